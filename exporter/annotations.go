@@ -0,0 +1,37 @@
+package exporter
+
+import (
+	"maps"
+	"time"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+)
+
+// Annotations of the manifests built in the rootfs view, telling where
+// the image comes from.
+const (
+	createdAnnotation = "org.opencontainers.image.created"
+	sourceAnnotation  = "io.plakar.source.location"
+	versionAnnotation = "io.plakar.version"
+)
+
+// sourceXattr is the extended attribute the importer sets on the
+// directory of an image to the repository it was imported from.
+const sourceXattr = "user.oci.source"
+
+// manifestAnnotations are the annotations of a manifest built from the
+// files restored: when the image was created, from the snapshot rather
+// than the clock so that the manifest of the same files is the same, the
+// repository it was imported from if known, and the version of the
+// integration, under those of the annotations option.
+func (exp *ociExporter) manifestAnnotations(created time.Time, source string) map[string]string {
+	annotations := map[string]string{versionAnnotation: storage.Version}
+	if !created.IsZero() {
+		annotations[createdAnnotation] = created.UTC().Format(time.RFC3339)
+	}
+	if source != "" {
+		annotations[sourceAnnotation] = source
+	}
+	maps.Copy(annotations, exp.annotations)
+	return annotations
+}
@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// configOverrides are the settings of the images built in the rootfs view
+// that the entrypoint, cmd, env, labels and workingdir options override in
+// their config, so that the files restored make an image that runs as
+// intended even without the config of an image.
+type configOverrides struct {
+	entrypoint []string
+	cmd        []string
+	env        []string
+	labels     map[string]string
+	workingDir string
+	set        bool
+}
+
+// parseConfigOverrides parses the options overriding the config of the
+// images built: entrypoint and cmd as a JSON array, e.g.
+// ["/bin/sh","-c"], or words separated by spaces, env and labels as
+// comma-separated key=value pairs.
+func parseConfigOverrides(config map[string]string) (configOverrides, error) {
+	var o configOverrides
+	var err error
+	if v := config["entrypoint"]; v != "" {
+		if o.entrypoint, err = parseCommand("entrypoint", v); err != nil {
+			return o, err
+		}
+		o.set = true
+	}
+	if v := config["cmd"]; v != "" {
+		if o.cmd, err = parseCommand("cmd", v); err != nil {
+			return o, err
+		}
+		o.set = true
+	}
+	if v := config["env"]; v != "" {
+		pairs, err := parsePairs("env", v)
+		if err != nil {
+			return o, err
+		}
+		for _, kv := range pairs {
+			o.env = append(o.env, kv[0]+"="+kv[1])
+		}
+		o.set = true
+	}
+	if v := config["labels"]; v != "" {
+		pairs, err := parsePairs("labels", v)
+		if err != nil {
+			return o, err
+		}
+		o.labels = map[string]string{}
+		for _, kv := range pairs {
+			o.labels[kv[0]] = kv[1]
+		}
+		o.set = true
+	}
+	if v := config["workingdir"]; v != "" {
+		if !strings.HasPrefix(v, "/") {
+			return o, fmt.Errorf("invalid workingdir %q, expected an absolute path", v)
+		}
+		o.workingDir = v
+		o.set = true
+	}
+	return o, nil
+}
+
+// parseCommand parses a command given as a JSON array of strings, or as
+// words separated by spaces.
+func parseCommand(key, v string) ([]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(v), "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(v), &args); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", key, v, err)
+		}
+		return args, nil
+	}
+	return strings.Fields(v), nil
+}
+
+// parsePairs parses comma-separated key=value pairs, in order.
+func parsePairs(key, v string) ([][2]string, error) {
+	var pairs [][2]string
+	for _, spec := range strings.Split(v, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(spec, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected key=value", key, spec)
+		}
+		pairs = append(pairs, [2]string{k, val})
+	}
+	return pairs, nil
+}
+
+// apply overrides the settings of the config of an image, the config
+// object of the image config: the entrypoint, command and working
+// directory are replaced, while variables and labels are set on top of
+// those of the config.
+func (o *configOverrides) apply(config map[string]json.RawMessage) error {
+	if !o.set {
+		return nil
+	}
+	// the settings not overridden are kept as they are
+	settings := map[string]json.RawMessage{}
+	if raw, ok := config["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &settings); err != nil {
+			return fmt.Errorf("decode config: %w", err)
+		}
+	}
+	set := func(key string, v any) {
+		raw, _ := json.Marshal(v)
+		settings[key] = raw
+	}
+
+	if o.entrypoint != nil {
+		set("Entrypoint", o.entrypoint)
+		if o.cmd == nil {
+			// the command of the config was arguments to the entrypoint
+			// replaced
+			delete(settings, "Cmd")
+		}
+	}
+	if o.cmd != nil {
+		set("Cmd", o.cmd)
+	}
+	if o.env != nil {
+		var env []string
+		if raw, ok := settings["Env"]; ok {
+			if err := json.Unmarshal(raw, &env); err != nil {
+				return fmt.Errorf("decode config Env: %w", err)
+			}
+		}
+		for _, kv := range o.env {
+			name, _, _ := strings.Cut(kv, "=")
+			i := slices.IndexFunc(env, func(cur string) bool {
+				curName, _, _ := strings.Cut(cur, "=")
+				return curName == name
+			})
+			if i >= 0 {
+				env[i] = kv
+			} else {
+				env = append(env, kv)
+			}
+		}
+		set("Env", env)
+	}
+	if o.labels != nil {
+		labels := map[string]string{}
+		if raw, ok := settings["Labels"]; ok {
+			if err := json.Unmarshal(raw, &labels); err != nil {
+				return fmt.Errorf("decode config Labels: %w", err)
+			}
+			if labels == nil {
+				labels = map[string]string{}
+			}
+		}
+		maps.Copy(labels, o.labels)
+		set("Labels", labels)
+	}
+	if o.workingDir != "" {
+		set("WorkingDir", o.workingDir)
+	}
+
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	config["config"] = raw
+	return nil
+}
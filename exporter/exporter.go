@@ -0,0 +1,309 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/connectors/exporter"
+	"github.com/PlakarKorp/kloset/location"
+)
+
+func init() {
+	for _, scheme := range storage.Schemes() {
+		exporter.Register(scheme, 0, New)
+	}
+}
+
+// options are the options of the exporter, on top of those of the store.
+var options = []string{
+	"annotations",
+	"cmd",
+	"dry_run",
+	"entrypoint",
+	"env",
+	"labels",
+	"layer_size",
+	"platform",
+	"tags",
+	"view",
+	"workingdir",
+}
+
+// Views, as named by the view option: the OCI image layout the importer
+// writes in its blobs view, pushed as it is, or files packaged into the
+// layers of a new image, such as the root filesystem of its rootfs view.
+const (
+	viewBlobs  = "blobs"
+	viewRootfs = "rootfs"
+)
+
+// defaultLayerSize is the size of the files packaged into a layer, past
+// which the next files go into a new one.
+const defaultLayerSize = 1 << 30
+
+// defaultPlatform is the platform of the images built from files without
+// the config of an image.
+const defaultPlatform = "linux/amd64"
+
+// ociExporter pushes the files of a restore to a repository of an OCI
+// registry, or to an OCI image layout on disk.
+type ociExporter struct {
+	dst target
+
+	// ref is the tag or digest of the image to push, empty to push every
+	// image of the layout, and tags the other tags it is pushed under
+	ref  string
+	tags []string
+
+	view string
+
+	// platform is that of the images built in the rootfs view, empty to
+	// keep that of the config restored along with the files, and
+	// layerSize the size of the files of each of their layers
+	platform  string
+	layerSize int64
+
+	// overrides are the settings of the config of the images built in
+	// the rootfs view, and annotations the annotations of their manifests
+	overrides   configOverrides
+	annotations map[string]string
+
+	// dryRun only reports what the export would push
+	dryRun bool
+
+	// stats counts what the export did
+	stats *pushStats
+}
+
+// New configures an exporter to the repository named by the location,
+// e.g. oci://ghcr.io/org/image:v1.2, oci://ghcr.io/org/image:v1.2,latest
+// to push the image under several tags, or oci://ghcr.io/org/image, or to
+// the image layout directory oci:///path or oci+dir:///path.  It accepts
+// the options of the store, from which it borrows the registry transport.
+func New(ctx context.Context, opts *connectors.Options, name string, config map[string]string) (exporter.Exporter, error) {
+	loc, tags := splitTags(config["location"])
+	loc, ref, err := storage.SplitReference(loc)
+	if err != nil {
+		return nil, err
+	}
+	exp := &ociExporter{ref: ref, view: viewBlobs, layerSize: defaultLayerSize}
+
+	if v := config["tags"]; v != "" {
+		tags = append(tags, strings.Split(v, ",")...)
+	}
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag == "" || tag == ref || slices.Contains(exp.tags, tag) {
+			continue
+		}
+		if !storage.ValidTag(tag) {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		exp.tags = append(exp.tags, tag)
+	}
+	if len(exp.tags) > 0 && ref == "" {
+		return nil, fmt.Errorf("tags need the tag or digest of the image to push in the location, e.g. %s:%s", loc, exp.tags[0])
+	}
+
+	switch v := config["view"]; v {
+	case "", viewBlobs:
+	case viewRootfs:
+		if ref == "" || strings.Contains(ref, ":") {
+			return nil, fmt.Errorf("view %s needs a tag in the location, e.g. %s:latest", viewRootfs, loc)
+		}
+		exp.view = v
+	default:
+		return nil, fmt.Errorf("invalid view %q, expected %s or %s", v, viewBlobs, viewRootfs)
+	}
+	if v := config["platform"]; v != "" {
+		if parts := strings.Split(v, "/"); len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+			return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", v)
+		}
+		exp.platform = v
+	}
+	if v := config["dry_run"]; v != "" {
+		if exp.dryRun, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid dry_run %q", v)
+		}
+	}
+	if v := config["layer_size"]; v != "" {
+		if exp.layerSize, err = storage.ParseSize(v); err != nil || exp.layerSize <= 0 {
+			return nil, fmt.Errorf("invalid layer_size %q", v)
+		}
+	}
+	if exp.overrides, err = parseConfigOverrides(config); err != nil {
+		return nil, err
+	}
+	if v := config["annotations"]; v != "" {
+		pairs, err := parsePairs("annotations", v)
+		if err != nil {
+			return nil, err
+		}
+		exp.annotations = map[string]string{}
+		for _, kv := range pairs {
+			exp.annotations[kv[0]] = kv[1]
+		}
+	}
+	if (exp.overrides.set || exp.annotations != nil) && exp.view != viewRootfs {
+		// the images of the layout are pushed as they were imported
+		return nil, fmt.Errorf("entrypoint, cmd, env, labels, workingdir and annotations need view=%s", viewRootfs)
+	}
+
+	if isLocalLocation(loc) {
+		var origin string
+		if opts != nil {
+			origin = opts.Hostname
+		}
+		exp.dst = newLayoutTarget(origin, loc)
+		return exp, nil
+	}
+
+	regConfig := maps.Clone(config)
+	regConfig["location"] = loc
+	for _, key := range options {
+		delete(regConfig, key)
+	}
+	reg, err := storage.NewRegistry(ctx, name, regConfig)
+	if err != nil {
+		return nil, err
+	}
+	if reg.Name() == "" {
+		return nil, fmt.Errorf("location %s names no repository", config["location"])
+	}
+	exp.dst = reg
+	return exp, nil
+}
+
+func (exp *ociExporter) Origin() string {
+	return exp.dst.Origin()
+}
+
+func (exp *ociExporter) Type() string {
+	return "oci"
+}
+
+func (exp *ociExporter) Root() string {
+	switch {
+	case exp.ref == "":
+		return exp.dst.Root()
+	case strings.Contains(exp.ref, ":"):
+		return exp.dst.Root() + "@" + exp.ref
+	}
+	return exp.dst.Root() + ":" + exp.ref
+}
+
+func (exp *ociExporter) Flags() location.Flags {
+	return 0
+}
+
+// Ping checks that the registry may be reached with the credentials in
+// use, or that the layout directory may be written.  The repository or
+// layout need not exist: pushing creates it.
+func (exp *ociExporter) Ping(ctx context.Context) error {
+	if err := exp.dst.Ping(ctx); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (exp *ociExporter) Close(ctx context.Context) error {
+	return exp.dst.Close(ctx)
+}
+
+// pusher pushes the files of a restore as they are received, and what
+// they make up once they all were.
+type pusher interface {
+	add(ctx context.Context, rec *connectors.Record) error
+	finish(ctx context.Context) (manifestBlob, error)
+}
+
+// Export pushes the files restored: the OCI image layout they hold in the
+// blobs view, or an image of their own in the rootfs view, then tags the
+// image under its other tags.  A file that cannot be pushed is reported
+// as such, and the export goes on; the export fails when the image cannot
+// be pushed, or tagged.  A dry run builds and reports everything but
+// pushes nothing, and fails when the credentials may not push.
+func (exp *ociExporter) Export(ctx context.Context, records <-chan *connectors.Record, results chan<- *connectors.Result) error {
+	exp.stats = &pushStats{}
+	var p pusher
+	if exp.view == viewRootfs {
+		rp := exp.newRootfsPush()
+		defer rp.close()
+		p = rp
+	} else {
+		p = exp.newLayoutPush()
+	}
+
+	for rec := range records {
+		if err := ctx.Err(); err != nil {
+			rec.Close()
+			return err
+		}
+		if rec.Err != nil {
+			results <- rec.Error(rec.Err)
+			continue
+		}
+		if err := p.add(ctx, rec); err != nil {
+			results <- rec.Error(err)
+			continue
+		}
+		results <- rec.Ok()
+	}
+	m, err := p.finish(ctx)
+	if err != nil {
+		return err
+	}
+	exp.report()
+	if err := exp.tag(ctx, m); err != nil {
+		return err
+	}
+	if exp.dryRun {
+		// the push would fail without the permission to push
+		return exp.dst.CanPush(ctx)
+	}
+	return nil
+}
+
+// tag pushes the manifest m, pushed already under the reference of the
+// location, under the other tags.  Its blobs are there already, and each
+// tag is a single request; a tag that fails is reported, and leaves the
+// others and the image pushed as they are.
+func (exp *ociExporter) tag(ctx context.Context, m manifestBlob) error {
+	var errs []error
+	for _, tag := range exp.tags {
+		digest, err := exp.pushManifest(ctx, tag, m.mediaType, m.raw)
+		if err != nil {
+			slog.Error("oci: failed to tag image", "repository", exp.dst.Root(), "tag", tag, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		exp.logPush("oci: tagged image", "repository", exp.dst.Root(), "tag", tag, "digest", digest)
+	}
+	return errors.Join(errs...)
+}
+
+// splitTags splits the tags past the first off a location naming several,
+// e.g. oci://ghcr.io/org/image:v1.2.3,v1.2,latest.
+func splitTags(loc string) (string, []string) {
+	base, query, hasQuery := strings.Cut(loc, "?")
+	name := base[strings.LastIndex(base, "/")+1:]
+	comma := strings.Index(name, ",")
+	if comma < 0 {
+		return loc, nil
+	}
+	comma += len(base) - len(name)
+	tags := strings.Split(base[comma+1:], ",")
+	base = base[:comma]
+	if hasQuery {
+		base += "?" + query
+	}
+	return base, tags
+}
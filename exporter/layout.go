@@ -0,0 +1,283 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// Media types of the manifests the exporter writes or tells apart.
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// refNameAnnotation holds the tag of the images of an index.json.
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// maxManifestSize bounds the manifests and indexes pushed, as registries
+// do; smaller blobs of the layout are read whole to tell them apart from
+// the others.
+const maxManifestSize = 4 << 20
+
+// maxIndexDepth bounds the nesting of indexes.
+const maxIndexDepth = 4
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// platform is the platform an image of an index runs on, as its config
+// tells.
+type platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+type imageIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type imageManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// manifestDoc is enough of a manifest or index to tell it from the other
+// blobs of a layout.
+type manifestDoc struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        json.RawMessage `json:"config"`
+	Manifests     json.RawMessage `json:"manifests"`
+}
+
+// mediaType is the media type of doc, when it is a manifest or an index.
+func (doc *manifestDoc) mediaType() (string, bool) {
+	if doc.SchemaVersion != 2 || (doc.Config == nil && doc.Manifests == nil) {
+		return "", false
+	}
+	switch {
+	case doc.MediaType != "":
+		return doc.MediaType, true
+	case doc.Manifests != nil:
+		return ociIndexMediaType, true
+	}
+	return ociManifestMediaType, true
+}
+
+// layoutPush pushes the OCI image layout the importer writes in its blobs
+// view, as it is: /oci-layout, /index.json and /blobs/sha256/<hex>, the
+// rest being metadata of the importer.  Blobs are pushed as they are
+// received, while manifests and indexes, which the registry only accepts
+// once what they reference is there, are kept until index.json tells
+// which images to push and under which tags.
+type layoutPush struct {
+	exp *ociExporter
+
+	layout    bool
+	index     []byte
+	manifests map[string]manifestBlob
+	pushed    map[string]bool
+}
+
+// manifestBlob is a manifest or index of the layout, as imported.
+type manifestBlob struct {
+	mediaType string
+	raw       []byte
+}
+
+func (exp *ociExporter) newLayoutPush() *layoutPush {
+	return &layoutPush{
+		exp:       exp,
+		manifests: map[string]manifestBlob{},
+		pushed:    map[string]bool{},
+	}
+}
+
+func (l *layoutPush) add(ctx context.Context, rec *connectors.Record) error {
+	if rec.IsXattr || !rec.FileInfo.Mode().IsRegular() {
+		return nil
+	}
+	switch {
+	case rec.Pathname == "/oci-layout":
+		l.layout = true
+	case rec.Pathname == "/index.json":
+		raw, err := readAll(rec.Reader, maxManifestSize)
+		if err != nil {
+			return err
+		}
+		l.index = raw
+	case path.Dir(rec.Pathname) == "/blobs/sha256":
+		return l.addBlob(ctx, "sha256:"+path.Base(rec.Pathname), rec)
+	}
+	return nil
+}
+
+// addBlob pushes the blob digest of the layout, unless it is a manifest
+// or an index.  Its content must match its digest, so that the images
+// pushed are those imported.
+func (l *layoutPush) addBlob(ctx context.Context, digest string, rec *connectors.Record) error {
+	if rec.FileInfo.Size() > maxManifestSize {
+		return l.exp.pushBlob(ctx, digest, rec.FileInfo.Size(), rec.Reader)
+	}
+
+	raw, err := readAll(rec.Reader, maxManifestSize)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(raw)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+		return &storage.DigestMismatchError{Ref: rec.Pathname, Expected: digest, Actual: actual}
+	}
+	var doc manifestDoc
+	if json.Unmarshal(raw, &doc) == nil {
+		if mediaType, ok := doc.mediaType(); ok {
+			l.manifests[digest] = manifestBlob{mediaType: mediaType, raw: raw}
+			return nil
+		}
+	}
+	return l.exp.pushBlob(ctx, digest, int64(len(raw)), bytes.NewReader(raw))
+}
+
+// finish pushes the manifests of the images of index.json, each under its
+// tag: that of the location, or the org.opencontainers.image.ref.name
+// annotation they were imported with.  Images without a tag are pushed
+// by digest.  It returns the manifest of the image the location names,
+// if any.
+func (l *layoutPush) finish(ctx context.Context) (manifestBlob, error) {
+	if !l.layout || l.index == nil {
+		return manifestBlob{}, fmt.Errorf("no OCI image layout restored, oci-layout or index.json missing: restore the root of an image imported in the %s view, or push files with view=%s", viewBlobs, viewRootfs)
+	}
+	var index imageIndex
+	if err := json.Unmarshal(l.index, &index); err != nil {
+		return manifestBlob{}, fmt.Errorf("decode index.json: %w", err)
+	}
+
+	ref := l.exp.ref
+	switch {
+	case ref == "":
+		tagged := map[string]bool{}
+		for _, desc := range index.Manifests {
+			tag := desc.Annotations[refNameAnnotation]
+			if !storage.ValidTag(tag) || tagged[tag] {
+				if tag != "" {
+					slog.Warn("oci: pushing image by digest", "digest", desc.Digest, "tag", tag)
+				}
+				tag = desc.Digest
+			}
+			tagged[tag] = true
+			if _, err := l.push(ctx, desc, tag, 0); err != nil {
+				return manifestBlob{}, err
+			}
+		}
+		return manifestBlob{}, nil
+
+	case storage.ValidTag(ref):
+		var found []descriptor
+		for _, desc := range index.Manifests {
+			if desc.Annotations[refNameAnnotation] == ref {
+				found = append(found, desc)
+			}
+		}
+		if len(found) == 0 && len(index.Manifests) == 1 {
+			found = index.Manifests
+		}
+		if len(found) != 1 {
+			return manifestBlob{}, fmt.Errorf("index.json has %d images tagged %s, expected one", len(found), ref)
+		}
+		return l.push(ctx, found[0], ref, 0)
+	}
+
+	m, ok := l.manifests[ref]
+	if !ok {
+		return manifestBlob{}, fmt.Errorf("manifest %s not found in the layout", ref)
+	}
+	return l.push(ctx, descriptor{MediaType: m.mediaType, Digest: ref}, ref, 0)
+}
+
+// push pushes the manifest desc under ref, a tag or its digest, after the
+// manifests it references when it is an index, and returns it.
+func (l *layoutPush) push(ctx context.Context, desc descriptor, ref string, depth int) (manifestBlob, error) {
+	m, ok := l.manifests[desc.Digest]
+	if !ok {
+		return manifestBlob{}, fmt.Errorf("manifest %s not found in the layout", desc.Digest)
+	}
+	if desc.MediaType != "" {
+		m.mediaType = desc.MediaType
+	}
+	if ref == desc.Digest && l.pushed[desc.Digest] {
+		return m, nil
+	}
+
+	var index imageIndex
+	if isIndex(m.mediaType) && json.Unmarshal(m.raw, &index) == nil {
+		if depth >= maxIndexDepth {
+			return manifestBlob{}, fmt.Errorf("index %s nests deeper than %d levels", desc.Digest, maxIndexDepth)
+		}
+		for _, child := range index.Manifests {
+			if _, ok := l.manifests[child.Digest]; !ok {
+				// not imported, such as the images of other platforms:
+				// the registry tells whether it holds them already
+				slog.Warn("oci: manifest of index not in the layout", "index", desc.Digest, "digest", child.Digest)
+				continue
+			}
+			if _, err := l.push(ctx, child, child.Digest, depth+1); err != nil {
+				return manifestBlob{}, err
+			}
+		}
+	}
+
+	digest, err := l.exp.pushManifest(ctx, ref, m.mediaType, m.raw)
+	if err != nil {
+		return manifestBlob{}, err
+	}
+	if digest != desc.Digest {
+		return manifestBlob{}, &storage.DigestMismatchError{Ref: ref, Expected: desc.Digest, Actual: digest}
+	}
+	l.pushed[desc.Digest] = true
+	if ref != desc.Digest {
+		l.exp.logPush("oci: pushed image", "repository", l.exp.dst.Root(), "tag", ref, "digest", digest)
+	}
+	return m, nil
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == ociIndexMediaType || mediaType == "application/vnd.docker.distribution.manifest.list.v2+json"
+}
+
+// readAll reads rd whole, refusing content larger than limit.
+func readAll(rd io.Reader, limit int64) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > limit {
+		return nil, fmt.Errorf("content exceeds %d bytes", limit)
+	}
+	return raw, nil
+}
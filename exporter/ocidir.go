@@ -0,0 +1,312 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+)
+
+// target is where images are pushed: a repository of a registry, or an
+// OCI image layout on disk.
+type target interface {
+	Origin() string
+	Root() string
+	Ping(ctx context.Context) error
+
+	// HasBlob reports whether the target holds the blob digest
+	HasBlob(ctx context.Context, digest string) (bool, error)
+
+	// PushBlob stores rd, the content of the blob digest, unless the
+	// target holds it already, and reports whether it was stored
+	PushBlob(ctx context.Context, digest string, rd io.Reader) (bool, error)
+
+	// PushManifest stores the manifest raw under ref, a tag or its
+	// digest, and returns its digest
+	PushManifest(ctx context.Context, ref, mediaType string, raw []byte) (string, error)
+
+	// CanPush checks that the target may be written
+	CanPush(ctx context.Context) error
+
+	Close(ctx context.Context) error
+}
+
+var _ target = (*storage.Registry)(nil)
+
+// layoutMarker is the file identifying an OCI image layout.
+const layoutMarker = "oci-layout"
+
+// isLocalLocation reports whether loc names an image layout directory,
+// oci+dir:///path or oci:///path, rather than a registry.
+func isLocalLocation(loc string) bool {
+	return strings.HasPrefix(loc, "oci+dir://") || strings.HasPrefix(loc, "oci:///")
+}
+
+// layoutTarget is an OCI image layout directory, such as skopeo copy
+// reads with oci:<dir>:<tag>: blobs are stored under blobs/sha256, and
+// the images pushed are listed in index.json, tagged with the
+// org.opencontainers.image.ref.name annotation.  An existing layout is
+// added to, its blobs are not written again and the images of other tags
+// are kept; the layout is created by the first push otherwise.
+type layoutTarget struct {
+	origin string
+	root   string
+
+	// index is index.json, once read
+	index *imageIndex
+}
+
+func newLayoutTarget(origin, loc string) *layoutTarget {
+	_, name, _ := strings.Cut(loc, "://")
+	return &layoutTarget{origin: origin, root: filepath.Clean(name)}
+}
+
+func (t *layoutTarget) Origin() string {
+	return t.origin
+}
+
+func (t *layoutTarget) Root() string {
+	return t.root
+}
+
+// Ping checks that the directory is an image layout, fs.ErrNotExist when
+// there is none yet.
+func (t *layoutTarget) Ping(ctx context.Context) error {
+	fi, err := os.Stat(t.root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", t.root)
+	}
+	_, err = t.readIndex()
+	return err
+}
+
+// readIndex reads index.json, checking the marker of the layout.  A
+// directory without either is an empty layout, for an empty or missing
+// directory to be written to.
+func (t *layoutTarget) readIndex() (*imageIndex, error) {
+	if t.index != nil {
+		return t.index, nil
+	}
+	index := &imageIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []descriptor{}}
+	raw, err := os.ReadFile(filepath.Join(t.root, layoutMarker))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		entries, err := os.ReadDir(t.root)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%s is neither empty nor an OCI image layout", t.root)
+		}
+		t.index = index
+		return index, nil
+	case err != nil:
+		return nil, err
+	}
+	var marker struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(raw, &marker); err != nil || marker.ImageLayoutVersion == "" {
+		return nil, fmt.Errorf("%s is not an OCI image layout: invalid %s", t.root, layoutMarker)
+	}
+
+	raw, err = os.ReadFile(filepath.Join(t.root, "index.json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(raw, index); err != nil {
+			return nil, fmt.Errorf("decode index.json of %s: %w", t.root, err)
+		}
+	}
+	t.index = index
+	return index, nil
+}
+
+// create creates the layout, unless it exists already.
+func (t *layoutTarget) create() error {
+	if _, err := t.readIndex(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(t.root, "blobs", "sha256"), 0o755); err != nil {
+		return err
+	}
+	pathname := filepath.Join(t.root, layoutMarker)
+	if _, err := os.Stat(pathname); err == nil {
+		return nil
+	}
+	return writeFile(pathname, []byte(`{"imageLayoutVersion":"1.0.0"}`))
+}
+
+// blobPath is the path of the blob digest in the layout.
+func (t *layoutTarget) blobPath(digest string) (string, error) {
+	algo, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" || len(hexDigest) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(t.root, "blobs", algo, hexDigest), nil
+}
+
+func (t *layoutTarget) HasBlob(ctx context.Context, digest string) (bool, error) {
+	pathname, err := t.blobPath(digest)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(pathname); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PushBlob writes rd to a temporary file next to the blob, moved in place
+// once its content is checked against digest, so that the layout never
+// holds a partial or corrupt blob.
+func (t *layoutTarget) PushBlob(ctx context.Context, digest string, rd io.Reader) (bool, error) {
+	if ok, err := t.HasBlob(ctx, digest); ok || err != nil {
+		return false, err
+	}
+	if err := t.create(); err != nil {
+		return false, err
+	}
+	pathname, _ := t.blobPath(digest)
+	f, err := os.CreateTemp(filepath.Dir(pathname), ".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), rd)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return false, &storage.DigestMismatchError{Ref: digest, Expected: digest, Actual: actual}
+	}
+	if err := os.Rename(f.Name(), pathname); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PushManifest stores raw as a blob and lists it in index.json: under the
+// tag ref, in place of the image it tagged if any, or untagged when ref
+// is its digest.  The images of an index pushed are not listed on their
+// own, as they are reached through it.
+func (t *layoutTarget) PushManifest(ctx context.Context, ref, mediaType string, raw []byte) (string, error) {
+	sum := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if _, err := t.PushBlob(ctx, digest, bytes.NewReader(raw)); err != nil {
+		return "", fmt.Errorf("put manifest %s: %w", ref, err)
+	}
+
+	index, err := t.readIndex()
+	if err != nil {
+		return "", err
+	}
+	desc := descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}
+	if ref != digest {
+		desc.Annotations = map[string]string{refNameAnnotation: ref}
+	}
+	var children imageIndex
+	if isIndex(mediaType) {
+		json.Unmarshal(raw, &children)
+	}
+	listed := false
+	index.Manifests = slices.DeleteFunc(index.Manifests, func(cur descriptor) bool {
+		switch name := cur.Annotations[refNameAnnotation]; {
+		case name != "":
+			// the image the tag named
+			listed = listed || cur.Digest == digest
+			return name == ref
+		case cur.Digest == digest:
+			listed = true
+			return ref != digest
+		}
+		// an image of the index, listed untagged when pushed
+		return slices.ContainsFunc(children.Manifests, func(child descriptor) bool {
+			return child.Digest == cur.Digest
+		})
+	})
+	if ref != digest || !listed {
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	out, err := json.Marshal(index)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(filepath.Join(t.root, "index.json"), out); err != nil {
+		return "", fmt.Errorf("put manifest %s: %w", ref, err)
+	}
+	return digest, nil
+}
+
+// CanPush checks that the layout, or the closest of its parents that
+// exists, may be written, by creating a file there and removing it.
+func (t *layoutTarget) CanPush(ctx context.Context) error {
+	if _, err := t.readIndex(); err != nil {
+		return err
+	}
+	dir := t.root
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("%s may not be written: %w", t.root, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (t *layoutTarget) Close(ctx context.Context) error {
+	return nil
+}
+
+// writeFile writes content to pathname through a temporary file renamed
+// in place, so that pathname is never seen half written.
+func writeFile(pathname string, content []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(pathname), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), pathname)
+}
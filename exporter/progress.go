@@ -0,0 +1,145 @@
+package exporter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the progress of a blob upload is
+// reported.
+const progressInterval = 5 * time.Second
+
+// pushStats counts what an export did, for the summary reported once it
+// is over: the blobs uploaded, and those skipped because the repository
+// held them already or they were mounted from another repository.  In a
+// dry run, the blobs that would be uploaded and those the repository
+// holds already.
+type pushStats struct {
+	uploaded      atomic.Int64
+	uploadedBytes atomic.Int64
+	skipped       atomic.Int64
+	skippedBytes  atomic.Int64
+}
+
+func (exp *ociExporter) report() {
+	st := exp.stats
+	if exp.dryRun {
+		slog.Info("oci: dry run done, nothing pushed",
+			"repository", exp.Root(),
+			"would_upload", st.uploaded.Load(),
+			"would_upload_bytes", st.uploadedBytes.Load(),
+			"exists", st.skipped.Load(),
+			"exists_bytes", st.skippedBytes.Load())
+		return
+	}
+	slog.Info("oci: export done",
+		"repository", exp.Root(),
+		"uploaded", st.uploaded.Load(),
+		"uploaded_bytes", st.uploadedBytes.Load(),
+		"skipped", st.skipped.Load(),
+		"skipped_bytes", st.skippedBytes.Load())
+}
+
+// pushBlob pushes rd, the content of the blob digest of the given size,
+// unless the repository holds it already, and counts it.  A dry run only
+// tells whether the repository holds it.
+func (exp *ociExporter) pushBlob(ctx context.Context, digest string, size int64, rd io.Reader) error {
+	var uploaded bool
+	var err error
+	if exp.dryRun {
+		var exists bool
+		if exists, err = exp.dst.HasBlob(ctx, digest); err == nil {
+			uploaded = !exists
+			status := "exists"
+			if uploaded {
+				status = "would upload"
+			}
+			slog.Info("oci: dry run: blob", "digest", digest, "size", size, "status", status)
+		}
+	} else {
+		uploaded, err = exp.dst.PushBlob(ctx, digest, newProgressReader(rd, digest, size))
+	}
+	if err != nil {
+		return err
+	}
+	if uploaded {
+		exp.stats.uploaded.Add(1)
+		exp.stats.uploadedBytes.Add(size)
+	} else {
+		exp.stats.skipped.Add(1)
+		exp.stats.skippedBytes.Add(size)
+	}
+	return nil
+}
+
+// pushManifest puts the manifest raw, of the given media type, under ref
+// and returns its digest.  A dry run reports it instead.
+func (exp *ociExporter) pushManifest(ctx context.Context, ref, mediaType string, raw []byte) (string, error) {
+	if !exp.dryRun {
+		return exp.dst.PushManifest(ctx, ref, mediaType, raw)
+	}
+	sum := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	slog.Info("oci: dry run: manifest", "reference", ref, "digest", digest, "media_type", mediaType, "manifest", string(raw))
+	return digest, nil
+}
+
+// logPush reports a manifest pushed, which a dry run reported already as
+// it would be.
+func (exp *ociExporter) logPush(msg string, args ...any) {
+	if !exp.dryRun {
+		slog.Info(msg, args...)
+	}
+}
+
+// progressReader reports how much of a blob was pushed, every
+// progressInterval, as the upload reads it.
+type progressReader struct {
+	rd     io.Reader
+	digest string
+	size   int64
+	n      int64
+	last   time.Time
+}
+
+// newProgressReader returns rd reporting its progress, and seekable if rd
+// is, so that the upload can still be retried.
+func newProgressReader(rd io.Reader, digest string, size int64) io.Reader {
+	p := &progressReader{rd: rd, digest: digest, size: size, last: time.Now()}
+	if rs, ok := rd.(io.ReadSeeker); ok {
+		if start, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			return &progressSeeker{progressReader: p, start: start}
+		}
+	}
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.rd.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		slog.Info("oci: pushing blob", "digest", p.digest, "bytes", p.n, "total", p.size)
+	}
+	return n, err
+}
+
+// progressSeeker is a progressReader over a seekable blob, counting from
+// where it is rewound to.
+type progressSeeker struct {
+	*progressReader
+	start int64
+}
+
+func (p *progressSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.rd.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		p.n = pos - p.start
+	}
+	return pos, err
+}
@@ -0,0 +1,624 @@
+package exporter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// configPath is where the importer stores the config of an image in the
+// directory of its root filesystem.
+const configPath = "/.oci/config.json"
+
+// maxConfigSize bounds the config restored along with the files.
+const maxConfigSize = 16 << 20
+
+// maxXattrSize bounds the extended attributes read.
+const maxXattrSize = 64 << 10
+
+// gzipUnknownOS is the OS byte of the gzip header of layers, as Go and
+// most image builders write it.
+const gzipUnknownOS = 255
+
+// rootfsPush packages the files restored into the tar+gzip layers of a
+// new image, a layer holding files of about layerSize bytes, and pushes
+// it under the tag of the location.  The config the importer stores with
+// the root filesystem of an image is kept, so that the image pushed runs
+// as the one imported.
+//
+// The root filesystems of a multi-platform image, which the importer
+// writes in one /<os>/<arch>[/<variant>] directory per platform, each
+// make an image of their own, pushed by digest, and the tag names an
+// index of them.  Such a tree is told apart from a root filesystem by its
+// first directory being named after an operating system, and the
+// platform of each image is that of its config, or that of its directory
+// without one.
+//
+// Layers are reproducible, so that exporting a snapshot again pushes the
+// same blobs and manifest, which the registry holds already: files are
+// packaged in the lexical order of their paths, whatever the order the
+// restore delivers them in, with the times, owners and modes it recorded,
+// and the times of the image are those of its latest file rather than of
+// the export.  Until they all were received, the contents of the files of
+// an image are staged in a temporary file, and their headers in memory.
+type rootfsPush struct {
+	exp *ociExporter
+
+	// multi tells whether the files are the root filesystems of several
+	// platforms, once decided from the first of them
+	decided bool
+	multi   bool
+
+	// images are the images being built, by directory, and sources the
+	// repositories the importer tells they come from
+	images  map[string]*imageBuild
+	sources map[string]string
+
+	// err is the failure that left the files unusable, which fails the
+	// export
+	err error
+}
+
+// imageBuild is the image built from the root filesystem in a directory.
+type imageBuild struct {
+	dir string
+
+	// platform is that of the image, empty to keep that of its config
+	platform string
+
+	config []byte
+
+	// files are those of the root filesystem, as received, and staging
+	// the temporary file holding their contents until they are packaged
+	files   []stagedFile
+	staging *os.File
+
+	layer  *layerWriter
+	layers []descriptor
+	diffs  []string
+
+	// modTime is the latest modification time of the files packaged
+	modTime time.Time
+
+	// err is the failure that left the layer being written unusable,
+	// which fails the export
+	err error
+}
+
+// stagedFile is a file waiting to be packaged: its tar header, and where
+// its content lies in the staging file.
+type stagedFile struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+// operatingSystems are the names of the first directory of the trees of
+// multi-platform images, those Go knows of.
+var operatingSystems = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true,
+	"freebsd": true, "illumos": true, "ios": true, "linux": true,
+	"netbsd": true, "openbsd": true, "plan9": true, "solaris": true,
+	"windows": true,
+}
+
+// variantRegexp matches the variants of platforms, e.g. v7 or v8.
+var variantRegexp = regexp.MustCompile(`^v[0-9]+$`)
+
+func (exp *ociExporter) newRootfsPush() *rootfsPush {
+	return &rootfsPush{exp: exp, images: map[string]*imageBuild{}, sources: map[string]string{}}
+}
+
+func (r *rootfsPush) add(ctx context.Context, rec *connectors.Record) error {
+	if r.err != nil {
+		return r.err
+	}
+	if rec.IsXattr {
+		if rec.XattrName == sourceXattr {
+			raw, err := readAll(rec.Reader, maxXattrSize)
+			if err != nil {
+				return err
+			}
+			r.sources[rec.Pathname] = string(raw)
+		}
+		return nil
+	}
+	if rec.Pathname == "/" {
+		return nil
+	}
+	if !r.decided {
+		r.decided = true
+		name := strings.TrimPrefix(rec.Pathname, "/")
+		r.multi = rec.FileInfo.Mode().IsDir() && operatingSystems[name]
+		if r.multi && r.exp.platform != "" {
+			r.err = fmt.Errorf("platform does not apply to the root filesystems of several platforms, found under /%s", name)
+			return r.err
+		}
+	}
+
+	if !r.multi {
+		return r.image("/", r.exp.platform).add(rec.Pathname, rec)
+	}
+	dir, pathname, ok := r.platformDir(rec.Pathname)
+	if !ok {
+		if rec.FileInfo.Mode().IsDir() {
+			return nil
+		}
+		return fmt.Errorf("not in the directory of a platform, e.g. /linux/amd64")
+	}
+	if pathname == "/" {
+		return nil
+	}
+	return r.image(dir, "").add(pathname, rec)
+}
+
+// platformDir splits pathname into the /<os>/<arch>[/<variant>] directory
+// of a platform and the path of the file within its root filesystem.  A
+// variant is only told apart from the files of a platform without one
+// before the first of them.
+func (r *rootfsPush) platformDir(pathname string) (dir, name string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(pathname, "/"), "/", 4)
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	n := 2
+	if _, ok := r.images["/"+path.Join(parts[:2]...)]; !ok && len(parts) > 2 && variantRegexp.MatchString(parts[2]) {
+		n = 3
+	}
+	if len(parts) > n {
+		name = path.Join(parts[n:]...)
+	}
+	return "/" + path.Join(parts[:n]...), "/" + name, true
+}
+
+// image is the image built from the files of dir, platform being that of
+// the image unless its config tells.
+func (r *rootfsPush) image(dir, platform string) *imageBuild {
+	b, ok := r.images[dir]
+	if !ok {
+		b = &imageBuild{dir: dir, platform: platform}
+		r.images[dir] = b
+	}
+	return b
+}
+
+// finish pushes the last layer of each image, then its config and
+// manifest, tagged as the location tells, or the index of the images of
+// every platform under that tag, which it returns.
+func (r *rootfsPush) finish(ctx context.Context) (manifestBlob, error) {
+	if r.err != nil {
+		return manifestBlob{}, r.err
+	}
+	if !r.multi {
+		img, err := r.image("/", r.exp.platform).push(ctx, r.exp, r.exp.ref, r.sources["/"])
+		if err != nil {
+			return manifestBlob{}, err
+		}
+		r.exp.logPush("oci: pushed image", "repository", r.exp.dst.Root(), "tag", r.exp.ref, "digest", img.Digest, "layers", img.layers)
+		return manifestBlob{mediaType: ociManifestMediaType, raw: img.raw}, nil
+	}
+
+	index := imageIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []descriptor{}}
+	var created time.Time
+	var sources []string
+	for _, dir := range slices.Sorted(maps.Keys(r.images)) {
+		img, err := r.images[dir].push(ctx, r.exp, "", r.sources[dir])
+		if err != nil {
+			return manifestBlob{}, fmt.Errorf("%s: %w", dir, err)
+		}
+		index.Manifests = append(index.Manifests, img.descriptor)
+		if img.created.After(created) {
+			created = img.created
+		}
+		if !slices.Contains(sources, r.sources[dir]) {
+			sources = append(sources, r.sources[dir])
+		}
+	}
+	if len(index.Manifests) == 0 {
+		return manifestBlob{}, fmt.Errorf("no root filesystem restored in the directories of platforms")
+	}
+	// the index is as recent as its latest image, and comes from the
+	// repository its images come from, if they agree
+	source := ""
+	if len(sources) == 1 {
+		source = sources[0]
+	}
+	index.Annotations = r.exp.manifestAnnotations(created, source)
+	raw, err := json.Marshal(index)
+	if err != nil {
+		return manifestBlob{}, err
+	}
+	digest, err := r.exp.pushManifest(ctx, r.exp.ref, ociIndexMediaType, raw)
+	if err != nil {
+		return manifestBlob{}, err
+	}
+	r.exp.logPush("oci: pushed image", "repository", r.exp.dst.Root(), "tag", r.exp.ref, "digest", digest, "platforms", len(index.Manifests))
+	return manifestBlob{mediaType: ociIndexMediaType, raw: raw}, nil
+}
+
+func (r *rootfsPush) close() {
+	for _, b := range r.images {
+		if b.layer != nil {
+			b.layer.remove()
+		}
+		if b.staging != nil {
+			b.staging.Close()
+			os.Remove(b.staging.Name())
+		}
+	}
+}
+
+// add stages the file rec, at pathname in the root filesystem of the
+// image, to be packaged once all were received.  A file whose content
+// cannot be read is left out.
+func (b *imageBuild) add(pathname string, rec *connectors.Record) error {
+	if b.err != nil {
+		return b.err
+	}
+	if pathname == "/" {
+		return nil
+	}
+	if pathname == "/.oci" || strings.HasPrefix(pathname, "/.oci/") {
+		if pathname == configPath && rec.FileInfo.Mode().IsRegular() {
+			raw, err := readAll(rec.Reader, maxConfigSize)
+			if err != nil {
+				return err
+			}
+			b.config = raw
+		}
+		return nil
+	}
+
+	hdr, err := tarHeader(pathname, rec)
+	if err != nil {
+		return err
+	}
+	if b.staging == nil {
+		if b.staging, err = os.CreateTemp("", "plakar-oci-staging-*"); err != nil {
+			b.err = err
+			return err
+		}
+	}
+	offset, err := b.staging.Seek(0, io.SeekCurrent)
+	if err != nil {
+		b.err = err
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		n, err := io.Copy(b.staging, rec.Reader)
+		if err == nil && n != hdr.Size {
+			err = fmt.Errorf("read %d bytes, expected %d", n, hdr.Size)
+		}
+		if err != nil {
+			// the next file overwrites what was staged of this one
+			if _, serr := b.staging.Seek(offset, io.SeekStart); serr != nil {
+				b.err = serr
+			}
+			return err
+		}
+	}
+	if hdr.ModTime.After(b.modTime) {
+		b.modTime = hdr.ModTime
+	}
+	b.files = append(b.files, stagedFile{hdr: hdr, offset: offset})
+	return nil
+}
+
+// packLayers packages the files staged into layers, in the lexical order
+// of their paths, which puts directories before their files, and pushes
+// each layer once it holds files of layerSize bytes.  The last layer is
+// left to push.
+func (b *imageBuild) packLayers(ctx context.Context, exp *ociExporter) error {
+	slices.SortFunc(b.files, func(x, y stagedFile) int {
+		return strings.Compare(strings.TrimSuffix(x.hdr.Name, "/"), strings.TrimSuffix(y.hdr.Name, "/"))
+	})
+	for _, f := range b.files {
+		if b.layer == nil {
+			var err error
+			if b.layer, err = newLayerWriter(); err != nil {
+				return err
+			}
+		}
+		var rd io.Reader
+		if f.hdr.Typeflag == tar.TypeReg {
+			rd = io.NewSectionReader(b.staging, f.offset, f.hdr.Size)
+		}
+		if err := b.layer.add(f.hdr, rd); err != nil {
+			return fmt.Errorf("layer %d: %w", len(b.layers)+1, err)
+		}
+		if b.layer.size >= exp.layerSize {
+			if err := b.pushLayer(ctx, exp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pushLayer pushes the layer being written.
+func (b *imageBuild) pushLayer(ctx context.Context, exp *ociExporter) error {
+	desc, diff, err := b.layer.push(ctx, exp)
+	b.layer.remove()
+	b.layer = nil
+	if err != nil {
+		b.err = fmt.Errorf("layer %d: %w", len(b.layers)+1, err)
+		return b.err
+	}
+	b.layers = append(b.layers, desc)
+	b.diffs = append(b.diffs, diff)
+	return nil
+}
+
+// builtImage is the descriptor of an image pushed, with its platform, its
+// manifest, the number of its layers and when it was created.
+type builtImage struct {
+	descriptor
+	raw     []byte
+	layers  int
+	created time.Time
+}
+
+// push packages and pushes the layers, then the config and manifest of
+// the image, under ref, or by digest when empty, annotated with source,
+// the repository it comes from if known.
+func (b *imageBuild) push(ctx context.Context, exp *ociExporter, ref, source string) (builtImage, error) {
+	if b.err != nil {
+		return builtImage{}, b.err
+	}
+	if err := b.packLayers(ctx, exp); err != nil {
+		return builtImage{}, err
+	}
+	if b.layer != nil || len(b.layers) == 0 {
+		if b.layer == nil {
+			var err error
+			if b.layer, err = newLayerWriter(); err != nil {
+				return builtImage{}, err
+			}
+		}
+		if err := b.pushLayer(ctx, exp); err != nil {
+			return builtImage{}, err
+		}
+	}
+
+	config, platform, created, err := b.imageConfig(&exp.overrides)
+	if err != nil {
+		return builtImage{}, err
+	}
+	sum := sha256.Sum256(config)
+	cfgDigest := "sha256:" + hex.EncodeToString(sum[:])
+	if err := exp.pushBlob(ctx, cfgDigest, int64(len(config)), bytes.NewReader(config)); err != nil {
+		return builtImage{}, fmt.Errorf("config: %w", err)
+	}
+	raw, err := json.Marshal(imageManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        descriptor{MediaType: ociConfigMediaType, Digest: cfgDigest, Size: int64(len(config))},
+		Layers:        b.layers,
+		Annotations:   exp.manifestAnnotations(created, source),
+	})
+	if err != nil {
+		return builtImage{}, err
+	}
+	sum = sha256.Sum256(raw)
+	desc := descriptor{MediaType: ociManifestMediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(raw)), Platform: platform}
+	if ref == "" {
+		ref = desc.Digest
+	}
+	if _, err := exp.pushManifest(ctx, ref, ociManifestMediaType, raw); err != nil {
+		return builtImage{}, err
+	}
+	return builtImage{descriptor: desc, raw: raw, layers: len(b.layers), created: created}, nil
+}
+
+// imageConfig is the config of the image, along with its platform and
+// creation time: that restored along with the files, or one for the
+// platform of the image, with the layers pushed and the settings of
+// overrides.  The history of the image imported does not describe these
+// layers, and is replaced.  Its times are that of the latest file, or the
+// Unix epoch without any, so that the config of the same files is the
+// same.
+func (b *imageBuild) imageConfig(overrides *configOverrides) ([]byte, *platform, time.Time, error) {
+	config := map[string]json.RawMessage{}
+	if b.config != nil {
+		if err := json.Unmarshal(b.config, &config); err != nil {
+			return nil, nil, time.Time{}, fmt.Errorf("decode %s: %w", configPath, err)
+		}
+	}
+	set := func(key string, v any) {
+		raw, _ := json.Marshal(v)
+		config[key] = raw
+	}
+
+	var p platform
+	if b.config != nil {
+		// the platform fields of a config are those of descriptors
+		json.Unmarshal(b.config, &p)
+	}
+	name := b.platform
+	switch {
+	case name == "" && b.dir != "/" && (p.OS == "" || p.Architecture == ""):
+		// the platform of its directory, for want of a config telling
+		name = strings.TrimPrefix(b.dir, "/")
+	case name == "" && b.config == nil:
+		name = defaultPlatform
+	}
+	if name != "" {
+		parts := strings.SplitN(name, "/", 3)
+		p = platform{OS: parts[0], Architecture: parts[1]}
+		set("os", parts[0])
+		set("architecture", parts[1])
+		delete(config, "variant")
+		if len(parts) == 3 {
+			p.Variant = parts[2]
+			set("variant", parts[2])
+		}
+	}
+
+	created := time.Unix(0, 0).UTC()
+	if !b.modTime.IsZero() {
+		created = b.modTime.UTC()
+	}
+	history := make([]map[string]any, len(b.layers))
+	for i := range history {
+		history[i] = map[string]any{"created": created, "created_by": "plakar restore"}
+	}
+	if raw, ok := config["created"]; ok {
+		// that of the image imported
+		var t time.Time
+		if json.Unmarshal(raw, &t) == nil {
+			created = t
+		}
+	} else {
+		set("created", created)
+	}
+	set("history", history)
+	set("rootfs", map[string]any{"type": "layers", "diff_ids": b.diffs})
+	if err := overrides.apply(config); err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("%s: %w", configPath, err)
+	}
+	raw, err := json.Marshal(config)
+	return raw, &p, created, err
+}
+
+// layerWriter writes a tar+gzip layer to a temporary file, hashing it for
+// its digest, and the uncompressed tar for the diff ID the config lists.
+// The gzip header carries neither name nor time, and an unknown OS, so
+// that the same entries always compress to the same layer.
+type layerWriter struct {
+	f    *os.File
+	gz   *gzip.Writer
+	tw   *tar.Writer
+	blob hash.Hash
+	diff hash.Hash
+	size int64
+}
+
+func newLayerWriter() (*layerWriter, error) {
+	f, err := os.CreateTemp("", "plakar-oci-layer-*")
+	if err != nil {
+		return nil, err
+	}
+	w := &layerWriter{f: f, blob: sha256.New(), diff: sha256.New()}
+	w.gz = gzip.NewWriter(io.MultiWriter(f, w.blob))
+	w.gz.Header = gzip.Header{OS: gzipUnknownOS}
+	w.tw = tar.NewWriter(io.MultiWriter(w.gz, w.diff))
+	return w, nil
+}
+
+// add writes the entry hdr, and the content of rd for regular files.
+func (w *layerWriter) add(hdr *tar.Header, rd io.Reader) error {
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		n, err := io.Copy(w.tw, rd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if n != hdr.Size {
+			return fmt.Errorf("%s: read %d bytes, expected %d", hdr.Name, n, hdr.Size)
+		}
+		w.size += n
+	}
+	return nil
+}
+
+// push completes the layer and pushes it, returning its descriptor and
+// diff ID.
+func (w *layerWriter) push(ctx context.Context, exp *ociExporter) (descriptor, string, error) {
+	if err := w.tw.Close(); err != nil {
+		return descriptor{}, "", err
+	}
+	if err := w.gz.Close(); err != nil {
+		return descriptor{}, "", err
+	}
+	size, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return descriptor{}, "", err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return descriptor{}, "", err
+	}
+	desc := descriptor{MediaType: ociLayerMediaType, Digest: "sha256:" + hex.EncodeToString(w.blob.Sum(nil)), Size: size}
+	if err := exp.pushBlob(ctx, desc.Digest, desc.Size, w.f); err != nil {
+		return descriptor{}, "", err
+	}
+	return desc, "sha256:" + hex.EncodeToString(w.diff.Sum(nil)), nil
+}
+
+func (w *layerWriter) remove() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// tarHeader is the tar header of the file rec, at pathname in the root
+// filesystem, from what the snapshot recorded of it only: its
+// modification time, to the second, without access or change time, and
+// its numeric and named owners.
+func tarHeader(pathname string, rec *connectors.Record) (*tar.Header, error) {
+	fi := rec.FileInfo
+	mode := fi.Mode()
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(pathname, "/"),
+		Mode:    int64(mode.Perm()),
+		ModTime: fi.ModTime().Truncate(time.Second),
+		Uid:     int(fi.Luid),
+		Gid:     int(fi.Lgid),
+		Uname:   fi.Lusername,
+		Gname:   fi.Lgroupname,
+		Format:  tar.FormatPAX,
+	}
+	if mode&fs.ModeSetuid != 0 {
+		hdr.Mode |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		hdr.Mode |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		hdr.Mode |= 0o1000
+	}
+
+	switch {
+	case mode.IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = fi.Size()
+	case mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case mode&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = rec.Target
+	case mode&fs.ModeDevice != 0:
+		hdr.Typeflag = tar.TypeBlock
+		if mode&fs.ModeCharDevice != 0 {
+			hdr.Typeflag = tar.TypeChar
+		}
+		hdr.Devmajor, hdr.Devminor = devNumbers(fi.Ldev)
+	case mode&fs.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("cannot package file of type %s", mode.Type())
+	}
+	return hdr, nil
+}
+
+// devNumbers decodes a device number the way Linux encodes it.
+func devNumbers(dev uint64) (major, minor int64) {
+	return int64((dev>>8)&0xfff | (dev>>32)&0xfffff000), int64(dev&0xff | (dev>>12)&0xffffff00)
+}
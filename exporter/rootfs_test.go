@@ -0,0 +1,242 @@
+package exporter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// file is a file of a root filesystem restored, a directory when its
+// name ends with a slash.
+type file struct {
+	name    string
+	content string
+}
+
+// rootfsFiles are the files of a small root filesystem, larger than the
+// layers they are exported in.
+var rootfsFiles = []file{
+	{name: "/.oci/"},
+	{name: "/.oci/config.json", content: `{"architecture":"amd64","os":"linux","config":{"Cmd":["sh"]}}`},
+	{name: "/bin/"},
+	{name: "/bin/sh", content: strings.Repeat("sh", 700)},
+	{name: "/etc/"},
+	{name: "/etc/hosts", content: "127.0.0.1 localhost\n"},
+	{name: "/etc/passwd", content: strings.Repeat("root:x:0:0::/root:/bin/sh\n", 60)},
+	{name: "/etc-old/"},
+	{name: "/etc.d/"},
+	{name: "/usr/"},
+	{name: "/usr/lib/"},
+	{name: "/usr/lib/libc.so", content: strings.Repeat("\x7fELF", 400)},
+	{name: "/var/"},
+}
+
+// export exports files, in the order given, in the rootfs view to a new
+// image layout directory, and returns the directory.
+func export(t *testing.T, files []file, config map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	config["location"] = "oci://" + dir + ":latest"
+	config["view"] = viewRootfs
+	exp, err := New(context.Background(), nil, "oci", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(chan *connectors.Record, len(files))
+	results := make(chan *connectors.Result, len(files))
+	for _, f := range files {
+		name := strings.TrimSuffix(f.name, "/")
+		mode := fs.FileMode(0o644)
+		if strings.HasSuffix(f.name, "/") {
+			mode = fs.ModeDir | 0o755
+		}
+		fi := objects.NewFileInfo(path.Base(name), int64(len(f.content)), mode, time.Date(2024, 5, 1, 12, 0, len(f.content), 0, time.UTC), 0, 0, 0, 0, 1)
+		content := f.content
+		records <- connectors.NewRecord(name, "", fi, nil, func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(content)), nil
+		})
+	}
+	close(records)
+	if err := exp.Export(context.Background(), records, results); err != nil {
+		t.Fatal(err)
+	}
+	close(results)
+	for res := range results {
+		if res.Err != nil {
+			t.Errorf("%s: %v", res.Record.Pathname, res.Err)
+		}
+	}
+	if err := exp.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// readBlob reads the blob digest of the image layout in dir.
+func readBlob(t *testing.T, dir, digest string) []byte {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join(dir, "blobs", strings.Replace(digest, ":", "/", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// readImage returns the manifest of the only image of the layout in dir.
+func readImage(t *testing.T, dir string) (descriptor, imageManifest) {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index imageIndex
+	if err := json.Unmarshal(raw, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("%d images in index.json, want 1", len(index.Manifests))
+	}
+	var m imageManifest
+	if err := json.Unmarshal(readBlob(t, dir, index.Manifests[0].Digest), &m); err != nil {
+		t.Fatal(err)
+	}
+	return index.Manifests[0], m
+}
+
+// layerTar returns the uncompressed tar of the layer desc.
+func layerTar(t *testing.T, dir string, desc descriptor) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(readBlob(t, dir, desc.Digest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// TestRootfsExportTwice exports the same files twice, received in
+// another order the second time, and expects the same layers and
+// manifest, their entries in the lexical order of their paths.
+func TestRootfsExportTwice(t *testing.T) {
+	shuffled := slices.Clone(rootfsFiles)
+	slices.Reverse(shuffled)
+	shuffled[0], shuffled[5] = shuffled[5], shuffled[0]
+
+	first := export(t, rootfsFiles, map[string]string{"layer_size": "1KiB"})
+	second := export(t, shuffled, map[string]string{"layer_size": "1KiB"})
+
+	desc1, m1 := readImage(t, first)
+	desc2, m2 := readImage(t, second)
+	if len(m1.Layers) < 2 {
+		t.Fatalf("%d layers, want several", len(m1.Layers))
+	}
+	if len(m1.Layers) != len(m2.Layers) {
+		t.Fatalf("%d layers, then %d", len(m1.Layers), len(m2.Layers))
+	}
+	for i := range m1.Layers {
+		if m1.Layers[i].Digest != m2.Layers[i].Digest {
+			t.Errorf("layer %d: digest %s, then %s", i+1, m1.Layers[i].Digest, m2.Layers[i].Digest)
+		}
+	}
+	if desc1.Digest != desc2.Digest {
+		t.Errorf("manifest digest %s, then %s", desc1.Digest, desc2.Digest)
+	}
+
+	var names []string
+	for _, layer := range m1.Layers {
+		tr := tar.NewReader(bytes.NewReader(layerTar(t, first, layer)))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+	}
+	want := []string{"bin/", "bin/sh", "etc/", "etc-old/", "etc.d/", "etc/hosts", "etc/passwd", "usr/", "usr/lib/", "usr/lib/libc.so", "var/"}
+	if !slices.Equal(names, want) {
+		t.Errorf("entries %q, want %q", names, want)
+	}
+}
+
+// TestRootfsDiffIDs checks the layers and config of an image exported as
+// a runtime pulling it would: the digest of each layer is that of its
+// blob, its diff ID in the config that of its uncompressed tar, and the
+// config carries the overrides.
+func TestRootfsDiffIDs(t *testing.T) {
+	dir := export(t, rootfsFiles, map[string]string{
+		"layer_size": "1KiB",
+		"entrypoint": `["/bin/sh","-c"]`,
+		"env":        "PATH=/bin",
+		"labels":     "org.example=1",
+	})
+	_, m := readImage(t, dir)
+
+	var config struct {
+		Config struct {
+			Entrypoint []string
+			Cmd        []string
+			Env        []string
+			Labels     map[string]string
+		} `json:"config"`
+		RootFS struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	raw := readBlob(t, dir, m.Config.Digest)
+	if digest := sha256Digest(raw); digest != m.Config.Digest {
+		t.Fatalf("config digest %s, blob hashes to %s", m.Config.Digest, digest)
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.RootFS.Type != "layers" || len(config.RootFS.DiffIDs) != len(m.Layers) || len(m.Layers) < 2 {
+		t.Fatalf("rootfs of type %q with %d diff IDs, for %d layers", config.RootFS.Type, len(config.RootFS.DiffIDs), len(m.Layers))
+	}
+	for i, layer := range m.Layers {
+		blob := readBlob(t, dir, layer.Digest)
+		if digest := sha256Digest(blob); digest != layer.Digest || int64(len(blob)) != layer.Size {
+			t.Errorf("layer %d: digest %s of %d bytes, blob hashes to %s of %d bytes", i+1, layer.Digest, layer.Size, digest, len(blob))
+		}
+		if diff := sha256Digest(layerTar(t, dir, layer)); diff != config.RootFS.DiffIDs[i] {
+			t.Errorf("layer %d: diff ID %s, uncompressed tar hashes to %s", i+1, config.RootFS.DiffIDs[i], diff)
+		}
+	}
+
+	// the entrypoint given drops the command of the config restored
+	if !slices.Equal(config.Config.Entrypoint, []string{"/bin/sh", "-c"}) || config.Config.Cmd != nil {
+		t.Errorf("entrypoint %q and cmd %q", config.Config.Entrypoint, config.Config.Cmd)
+	}
+	if !slices.Contains(config.Config.Env, "PATH=/bin") || config.Config.Labels["org.example"] != "1" {
+		t.Errorf("env %q and labels %v", config.Config.Env, config.Config.Labels)
+	}
+}
+
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,133 @@
+package exporter
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// containerRuntime returns the first container runtime found that
+// answers, for the tests loading images into a real one, and skips the
+// test when none does.
+func containerRuntime(t *testing.T) string {
+	t.Helper()
+	for _, name := range []string{"podman", "docker"} {
+		if _, err := exec.LookPath(name); err != nil {
+			continue
+		}
+		if err := exec.Command(name, "info").Run(); err != nil {
+			t.Logf("%s info: %v", name, err)
+			continue
+		}
+		return name
+	}
+	t.Skip("no container runtime available")
+	return ""
+}
+
+// run runs a command of the container runtime and returns its output.
+func run(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// tarLayout archives the image layout in dir, for docker load.
+func tarLayout(t *testing.T, dir string) string {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// TestRuntimeLoad loads an image exported in the rootfs view into the
+// container runtime available, podman or docker, which checks the diff
+// IDs of the config against the layers it unpacks, and expects the same
+// diff IDs from it.
+func TestRuntimeLoad(t *testing.T) {
+	name := containerRuntime(t)
+	dir := export(t, rootfsFiles, map[string]string{"layer_size": "1KiB"})
+	_, m := readImage(t, dir)
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(readBlob(t, dir, m.Config.Digest), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	var image string
+	switch name {
+	case "podman":
+		out := run(t, name, "pull", "--quiet", "oci:"+dir+":latest")
+		image = out[strings.LastIndex(out, "\n")+1:]
+	case "docker":
+		out := run(t, name, "load", "--input", tarLayout(t, dir))
+		_, image, _ = strings.Cut(out[strings.LastIndex(out, "\n")+1:], ": ")
+	}
+	if image == "" {
+		t.Fatalf("%s loaded no image", name)
+	}
+	t.Cleanup(func() { exec.Command(name, "rmi", "--force", image).Run() })
+
+	var layers []string
+	if err := json.Unmarshal([]byte(run(t, name, "image", "inspect", "--format", "{{json .RootFS.Layers}}", image)), &layers); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(layers, config.RootFS.DiffIDs) {
+		t.Fatalf("%s unpacked layers %q, config lists %q", name, layers, config.RootFS.DiffIDs)
+	}
+}
@@ -0,0 +1,353 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+)
+
+// ociLayerMediaType is that of the layers of a docker-archive, which are
+// uncompressed tarballs.
+const ociLayerMediaType = "application/vnd.oci.image.layer.v1.tar"
+
+// maxLinkDepth bounds how many links are followed to find the content of
+// an archive member.
+const maxLinkDepth = 8
+
+// openArchive opens the docker-archive or oci-archive tarball name.
+// Archives written by docker save since Docker 25 are both, and are read
+// as the OCI image layout they embed.
+func openArchive(origin, name string) (source, error) {
+	fsys, err := openTarFS(name)
+	if err != nil {
+		return nil, err
+	}
+	if fsys.has(layoutMarker) && fsys.has("index.json") {
+		return openLayoutDir(origin, name, fsys)
+	}
+	if fsys.has("manifest.json") {
+		src, err := openDockerArchive(origin, name, fsys)
+		if err != nil {
+			fsys.Close()
+			return nil, err
+		}
+		return src, nil
+	}
+	fsys.Close()
+	return nil, fmt.Errorf("%s is neither a docker-archive nor an oci-archive", name)
+}
+
+// tarFS serves the members of a tarball.  Their offsets are indexed in a
+// single pass over the headers, skipping the content, which is then read
+// in place: archives of tens of gigabytes are neither extracted nor read
+// more than once.
+type tarFS struct {
+	f       *os.File
+	members map[string]*tarMember
+}
+
+type tarMember struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+func openTarFS(name string) (*tarFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	t := &tarFS{f: f, members: map[string]*tarMember{}}
+	if err := t.scan(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return t, nil
+}
+
+func (t *tarFS) scan() error {
+	var magic [2]byte
+	if _, err := io.ReadFull(t.f, magic[:]); err != nil {
+		return err
+	}
+	if magic == [2]byte{0x1f, 0x8b} {
+		return fmt.Errorf("compressed archives are not supported, decompress it first")
+	}
+	if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// archive/tar does not read ahead and seeks over the content of
+	// the members, so the file offset is that of the content once the
+	// header is read
+	tr := tar.NewReader(t.f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset, err := t.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		t.members[memberName(hdr.Name)] = &tarMember{hdr: hdr, offset: offset}
+	}
+}
+
+// memberName is the name of a member as an fs.FS path.
+func memberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (t *tarFS) has(name string) bool {
+	_, ok := t.members[name]
+	return ok
+}
+
+// lookup returns the member holding the content of name, following
+// links.
+func (t *tarFS) lookup(name string) (*tarMember, error) {
+	for range maxLinkDepth {
+		m, ok := t.members[name]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		switch m.hdr.Typeflag {
+		case tar.TypeReg:
+			return m, nil
+		case tar.TypeSymlink:
+			name = memberName(path.Join(path.Dir(name), m.hdr.Linkname))
+		case tar.TypeLink:
+			name = memberName(m.hdr.Linkname)
+		default:
+			return nil, fmt.Errorf("not a regular file")
+		}
+	}
+	return nil, fmt.Errorf("too many links")
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	m, err := t.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &tarFile{
+		SectionReader: io.NewSectionReader(t.f, m.offset, m.hdr.Size),
+		fi:            m.hdr.FileInfo(),
+	}, nil
+}
+
+func (t *tarFS) Close() error {
+	return t.f.Close()
+}
+
+// tarFile is the content of a member, read in place.
+type tarFile struct {
+	*io.SectionReader
+	fi fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
+
+// dockerArchive is a tarball written by docker save before Docker 25:
+// manifest.json lists the images with their tags, config and layers,
+// but no registry manifest.  One is synthesized for each image, the
+// layers being identified by the diff IDs of the config, which are the
+// digests of the uncompressed layer tarballs the archive holds.
+type dockerArchive struct {
+	origin string
+	root   string
+	fsys   *tarFS
+
+	// manifests maps digests to synthesized manifests, and tags to the
+	// digest of their manifest
+	manifests map[string][]byte
+	tags      map[string]string
+	order     []string
+
+	// blobs maps the digests of the configs and layers to their member
+	blobs map[string]string
+}
+
+func openDockerArchive(origin, root string, fsys *tarFS) (*dockerArchive, error) {
+	raw, err := fs.ReadFile(fsys, "manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Config   string   `json:"Config"`
+		RepoTags []string `json:"RepoTags"`
+		Layers   []string `json:"Layers"`
+	}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("decode manifest.json of %s: %w", root, err)
+	}
+
+	a := &dockerArchive{
+		origin:    origin,
+		root:      root,
+		fsys:      fsys,
+		manifests: map[string][]byte{},
+		tags:      map[string]string{},
+		blobs:     map[string]string{},
+	}
+	for _, entry := range entries {
+		digest, err := a.synthesize(entry.Config, entry.Layers)
+		if err != nil {
+			return nil, fmt.Errorf("%s: image %s: %w", root, entry.Config, err)
+		}
+		if len(entry.RepoTags) == 0 {
+			slog.Warn("oci: skipping untagged image of archive", "archive", root, "config", entry.Config)
+			continue
+		}
+		for _, ref := range entry.RepoTags {
+			// repository:tag, the repository possibly with a port
+			tag := ref[strings.LastIndex(ref, ":")+1:]
+			if _, ok := a.tags[tag]; ok {
+				slog.Warn("oci: skipping duplicate tag of archive", "archive", root, "reference", ref)
+				continue
+			}
+			a.tags[tag] = digest
+			a.order = append(a.order, tag)
+		}
+	}
+	return a, nil
+}
+
+// synthesize builds the manifest of the image with the given config and
+// layers, returning its digest.
+func (a *dockerArchive) synthesize(configName string, layerNames []string) (string, error) {
+	m, err := a.fsys.lookup(memberName(configName))
+	if err != nil {
+		return "", fmt.Errorf("config %s: %w", configName, err)
+	}
+	raw, err := readSized(io.NewSectionReader(a.fsys.f, m.offset, m.hdr.Size), m.hdr.Size, maxConfigSize)
+	if err != nil {
+		return "", fmt.Errorf("config %s: %w", configName, err)
+	}
+	var cfg struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return "", fmt.Errorf("decode config: %w", err)
+	}
+	if len(cfg.RootFS.DiffIDs) != len(layerNames) {
+		return "", fmt.Errorf("config lists %d layers, manifest.json %d", len(cfg.RootFS.DiffIDs), len(layerNames))
+	}
+
+	sum := sha256.Sum256(raw)
+	man := imageManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config: descriptor{
+			MediaType: ociConfigMediaType,
+			Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+			Size:      int64(len(raw)),
+		},
+		Layers: []descriptor{},
+	}
+	a.blobs[man.Config.Digest] = memberName(configName)
+	for i, name := range layerNames {
+		m, err := a.fsys.lookup(memberName(name))
+		if err != nil {
+			return "", fmt.Errorf("layer %s: %w", name, err)
+		}
+		desc := descriptor{MediaType: ociLayerMediaType, Digest: cfg.RootFS.DiffIDs[i], Size: m.hdr.Size}
+		man.Layers = append(man.Layers, desc)
+		a.blobs[desc.Digest] = memberName(name)
+	}
+
+	manifest, err := json.Marshal(man)
+	if err != nil {
+		return "", err
+	}
+	sum = sha256.Sum256(manifest)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	a.manifests[digest] = manifest
+	return digest, nil
+}
+
+func (a *dockerArchive) Origin() string {
+	return a.origin
+}
+
+func (a *dockerArchive) Root() string {
+	return a.root
+}
+
+func (a *dockerArchive) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (a *dockerArchive) Tags(ctx context.Context, fn func(tags []string) error) error {
+	if len(a.order) == 0 {
+		return nil
+	}
+	return fn(a.order)
+}
+
+func (a *dockerArchive) Manifest(ctx context.Context, ref, accept string) ([]byte, string, string, error) {
+	digest := ref
+	if !isDigest(ref) {
+		digest = a.tags[ref]
+	}
+	raw, ok := a.manifests[digest]
+	if !ok {
+		return nil, "", "", fmt.Errorf("%s: %w", ref, fs.ErrNotExist)
+	}
+	return bytes.Clone(raw), ociManifestMediaType, digest, nil
+}
+
+func (a *dockerArchive) Referrers(ctx context.Context, digest string) ([]byte, error) {
+	return nil, fmt.Errorf("referrers of %s: %w", digest, fs.ErrNotExist)
+}
+
+func (a *dockerArchive) Blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	name, ok := a.blobs[digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", digest, fs.ErrNotExist)
+	}
+	f, err := a.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := storage.NewVerifyingReader(f, digest)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (a *dockerArchive) Retry(ctx context.Context, fn func() error) error {
+	return fn()
+}
+
+func (a *dockerArchive) Close(ctx context.Context) error {
+	return a.fsys.Close()
+}
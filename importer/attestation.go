@@ -0,0 +1,97 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// dockerReferenceDigest is the annotation of the attestation manifests
+// BuildKit attaches to the images of an index, with the digest of the
+// image they attest.
+const dockerReferenceDigest = "vnd.docker.reference.digest"
+
+// maxAttestationSize bounds the attestations decoded, larger ones are
+// stored as they are.
+const maxAttestationSize = 64 << 20
+
+// statement is the part of an in-toto statement, the layers of
+// attestation manifests, that names its file.
+type statement struct {
+	Type          string `json:"_type"`
+	PredicateType string `json:"predicateType"`
+}
+
+// emitAttestations emits the in-toto statements attesting leaf, among the
+// attestation manifests imported along with img, in dir: each is decoded
+// and stored indented as <predicate-type>.json, the https:// scheme of
+// the predicate type left out and the rest escaped, e.g.
+// slsa.dev%2Fprovenance%2Fv0.2.json.  Statements that cannot be decoded
+// are stored as they are, as <hex>.raw, rather than dropped.
+func (imp *ociImporter) emitAttestations(ctx context.Context, records chan<- *connectors.Record, img, leaf *image, dir string) error {
+	var layers []descriptor
+	for _, att := range leaves(img) {
+		if att.desc.attestation() && att.desc.Annotations[dockerReferenceDigest] == leaf.desc.Digest {
+			layers = append(layers, att.manifest.Layers...)
+		}
+	}
+	if len(layers) == 0 {
+		return nil
+	}
+	if err := send(ctx, records, imp.dirRecord(dir)); err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for _, desc := range layers {
+		pathname, err := blobPath(desc.Digest)
+		if err != nil {
+			return err
+		}
+		hex := path.Base(pathname)
+		if desc.Size > maxAttestationSize {
+			slog.Warn("oci: storing large attestation as it is", "image", leaf.desc.Digest, "digest", desc.Digest, "size", desc.Size)
+			rec, err := imp.blobFile(ctx, path.Join(dir, hex+".raw"), img.name, desc)
+			if err != nil {
+				return err
+			}
+			if err := send(ctx, records, rec); err != nil {
+				rec.Close()
+				return err
+			}
+			continue
+		}
+
+		raw, err := imp.readBlob(ctx, desc, maxAttestationSize)
+		if err != nil {
+			return fmt.Errorf("attestation %s: %w", desc.Digest, err)
+		}
+		name, content := hex+".raw", raw
+		var st statement
+		if err := json.Unmarshal(raw, &st); err != nil || st.Type == "" || st.PredicateType == "" {
+			slog.Warn("oci: storing malformed attestation as it is", "image", leaf.desc.Digest, "digest", desc.Digest)
+		} else {
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, raw, "", "  "); err != nil {
+				return err
+			}
+			name = escapeName(strings.TrimPrefix(st.PredicateType, "https://"))
+			if names[name] {
+				// several statements of the same predicate type
+				name += "-" + hex[:min(12, len(hex))]
+			}
+			names[name] = true
+			name, content = name+".json", indented.Bytes()
+		}
+		if err := send(ctx, records, imp.fileRecord(path.Join(dir, name), content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
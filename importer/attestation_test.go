@@ -0,0 +1,61 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// TestRootfsLargeAttestation imports the root filesystem of an image
+// along with an attestation too large to be decoded, and expects it
+// stored as it is.
+func TestRootfsLargeAttestation(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	f := newFakeRegistry()
+	zeros := io.NewSectionReader(&zeroTar{}, 0, maxAttestationSize+1)
+	h := sha256.New()
+	if _, err := io.Copy(h, zeros); err != nil {
+		t.Fatal(err)
+	}
+	statement := descriptor{MediaType: "application/vnd.in-toto+json", Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: zeros.Size()}
+	f.open = func(digest string) (io.ReadSeeker, bool) {
+		return io.NewSectionReader(zeros, 0, zeros.Size()), digest == statement.Digest
+	}
+
+	layer := f.blob(tarball(t, []string{"hello"}, map[string]string{"hello": "world"}))
+	img := f.manifest("", ociManifestMediaType, imageManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        f.config(`{"architecture":"amd64","os":"linux"}`),
+		Layers:        []descriptor{layer},
+	})
+	img.Platform = &platform{OS: "linux", Architecture: "amd64"}
+	att := f.manifest("", ociManifestMediaType, imageManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        f.config(`{}`),
+		Layers:        []descriptor{statement},
+	})
+	att.Platform = &platform{OS: "unknown", Architecture: "unknown"}
+	att.Annotations = map[string]string{dockerReferenceType: "attestation-manifest", dockerReferenceDigest: img.Digest}
+	f.manifest("latest", ociIndexMediaType, imageIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []descriptor{img, att}})
+	host := f.start(t)
+
+	sizes := map[string]int64{}
+	config := map[string]string{"location": "oci://" + host + "/repo:latest", "plain_http": "true", "view": "rootfs", "include_attestations": "true"}
+	runImport(t, config, func(rec *connectors.Record) ([]byte, error) {
+		n, err := io.Copy(io.Discard, rec.Reader)
+		sizes[rec.Pathname] = n
+		return nil, err
+	})
+	raw := path.Join("/.oci/attestations", strings.TrimPrefix(statement.Digest, "sha256:")+".raw")
+	if sizes[raw] != statement.Size {
+		t.Fatalf("%s of %d bytes, want %d", raw, sizes[raw], statement.Size)
+	}
+}
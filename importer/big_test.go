@@ -0,0 +1,147 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// bigFileSize is the size of the file of the large layers.
+const bigFileSize = 2 << 30
+
+// maxLargeLayersRSS bounds the growth of the resident memory of the
+// import of the large layers.
+const maxLargeLayersRSS = 64 << 20
+
+// zeroTar is a tar holding a single file of zeros, read without being held
+// in memory: past its header, a tar of zeros is zeros.
+type zeroTar struct {
+	hdr []byte
+}
+
+func newZeroTar(t *testing.T, name string, size int64) *io.SectionReader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	// the content is padded to blocks of 512 bytes, and two blocks end
+	// the archive
+	padded := (size + 511) &^ 511
+	return io.NewSectionReader(&zeroTar{hdr: buf.Bytes()}, 0, int64(buf.Len())+padded+1024)
+}
+
+func (z *zeroTar) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < int64(len(z.hdr)) {
+		n = copy(p, z.hdr[off:])
+	}
+	clear(p[n:])
+	return len(p), nil
+}
+
+// rss is the resident set size of the process, from /proc.
+func rss(t *testing.T) int64 {
+	raw, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip("no /proc/self/status:", err)
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		if v, ok := strings.CutPrefix(line, "VmRSS:"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kb << 10
+		}
+	}
+	t.Skip("no VmRSS in /proc/self/status")
+	return 0
+}
+
+// TestLargeLayers imports an image of 2 GiB layers of zeros, one
+// uncompressed, served without being held, and one gzip-compressed, and
+// expects the resident memory of the import to stay far below.
+func TestLargeLayers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("imports 4 GiB of layers")
+	}
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("TMPDIR", t.TempDir())
+
+	f := newFakeRegistry()
+	plain := newZeroTar(t, "plain", bigFileSize)
+	h := sha256.New()
+	if _, err := io.Copy(h, plain); err != nil {
+		t.Fatal(err)
+	}
+	plainDesc := descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: plain.Size()}
+	f.open = func(digest string) (io.ReadSeeker, bool) {
+		return io.NewSectionReader(plain, 0, plain.Size()), digest == plainDesc.Digest
+	}
+
+	var gz bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&gz, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(zw, newZeroTar(t, "compressed", bigFileSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gzDesc := f.blob(gz.Bytes())
+	gzDesc.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	config := f.config(`{"architecture":"amd64","os":"linux"}`)
+	f.manifest("latest", ociManifestMediaType, imageManifest{SchemaVersion: 2, MediaType: ociManifestMediaType, Config: config, Layers: []descriptor{plainDesc, gzDesc}})
+	host := f.start(t)
+
+	base := rss(t)
+	var peak atomic.Int64
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if v := rss(t); v > peak.Load() {
+				peak.Store(v)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	// the blobs as such, then the files of the layers
+	for view, want := range map[string]int64{"blobs": plainDesc.Size + gzDesc.Size, "rootfs": 2 * bigFileSize} {
+		var read int64
+		runImport(t, map[string]string{"location": "oci://" + host + "/repo:latest", "plain_http": "true", "view": view}, func(rec *connectors.Record) ([]byte, error) {
+			n, err := io.Copy(io.Discard, rec.Reader)
+			read += n
+			return nil, err
+		})
+		if read < want {
+			t.Errorf("view %s: read %d bytes, want %d at least", view, read, want)
+		}
+	}
+	close(stop)
+	<-done
+	if grown := peak.Load() - base; grown > maxLargeLayersRSS {
+		t.Fatalf("resident memory grew by %d MiB, want %d MiB at most", grown>>20, maxLargeLayersRSS>>20)
+	}
+}
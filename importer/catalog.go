@@ -0,0 +1,98 @@
+package importer
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"slices"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// importCatalog imports every repository of the registry, as listed by
+// its _catalog endpoint, each in the top-level directory of its name.
+func (imp *ociImporter) importCatalog(ctx context.Context, records chan<- *connectors.Record) error {
+	if err := send(ctx, records, imp.dirRecord("/")); err != nil {
+		return err
+	}
+	dirs := map[string]bool{"/": true}
+
+	// repositories are imported in lexical order once listed, as tags are
+	var selected []string
+	skipped := 0
+	err := imp.catalog.Catalog(ctx, func(repos []string) error {
+		for _, name := range repos {
+			if !imp.repos.match(name) {
+				skipped++
+				continue
+			}
+			selected = append(selected, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.Sort(selected)
+	selected = slices.Compact(selected)
+	slog.Info("oci: repositories scanned", "registry", imp.src.Origin(), "selected", len(selected), "skipped_by_filters", skipped)
+	for _, name := range selected {
+		if err := imp.importCatalogRepo(ctx, records, dirs, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importCatalogRepo imports the repository name under /<name>, by
+// relaying the records of an importer of the repository.  Failures are
+// reported on the directory of the repository, and the import goes on
+// with the next one.
+func (imp *ociImporter) importCatalogRepo(ctx context.Context, records chan<- *connectors.Record, dirs map[string]bool, name string) error {
+	dir := path.Join("/", name)
+	if err := imp.mkdirs(ctx, records, dirs, path.Dir(dir)); err != nil {
+		return err
+	}
+	reg, err := imp.catalog.Repository(name)
+	if err != nil {
+		return send(ctx, records, connectors.NewError(dir, err))
+	}
+
+	sub := *imp
+	sub.src = imp.throttle(reg)
+	sub.catalog = nil
+	sub.repoDir = "/"
+	sub.referred = map[string]bool{}
+	sub.referrerDirs = map[string]bool{"/": true}
+
+	relay := make(chan *connectors.Record)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(relay)
+		errc <- sub.importImages(ctx, relay)
+	}()
+
+	var serr error
+	for rec := range relay {
+		if serr != nil {
+			rec.Close()
+			continue
+		}
+		if rec.Pathname == "/" {
+			rec.FileInfo.Lname = path.Base(dir)
+		}
+		rec.Pathname = path.Join(dir, rec.Pathname)
+		if serr = send(ctx, records, rec); serr != nil {
+			rec.Close()
+		}
+	}
+	err = <-errc
+	if serr != nil {
+		return serr
+	}
+	if err != nil && ctx.Err() == nil && !aborts(err) {
+		slog.Warn("oci: could not import repository", "repository", name, "error", err)
+		return send(ctx, records, connectors.NewError(dir, err))
+	}
+	return err
+}
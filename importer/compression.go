@@ -0,0 +1,89 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of layers.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// maxZstdWindow bounds the window of zstd layers, which the decoder holds
+// in memory: 128 MiB, that of zstd --long.
+const maxZstdWindow = 1 << 27
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// mediaTypeCompression returns the compression of a layer according to
+// its media type, e.g. application/vnd.oci.image.layer.v1.tar+zstd or
+// application/vnd.docker.image.rootfs.diff.tar.gzip, or an empty string
+// if the media type does not tell.
+func mediaTypeCompression(mediaType string) string {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip"), strings.HasSuffix(mediaType, ".tar.gzip"):
+		return compressionGzip
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return compressionZstd
+	case strings.HasSuffix(mediaType, ".tar"):
+		return compressionNone
+	}
+	return ""
+}
+
+// decompress returns the uncompressed content of the blob of layer
+// desc.  The compression is that of the media type, unless the first
+// bytes of the blob tell otherwise: tools have been known to label gzip
+// layers as uncompressed, or the other way around.  Layers whose media
+// type names another compression are refused.
+func decompress(rd io.Reader, desc descriptor) (io.ReadCloser, error) {
+	declared := mediaTypeCompression(desc.MediaType)
+	if declared == "" && strings.Contains(desc.MediaType, "+") {
+		return nil, fmt.Errorf("unsupported layer media type %s", desc.MediaType)
+	}
+
+	br := bufio.NewReader(rd)
+	magic, _ := br.Peek(len(zstdMagic))
+	actual := compressionNone
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		actual = compressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		actual = compressionZstd
+	}
+	if declared != "" && declared != actual {
+		slog.Debug("oci: layer compression does not match its media type",
+			"digest", desc.Digest,
+			"media_type", desc.MediaType,
+			"compression", actual)
+	}
+
+	switch actual {
+	case compressionGzip:
+		return gzip.NewReader(br)
+	case compressionZstd:
+		// a single goroutine decodes ahead, the layer is read in order
+		zr, err := zstd.NewReader(br,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
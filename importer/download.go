@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const defaultDownloadConcurrency = 4
+
+// downloader fetches blobs ahead of the backup reading them, up to a
+// fixed number at once, spooling each to a temporary file.  A slot is
+// held from the start of a download until the backup closes its record,
+// so that records are emitted no faster than they are consumed and the
+// spool never grows beyond that many blobs.
+//
+// A blob that cannot be downloaded, once retried, fails its record, and
+// the tags using it are reported as not imported once their repository
+// has been scanned; the import goes on with the other tags.
+type downloader struct {
+	sem *semaphore.Weighted
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+func newDownloader(ctx context.Context, concurrency int) *downloader {
+	return &downloader{
+		sem: semaphore.NewWeighted(int64(concurrency)),
+		ctx: ctx,
+	}
+}
+
+// fetch starts downloading desc, a blob of the image ref of the importer
+// imp, once a slot is available.  The returned download must be closed.
+func (d *downloader) fetch(ctx context.Context, imp *ociImporter, ref string, desc descriptor) (*download, error) {
+	if err := d.sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	dctx, cancel := context.WithCancel(d.ctx)
+	dl := &download{
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		release: func() { d.sem.Release(1) },
+	}
+	d.wg.Add(1)
+	if imp.scan != nil {
+		imp.scan.pending.Add(1)
+	}
+	go func() {
+		defer d.wg.Done()
+		defer close(dl.done)
+		dl.f, dl.err = spoolBlob(dctx, imp, ref, desc)
+		if imp.scan != nil {
+			if dl.err != nil && dctx.Err() == nil {
+				imp.scan.failBlob(desc.Digest, dl.err)
+			}
+			imp.scan.pending.Done()
+		}
+	}()
+	return dl, nil
+}
+
+// spoolBlob spools the blob desc, reading it again from the start when the
+// connection drops on the way.
+func spoolBlob(ctx context.Context, imp *ociImporter, ref string, desc descriptor) (*os.File, error) {
+	f, err := os.CreateTemp("", "plakar-oci-blob-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// failures to open the blob were retried by the store already
+	var openErr error
+	var size int64
+	err = imp.src.Retry(ctx, func() error {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rc, err := imp.openBlob(ctx, ref, desc)
+		if err != nil {
+			openErr = err
+			return nil
+		}
+		defer rc.Close()
+		size, err = io.Copy(f, newProgressReader(rc, desc))
+		return err
+	})
+	if err == nil {
+		err = openErr
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		if !errors.Is(err, errBlobMismatch) {
+			err = fmt.Errorf("blob %s: %w", desc.Digest, err)
+		}
+		return nil, err
+	}
+	imp.stats.blobs.Add(1)
+	imp.stats.bytes.Add(size)
+	return f, nil
+}
+
+// wait waits for the downloads in progress.
+func (d *downloader) wait() {
+	d.wg.Wait()
+}
+
+// download is the content of a blob, readable once downloaded.  Closing
+// it stops the download if still running and removes the spool.
+type download struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	f       *os.File
+	err     error
+	release func()
+	once    sync.Once
+}
+
+func (dl *download) Read(p []byte) (int, error) {
+	<-dl.done
+	if dl.err != nil {
+		return 0, dl.err
+	}
+	return dl.f.Read(p)
+}
+
+// rewind makes the content readable again from the start, for the next
+// reader once the first is done with it.
+func (dl *download) rewind() error {
+	<-dl.done
+	if dl.err != nil {
+		return dl.err
+	}
+	_, err := dl.f.Seek(0, io.SeekStart)
+	return err
+}
+
+func (dl *download) Close() error {
+	dl.once.Do(func() {
+		dl.cancel()
+		<-dl.done
+		if dl.f != nil {
+			dl.f.Close()
+			os.Remove(dl.f.Name())
+		}
+		dl.release()
+	})
+	return nil
+}
@@ -0,0 +1,188 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// fakeRegistry serves images from memory, read-only: manifests by tag
+// and digest, blobs with ranges and the tag list of a single repository.
+// Blobs too large to be held are served by open.
+type fakeRegistry struct {
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	mtypes    map[string]string
+	tags      []string
+
+	// open serves the blobs not in blobs
+	open func(digest string) (io.ReadSeeker, bool)
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		mtypes:    map[string]string{},
+	}
+}
+
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// blob stores b and returns its descriptor, as an uncompressed layer.
+func (f *fakeRegistry) blob(b []byte) descriptor {
+	d := sha256Digest(b)
+	f.blobs[d] = b
+	return descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: d, Size: int64(len(b))}
+}
+
+// config stores an image configuration and returns its descriptor.
+func (f *fakeRegistry) config(raw string) descriptor {
+	desc := f.blob([]byte(raw))
+	desc.MediaType = ociConfigMediaType
+	return desc
+}
+
+// manifest stores v as a manifest of media type mt, tagged tag unless
+// empty, and returns its descriptor.
+func (f *fakeRegistry) manifest(tag, mt string, v any) descriptor {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	d := sha256Digest(raw)
+	f.manifests[d], f.mtypes[d] = raw, mt
+	if tag != "" {
+		f.manifests[tag], f.mtypes[tag] = raw, mt
+		f.tags = append(f.tags, tag)
+	}
+	return descriptor{MediaType: mt, Digest: d, Size: int64(len(raw))}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == "/v2/" || p == "/v2":
+	case strings.HasSuffix(p, "/tags/list"):
+		json.NewEncoder(w).Encode(map[string]any{"name": "repo", "tags": f.tags})
+	case strings.Contains(p, "/manifests/"):
+		ref := p[strings.LastIndex(p, "/")+1:]
+		raw, ok := f.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", f.mtypes[ref])
+		w.Header().Set("Docker-Content-Digest", sha256Digest(raw))
+		w.Header().Set("Content-Length", fmt.Sprint(len(raw)))
+		if r.Method != http.MethodHead {
+			w.Write(raw)
+		}
+	case strings.Contains(p, "/blobs/"):
+		d := p[strings.LastIndex(p, "/")+1:]
+		var content io.ReadSeeker
+		if b, ok := f.blobs[d]; ok {
+			content = bytes.NewReader(b)
+		} else if f.open != nil {
+			content, ok = f.open(d)
+			if !ok {
+				content = nil
+			}
+		}
+		if content == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", d)
+		http.ServeContent(w, r, "", time.Time{}, content)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// start serves the registry and returns its host.
+func (f *fakeRegistry) start(t *testing.T) string {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// tarball returns a tar holding the files named by the keys of files,
+// in the order given by names.
+func tarball(t *testing.T, names []string, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		content := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg, ModTime: time.Unix(1700000000, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// imported is a record emitted by an import, content read.
+type imported struct {
+	rec     *connectors.Record
+	content []byte
+}
+
+// runImport imports with config and returns the records emitted.  The
+// content of regular files is read through read, or in full when nil.
+func runImport(t *testing.T, config map[string]string, read func(rec *connectors.Record) ([]byte, error)) []imported {
+	t.Helper()
+	ctx := context.Background()
+	if read == nil {
+		read = func(rec *connectors.Record) ([]byte, error) { return io.ReadAll(rec.Reader) }
+	}
+	imp, err := New(ctx, nil, "oci", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make(chan *connectors.Record)
+	errc := make(chan error, 1)
+	go func() { errc <- imp.Import(ctx, records, nil) }()
+
+	var out []imported
+	for rec := range records {
+		it := imported{rec: rec}
+		if rec.Err != nil {
+			t.Errorf("%s: %v", rec.Pathname, rec.Err)
+		} else if rec.Reader != nil && rec.FileInfo.Mode().IsRegular() {
+			if it.content, err = read(rec); err != nil {
+				t.Errorf("%s: %v", rec.Pathname, err)
+			}
+		}
+		rec.Close()
+		out = append(out, it)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
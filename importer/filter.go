@@ -0,0 +1,80 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+)
+
+// globFilter selects the tags of a repository, or the repositories of a
+// registry, to import from glob patterns matched against their name;
+// excludes win over includes.
+type globFilter struct {
+	include []string
+	exclude []string
+}
+
+func parsePatterns(key, v string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", key, p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func matchAny(patterns []string, tag string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *globFilter) match(tag string) bool {
+	if matchAny(f.exclude, tag) {
+		return false
+	}
+	return len(f.include) == 0 || matchAny(f.include, tag)
+}
+
+// eachTag calls fn with every tag of the repository the filter selects,
+// filtered as pages are listed so that filtered tags never cost a manifest
+// fetch.  Tags are processed in lexical order once listed, whatever the
+// order the registry lists them in, so that imports of an unchanged
+// repository emit the same records.
+func (imp *ociImporter) eachTag(ctx context.Context, fn func(tag string) error) error {
+	var selected []string
+	skipped := 0
+	err := imp.src.Tags(ctx, func(tags []string) error {
+		for _, tag := range tags {
+			if !imp.filter.match(tag) {
+				skipped++
+				continue
+			}
+			selected = append(selected, tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.Sort(selected)
+	selected = slices.Compact(selected)
+	slog.Info("oci: tags scanned", "repository", imp.src.Root(), "selected", len(selected), "skipped_by_filters", skipped)
+	for _, tag := range selected {
+		if err := fn(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+)
+
+// What becomes of foreign layers, such as those of Windows base images,
+// which registries do not serve: a metadata-only stub, a download from
+// the URLs of their descriptor, or a failed import.
+const (
+	foreignSkip  = "skip"
+	foreignFetch = "fetch"
+	foreignFail  = "fail"
+)
+
+// foreign reports whether desc is a layer registries may not distribute,
+// to be fetched from the URLs of its descriptor.
+func (desc *descriptor) foreign() bool {
+	return strings.Contains(desc.MediaType, ".foreign.") || strings.Contains(desc.MediaType, ".nondistributable.")
+}
+
+// checkForeign applies the policy for a foreign layer not fetched: the
+// import fails, or goes on without it with a warning.
+func (imp *ociImporter) checkForeign(img *image, desc descriptor) error {
+	if imp.foreign == foreignFail {
+		return fmt.Errorf("image %s has foreign layer %s", img.desc.Digest, desc.Digest)
+	}
+	slog.Warn("oci: skipping foreign layer", "image", img.desc.Digest, "digest", desc.Digest, "urls", desc.URLs)
+	return nil
+}
+
+// emitForeign records the descriptor of a skipped foreign layer as
+// /foreign/<algorithm>/<hex>.json, in place of its content.
+func (l *layout) emitForeign(ctx context.Context, desc descriptor) error {
+	pathname, err := blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	pathname = path.Join("/foreign", strings.TrimPrefix(pathname, "/blobs")) + ".json"
+	if err := l.imp.mkdirs(ctx, l.records, l.dirs, path.Dir(pathname)); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	return send(ctx, l.records, l.imp.fileRecord(pathname, raw))
+}
+
+// openBlob returns the content of the blob desc of the image ref, from
+// the URLs of its descriptor for a foreign layer with
+// foreign_layers=fetch, checked against the descriptor as it is read.
+func (imp *ociImporter) openBlob(ctx context.Context, ref string, desc descriptor) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	var err error
+	if desc.foreign() && imp.foreign == foreignFetch {
+		fetch := storage.FetchURL
+		if f, ok := imp.src.(urlFetcher); ok {
+			fetch = f.FetchURL
+		}
+		rc, err = fetchForeign(ctx, fetch, desc)
+	} else {
+		rc, err = imp.src.Blob(ctx, desc.Digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &checkedBlob{rc: rc, imp: imp, ref: ref, desc: desc}, nil
+}
+
+// urlFetcher is implemented by the sources downloading URLs through a
+// transport of their own, registries with their proxy and TLS settings.
+type urlFetcher interface {
+	FetchURL(ctx context.Context, rawURL string) (io.ReadCloser, error)
+}
+
+// fetchForeign downloads a foreign layer with fetch from the first of its
+// URLs that serves it, without authentication: the credentials of the
+// registry are not for these hosts.
+func fetchForeign(ctx context.Context, fetch func(context.Context, string) (io.ReadCloser, error), desc descriptor) (io.ReadCloser, error) {
+	if len(desc.URLs) == 0 {
+		return nil, fmt.Errorf("foreign layer %s lists no URLs", desc.Digest)
+	}
+	var errs []error
+	for _, u := range desc.URLs {
+		rc, err := fetch(ctx, u)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		vr, err := storage.NewVerifyingReader(rc, desc.Digest)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return vr, nil
+	}
+	return nil, fmt.Errorf("foreign layer %s: %w", desc.Digest, errors.Join(errs...))
+}
@@ -0,0 +1,56 @@
+package importer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestFetchForeignLayer imports an image whose foreign layer is only
+// reachable through the proxy of the registry options, and lists a file
+// URL first, which must not be read.
+func TestFetchForeignLayer(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	f := newFakeRegistry()
+	content := tarball(t, []string{"hello"}, map[string]string{"hello": "world"})
+	layer := f.blob(content)
+	delete(f.blobs, layer.Digest)
+	layer.MediaType = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	layer.URLs = []string{"file:///etc/passwd", "http://foreign.invalid/layer.tar"}
+	f.manifest("latest", ociManifestMediaType, imageManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        f.config(`{"architecture":"amd64","os":"linux"}`),
+		Layers:        []descriptor{layer},
+	})
+	host := f.start(t)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		if r.URL.String() != "http://foreign.invalid/layer.tar" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(proxy.Close)
+
+	got := map[string]string{}
+	for _, it := range runImport(t, map[string]string{
+		"location":       "oci://" + host + "/repo:latest",
+		"plain_http":     "true",
+		"view":           "rootfs",
+		"foreign_layers": "fetch",
+		"proxy_url":      proxy.URL,
+	}, nil) {
+		got[it.rec.Pathname] = string(it.content)
+	}
+	if got["/hello"] != "world" {
+		t.Errorf("/hello holds %q, want world", got["/hello"])
+	}
+	if len(proxied) != 1 {
+		t.Errorf("proxied %q, want the layer URL alone", proxied)
+	}
+}
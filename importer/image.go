@@ -0,0 +1,551 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// Media types of the manifests the importer reads.
+const (
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociIndexMediaType       = "application/vnd.oci.image.index.v1+json"
+	dockerListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestAccept lists the manifest media types the importer reads.
+var manifestAccept = strings.Join([]string{
+	ociManifestMediaType,
+	dockerManifestMediaType,
+	ociIndexMediaType,
+	dockerListMediaType,
+}, ", ")
+
+func isIndex(mediaType string) bool {
+	return mediaType == ociIndexMediaType || mediaType == dockerListMediaType
+}
+
+const (
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+
+	// dockerReferenceType marks the attestation manifests BuildKit
+	// attaches to the images of an index
+	dockerReferenceType = "vnd.docker.reference.type"
+)
+
+// maxIndexDepth bounds how deeply indexes may nest.
+const maxIndexDepth = 4
+
+// maxManifestSize bounds the manifests read from image layouts.
+const maxManifestSize = 4 << 20
+
+// descriptor points at a blob, as in manifests and indexes.
+type descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	URLs         []string          `json:"urls,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Platform     *platform         `json:"platform,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// attestation reports whether desc is an attestation rather than an
+// image of the index.
+func (desc *descriptor) attestation() bool {
+	if desc.Annotations[dockerReferenceType] == "attestation-manifest" {
+		return true
+	}
+	if strings.Contains(desc.ArtifactType, "in-toto") {
+		return true
+	}
+	return desc.Platform != nil && desc.Platform.unknown()
+}
+
+type imageManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// imageIndex is both an image index of the registry and the index.json
+// at the root of an OCI image layout.
+type imageIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+// image is a manifest, or an index along with the images selected from
+// it, resolved from a reference but not yet emitted.  name is the
+// reference the image was reached from, which names the images of an
+// index in messages.
+type image struct {
+	ref      string
+	name     string
+	desc     descriptor
+	raw      []byte
+	manifest imageManifest
+	children []*image
+}
+
+// resolveImage fetches and decodes the manifest ref points to, descending
+// into the images of the platforms selected when it is an index.  A
+// missing reference is reported as such, matching fs.ErrNotExist.
+func (imp *ociImporter) resolveImage(ctx context.Context, ref string) (*image, error) {
+	img, err := imp.resolve(ctx, ref, ref, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("image %s%s not found: %w", imp.src.Root(), refSuffix(ref), err)
+		}
+		return nil, fmt.Errorf("image %s%s: %w", imp.src.Root(), refSuffix(ref), err)
+	}
+	if !isDigest(ref) {
+		img.desc.Annotations = map[string]string{refNameAnnotation: ref}
+	}
+	return img, nil
+}
+
+func (imp *ociImporter) resolve(ctx context.Context, ref, name string, depth int) (*image, error) {
+	raw, mediaType, digest, err := imp.src.Manifest(ctx, ref, manifestAccept)
+	if err != nil {
+		return nil, err
+	}
+
+	// registries may serve a generic Content-Type, the document then
+	// tells what it is
+	var doc struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %w", ref, err)
+	}
+	if mediaType == "" || (!isIndex(mediaType) && mediaType != ociManifestMediaType && mediaType != dockerManifestMediaType) {
+		switch {
+		case doc.MediaType != "":
+			mediaType = doc.MediaType
+		case doc.Manifests != nil:
+			mediaType = ociIndexMediaType
+		default:
+			mediaType = ociManifestMediaType
+		}
+	}
+
+	img := &image{
+		ref:  ref,
+		name: name,
+		raw:  raw,
+		desc: descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))},
+	}
+	if !isIndex(mediaType) {
+		if err := json.Unmarshal(raw, &img.manifest); err != nil {
+			return nil, fmt.Errorf("decode manifest %s: %w", ref, err)
+		}
+		return img, nil
+	}
+
+	if depth >= maxIndexDepth {
+		return nil, fmt.Errorf("index %s nests deeper than %d levels", ref, maxIndexDepth)
+	}
+	var index imageIndex
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return nil, fmt.Errorf("decode index %s: %w", ref, err)
+	}
+	for _, desc := range index.Manifests {
+		if !imp.selected(ref, &desc) {
+			continue
+		}
+		child, err := imp.resolve(ctx, desc.Digest, name, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		child.desc.Platform = desc.Platform
+		child.desc.ArtifactType = desc.ArtifactType
+		child.desc.Annotations = desc.Annotations
+		img.children = append(img.children, child)
+	}
+	if len(img.children) == 0 {
+		return nil, fmt.Errorf("index %s has no image for platform %s", ref, imp.platformName())
+	}
+	// the images of an index are imported by platform rather than in the
+	// order it was pushed, those of a platform keeping their order, which
+	// clients pick from
+	slices.SortStableFunc(img.children, func(a, b *image) int {
+		return strings.Compare(a.desc.Platform.key(), b.desc.Platform.key())
+	})
+	return img, nil
+}
+
+// selected reports whether the image desc of the index ref is imported.
+func (imp *ociImporter) selected(ref string, desc *descriptor) bool {
+	if desc.attestation() {
+		return imp.attestations
+	}
+	if isIndex(desc.MediaType) {
+		return true
+	}
+	if desc.Platform.unknown() {
+		slog.Warn("oci: skipping image of unknown platform", "index", ref, "digest", desc.Digest)
+		return false
+	}
+	return imp.platform == nil || imp.platform.matches(desc.Platform)
+}
+
+func (imp *ociImporter) platformName() string {
+	if imp.platform == nil {
+		return "all"
+	}
+	return imp.platform.String()
+}
+
+// refSuffix formats ref the way it is appended to a repository name.
+func refSuffix(ref string) string {
+	if isDigest(ref) {
+		return "@" + ref
+	}
+	return ":" + ref
+}
+
+// rootfsDir is the directory of the root filesystems with both views.
+const rootfsDir = "/rootfs"
+
+// layout emits an OCI image layout as images are added to it: the
+// manifests, configs and layers under /blobs/<algorithm>/<hex>, then
+// index.json listing the manifests once done.  Blobs shared by several
+// images are emitted once.
+//
+// When every platform is imported, index.json references the indexes
+// themselves, and /platforms/<os>/<arch>[/<variant>]/index.json lists the
+// images of each platform.  Otherwise index.json directly references the
+// images of the selected platform.
+//
+// This is the blobs view of a snapshot, which the exporter reads back as
+// it is:
+//
+//	/oci-layout                       layout version
+//	/index.json                       manifests imported, tagged with the
+//	                                  org.opencontainers.image.ref.name
+//	                                  annotation
+//	/blobs/sha256/<hex>               manifests, configs and layers, as
+//	                                  the registry serves them
+//	/platforms/<platform>/index.json  images of each platform
+//	/foreign/sha256/<hex>.json        descriptors of foreign layers
+//	/.oci/referrers/<digest>/         layout of the referrers of a manifest
+//	/images/<tag>/.oci/config.json    config of each image, with its
+//	                                  metadata as extended attributes
+//
+// With both views, the root filesystem of each image is under
+// /rootfs/<tag>, or /rootfs for the image named by the location, and the
+// layout defers the records of the layers it applies to it.
+type layout struct {
+	imp       *ociImporter
+	records   chan<- *connectors.Record
+	index     imageIndex
+	platforms map[string]*imageIndex
+	seen      map[string]bool
+	dirs      map[string]bool
+
+	// deferred lists the layers whose record is emitted from the
+	// download of the root filesystem view, with both views
+	deferred map[string]bool
+}
+
+func (imp *ociImporter) newLayout(ctx context.Context, records chan<- *connectors.Record) (*layout, error) {
+	for _, dir := range []string{"/", "/blobs", "/blobs/sha256"} {
+		if err := send(ctx, records, imp.dirRecord(dir)); err != nil {
+			return nil, err
+		}
+	}
+	if err := send(ctx, records, imp.fileRecord("/oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))); err != nil {
+		return nil, err
+	}
+	l := &layout{
+		imp:       imp,
+		records:   records,
+		index:     newImageIndex(),
+		platforms: map[string]*imageIndex{},
+		seen:      map[string]bool{},
+		dirs:      map[string]bool{"/": true, "/blobs": true, "/blobs/sha256": true},
+	}
+	if imp.mode == modeBoth {
+		l.deferred = map[string]bool{}
+	}
+	return l, nil
+}
+
+func newImageIndex() imageIndex {
+	return imageIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []descriptor{}}
+}
+
+// add emits img and references it from the index, along with the
+// metadata of its images.
+func (l *layout) add(ctx context.Context, img *image) error {
+	if err := l.imp.startImage(img); err != nil {
+		return err
+	}
+	if err := l.addImage(ctx, img); err != nil {
+		return err
+	}
+
+	// the metadata of the image named by the location sits at the root,
+	// that of the images of a repository under /images/<tag>
+	var images []*image
+	for _, leaf := range leaves(img) {
+		if !leaf.desc.attestation() {
+			images = append(images, leaf)
+		}
+	}
+	for _, leaf := range images {
+		dir := "/"
+		if l.imp.ref == "" {
+			dir = path.Join("/images", img.ref)
+		}
+		if len(images) > 1 && leaf.desc.Platform != nil {
+			dir = path.Join(dir, strings.TrimPrefix(leaf.desc.Platform.dir(), "/platforms"))
+		}
+		if err := l.imp.mkdirs(ctx, l.records, l.dirs, dir); err != nil {
+			return err
+		}
+		if err := l.imp.emitMetadata(ctx, l.records, img, leaf, dir); err != nil {
+			return err
+		}
+	}
+	return l.imp.importReferrers(ctx, l.records, img)
+}
+
+func (l *layout) addImage(ctx context.Context, img *image) error {
+	if l.imp.platform == nil || img.children == nil {
+		l.index.Manifests = append(l.index.Manifests, img.desc)
+		return l.emit(ctx, img, img.desc.Annotations)
+	}
+	for _, child := range leaves(img) {
+		desc := child.desc
+		desc.Annotations = maps.Clone(desc.Annotations)
+		if name, ok := img.desc.Annotations[refNameAnnotation]; ok {
+			if desc.Annotations == nil {
+				desc.Annotations = map[string]string{}
+			}
+			desc.Annotations[refNameAnnotation] = name
+		}
+		l.index.Manifests = append(l.index.Manifests, desc)
+		if err := l.emit(ctx, child, desc.Annotations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaves returns the images of img, descending into nested indexes.
+func leaves(img *image) []*image {
+	if img.children == nil {
+		return []*image{img}
+	}
+	var out []*image
+	for _, child := range img.children {
+		out = append(out, leaves(child)...)
+	}
+	return out
+}
+
+// emit emits the manifest of img and, recursively, what it references.
+// The images of each platform are recorded in its index with the
+// annotations of the reference they were reached from.
+func (l *layout) emit(ctx context.Context, img *image, annotations map[string]string) error {
+	if !l.seen[img.desc.Digest] {
+		l.seen[img.desc.Digest] = true
+		pathname, err := blobPath(img.desc.Digest)
+		if err != nil {
+			return err
+		}
+		rec := l.imp.fileRecord(pathname, img.raw)
+		rec.FileInfo = l.imp.blobInfo(pathname, img.desc)
+		if err := send(ctx, l.records, rec); err != nil {
+			return err
+		}
+	}
+
+	if img.children != nil {
+		for _, child := range img.children {
+			if err := l.emit(ctx, child, annotations); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if l.imp.platform == nil && img.desc.Platform != nil && !img.desc.attestation() {
+		key := img.desc.Platform.dir()
+		pindex, ok := l.platforms[key]
+		if !ok {
+			pi := newImageIndex()
+			pindex = &pi
+			l.platforms[key] = pindex
+		}
+		desc := img.desc
+		desc.Annotations = annotations
+		pindex.Manifests = append(pindex.Manifests, desc)
+	}
+
+	blobs := append([]descriptor{img.manifest.Config}, img.manifest.Layers...)
+	for i, desc := range blobs {
+		if desc.Digest == "" {
+			continue
+		}
+		if l.seen[desc.Digest] {
+			l.imp.stats.skipped.Add(1)
+			continue
+		}
+		l.seen[desc.Digest] = true
+		if desc.foreign() && l.imp.foreign != foreignFetch {
+			if err := l.imp.checkForeign(img, desc); err != nil {
+				return err
+			}
+			if err := l.emitForeign(ctx, desc); err != nil {
+				return err
+			}
+			continue
+		}
+		if l.deferred != nil && i > 0 && !img.desc.attestation() {
+			// downloaded by the root filesystem view
+			l.deferred[desc.Digest] = true
+			continue
+		}
+		rec, err := l.imp.blobRecord(ctx, "/", img.name, desc)
+		if err != nil {
+			return err
+		}
+		if err := send(ctx, l.records, rec); err != nil {
+			rec.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// emitDownload emits the record of the layer desc from its download by
+// the root filesystem view, which the record then owns.
+func (l *layout) emitDownload(ctx context.Context, desc descriptor, dl *download) error {
+	pathname, err := blobPath(desc.Digest)
+	if err == nil {
+		err = dl.rewind()
+	}
+	if err != nil {
+		dl.Close()
+		return err
+	}
+	rec := connectors.NewRecord(pathname, "", l.imp.blobInfo(pathname, desc), nil, nil)
+	rec.Reader = dl
+	if err := send(ctx, l.records, rec); err != nil {
+		rec.Close()
+		return err
+	}
+	return nil
+}
+
+// flushDeferred emits the layers of img the root filesystem view did not
+// hand over, as it failed before applying them.
+func (l *layout) flushDeferred(ctx context.Context, img *image) error {
+	for _, leaf := range leaves(img) {
+		for _, desc := range leaf.manifest.Layers {
+			if !l.deferred[desc.Digest] {
+				continue
+			}
+			delete(l.deferred, desc.Digest)
+			rec, err := l.imp.blobRecord(ctx, "/", img.name, desc)
+			if err != nil {
+				return err
+			}
+			if err := send(ctx, l.records, rec); err != nil {
+				rec.Close()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close emits index.json, and the index of each platform.
+func (l *layout) close(ctx context.Context) error {
+	for _, dir := range slices.Sorted(maps.Keys(l.platforms)) {
+		if err := l.imp.mkdirs(ctx, l.records, l.dirs, dir); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(l.platforms[dir])
+		if err != nil {
+			return err
+		}
+		if err := send(ctx, l.records, l.imp.fileRecord(dir+"/index.json", raw)); err != nil {
+			return err
+		}
+	}
+
+	raw, err := json.Marshal(l.index)
+	if err != nil {
+		return err
+	}
+	return send(ctx, l.records, l.imp.fileRecord("/index.json", raw))
+}
+
+// parents returns dir and its parent directories, outermost first.
+func parents(dir string) []string {
+	var out []string
+	for i := 1; i < len(dir); i++ {
+		if dir[i] == '/' {
+			out = append(out, dir[:i])
+		}
+	}
+	return append(out, dir)
+}
+
+// blobRecord is a blob of the registry, under the blobs directory of
+// the layout at dir, downloaded in the background while the backup works
+// through the records emitted before it.  Blobs of the previous import
+// are only fetched if the backup reads them.
+func (imp *ociImporter) blobRecord(ctx context.Context, dir, ref string, desc descriptor) (*connectors.Record, error) {
+	pathname, err := blobPath(desc.Digest)
+	if err != nil {
+		return connectors.NewError(path.Join(dir, "blobs", desc.Digest), err), nil
+	}
+	return imp.blobFile(ctx, path.Join(dir, pathname), ref, desc)
+}
+
+// blobFile is the record of the blob desc at pathname, as blobRecord.
+func (imp *ociImporter) blobFile(ctx context.Context, pathname, ref string, desc descriptor) (*connectors.Record, error) {
+	fi := imp.blobInfo(pathname, desc)
+	if !imp.force && imp.state.imported(desc.Digest) {
+		imp.stats.skipped.Add(1)
+		// read after the import returned, if at all
+		ctx := context.WithoutCancel(ctx)
+		return connectors.NewRecord(pathname, "", fi, nil, func() (io.ReadCloser, error) {
+			return imp.openBlob(ctx, ref, desc)
+		}), nil
+	}
+	dl, err := imp.downloads.fetch(ctx, imp, ref, desc)
+	if err != nil {
+		return nil, err
+	}
+	rec := connectors.NewRecord(pathname, "", fi, nil, nil)
+	rec.Reader = dl
+	return rec, nil
+}
+
+// blobInfo is the file info of the blob desc, dated from its first
+// import so that it looks unchanged to the backup from then on.
+func (imp *ociImporter) blobInfo(pathname string, desc descriptor) objects.FileInfo {
+	mtime := imp.state.add(desc.Digest, imp.scanned)
+	return objects.NewFileInfo(path.Base(pathname), desc.Size, 0o644, mtime, 0, 0, 0, 0, 1)
+}
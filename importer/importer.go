@@ -0,0 +1,626 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/connectors/importer"
+	"github.com/PlakarKorp/kloset/location"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func init() {
+	for _, scheme := range storage.Schemes() {
+		importer.Register(scheme, 0, New)
+	}
+	importer.Register("oci+dir", location.FLAG_LOCALFS, New)
+	importer.Register("oci+archive", location.FLAG_LOCALFS, New)
+}
+
+// options are the options of the importer, on top of those of the store.
+var options = []string{
+	"download_concurrency",
+	"exclude_repos",
+	"exclude_tags",
+	"force",
+	"foreign_layers",
+	"include_attestations",
+	"include_referrers",
+	"include_repos",
+	"include_tags",
+	"latest_only",
+	"max_images",
+	"max_layer_bytes",
+	"max_total_bytes",
+	"mode",
+	"on_rate_limit",
+	"platform",
+	"rate_limit_floor",
+	"referrer_types",
+	"resume",
+	"tree",
+	"verify",
+	"view",
+}
+
+// Import modes: the registry content as an OCI image layout, the root
+// filesystem of the images, or both.  They are the blobs, rootfs and both
+// views of the view option; mode is its former name.
+const (
+	modeLayout = "layout"
+	modeRootfs = "rootfs"
+	modeBoth   = "both"
+)
+
+// Views, as named by the view option.
+const (
+	viewBlobs  = "blobs"
+	viewRootfs = "rootfs"
+	viewBoth   = "both"
+)
+
+// ociImporter snapshots the content of a repository of an OCI registry.
+type ociImporter struct {
+	src source
+
+	// ref is the tag or digest of the image to import, empty to import
+	// the repository
+	ref string
+
+	// platform selects the images of indexes to import, nil for all;
+	// attestations are imported along with them if set
+	platform     *platform
+	attestations bool
+
+	mode string
+
+	// tree is how the images are laid out, and repoDir the directory of
+	// the repository in the tags tree
+	tree    string
+	repoDir string
+
+	// referrers enables the import of the referrers of the manifests,
+	// of the given artifact types if any; referred lists the subjects
+	// whose referrers were imported
+	referrers     bool
+	referrerTypes []string
+	referred      map[string]bool
+	referrerDirs  map[string]bool
+
+	// foreign is what becomes of foreign layers, and verify of blobs
+	// that do not match their descriptor
+	foreign string
+	verify  string
+
+	// filter selects the tags imported from a repository
+	filter globFilter
+
+	// catalog is the registry whose repositories are imported, when the
+	// location names no repository, and repos selects them
+	catalog *storage.Registry
+	repos   globFilter
+
+	// concurrency bounds the number of blobs downloaded at once
+	concurrency int
+	downloads   *downloader
+
+	// state lists the blobs of the previous import, not downloaded again
+	// unless force is set, nil in the rootfs view
+	state *importState
+	force bool
+
+	// scan tracks the tags of the repository being imported, and scans
+	// lists those of the import, whose progress is kept once it succeeds;
+	// with resume, the tags completed by previous imports are skipped
+	scan   *repoScan
+	scans  *[]*repoScan
+	resume bool
+
+	// rateLimitFloor is the quota of requests below which the scan of a
+	// registry slows down, and onRateLimit what becomes of it once the
+	// quota is exhausted
+	rateLimitFloor int64
+	onRateLimit    string
+
+	// stats counts what the import did
+	stats *importStats
+
+	// limits stop the import once exceeded by the images admitted
+	limits   importLimits
+	admitted *admitted
+
+	// scanned is when the scan started, the modification time of the
+	// blobs first imported by this scan
+	scanned time.Time
+}
+
+// New configures an importer for the image or repository named by the
+// location, e.g. oci://ghcr.io/org/image:v1.2, oci://ghcr.io/org/image@sha256:...
+// or oci://ghcr.io/org/image.  It accepts the options of the store, from
+// which it borrows the registry transport.  Locations without a host,
+// oci:///path, oci+dir://path or oci+archive://path, name an OCI image
+// layout on disk, or a docker-archive or oci-archive tarball.
+func New(ctx context.Context, opts *connectors.Options, name string, config map[string]string) (importer.Importer, error) {
+	loc, ref, err := storage.SplitReference(config["location"])
+	if err != nil {
+		return nil, err
+	}
+	imp := &ociImporter{ref: ref, mode: modeLayout, tree: treeOCI, concurrency: defaultDownloadConcurrency, foreign: foreignSkip, verify: verifyStrict,
+		rateLimitFloor: defaultRateLimitFloor, onRateLimit: onRateLimitFail}
+	if config["mode"] != "" && config["view"] != "" {
+		return nil, fmt.Errorf("options mode and view are mutually exclusive")
+	}
+	switch v := config["mode"]; v {
+	case "", modeLayout:
+	case modeRootfs:
+		imp.mode = modeRootfs
+	default:
+		return nil, fmt.Errorf("invalid mode %q, expected %s or %s", v, modeLayout, modeRootfs)
+	}
+	switch v := config["view"]; v {
+	case "", viewBlobs:
+	case viewRootfs:
+		imp.mode = modeRootfs
+	case viewBoth:
+		imp.mode = modeBoth
+	default:
+		return nil, fmt.Errorf("invalid view %q, expected %s, %s or %s", v, viewBlobs, viewRootfs, viewBoth)
+	}
+	switch v := config["tree"]; v {
+	case "", treeOCI:
+	case treeTags:
+		if imp.mode == modeBoth {
+			return nil, fmt.Errorf("tree %s does not support view %s", treeTags, viewBoth)
+		}
+		imp.tree = v
+	default:
+		return nil, fmt.Errorf("invalid tree %q, expected %s or %s", v, treeOCI, treeTags)
+	}
+	if v := config["platform"]; v != "" && v != "all" {
+		if imp.platform, err = parsePlatform(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := config["include_attestations"]; v != "" {
+		if imp.attestations, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid include_attestations %q", v)
+		}
+	}
+
+	switch v := config["foreign_layers"]; v {
+	case "":
+	case foreignSkip, foreignFetch, foreignFail:
+		imp.foreign = v
+	default:
+		return nil, fmt.Errorf("invalid foreign_layers %q, expected %s, %s or %s", v, foreignSkip, foreignFetch, foreignFail)
+	}
+	switch v := config["verify"]; v {
+	case "":
+	case verifyStrict, verifyWarn:
+		imp.verify = v
+	default:
+		return nil, fmt.Errorf("invalid verify %q, expected %s or %s", v, verifyStrict, verifyWarn)
+	}
+	switch v := config["on_rate_limit"]; v {
+	case "":
+	case onRateLimitWait, onRateLimitFail:
+		imp.onRateLimit = v
+	default:
+		return nil, fmt.Errorf("invalid on_rate_limit %q, expected %s or %s", v, onRateLimitWait, onRateLimitFail)
+	}
+	if v := config["rate_limit_floor"]; v != "" {
+		if imp.rateLimitFloor, err = strconv.ParseInt(v, 10, 64); err != nil || imp.rateLimitFloor < 0 {
+			return nil, fmt.Errorf("invalid rate_limit_floor %q", v)
+		}
+	}
+	for _, limit := range []struct {
+		key string
+		v   *int64
+	}{{"max_total_bytes", &imp.limits.totalBytes}, {"max_layer_bytes", &imp.limits.layerBytes}} {
+		if v := config[limit.key]; v != "" {
+			if *limit.v, err = storage.ParseSize(v); err != nil {
+				return nil, fmt.Errorf("invalid %s %q", limit.key, v)
+			}
+		}
+	}
+	if v := config["max_images"]; v != "" {
+		if imp.limits.images, err = strconv.ParseInt(v, 10, 64); err != nil || imp.limits.images < 0 {
+			return nil, fmt.Errorf("invalid max_images %q", v)
+		}
+	}
+	if v := config["download_concurrency"]; v != "" {
+		if imp.concurrency, err = strconv.Atoi(v); err != nil || imp.concurrency < 1 {
+			return nil, fmt.Errorf("invalid download_concurrency %q", v)
+		}
+	}
+
+	if v := config["include_referrers"]; v != "" {
+		if imp.referrers, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid include_referrers %q", v)
+		}
+	}
+	if imp.referrerTypes, err = parsePatterns("referrer_types", config["referrer_types"]); err != nil {
+		return nil, err
+	}
+	if v := config["force"]; v != "" {
+		if imp.force, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid force %q", v)
+		}
+	}
+	if v := config["resume"]; v != "" {
+		if imp.resume, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid resume %q", v)
+		}
+	}
+
+	if imp.filter.include, err = parsePatterns("include_tags", config["include_tags"]); err != nil {
+		return nil, err
+	}
+	if imp.filter.exclude, err = parsePatterns("exclude_tags", config["exclude_tags"]); err != nil {
+		return nil, err
+	}
+	if imp.repos.include, err = parsePatterns("include_repos", config["include_repos"]); err != nil {
+		return nil, err
+	}
+	if imp.repos.exclude, err = parsePatterns("exclude_repos", config["exclude_repos"]); err != nil {
+		return nil, err
+	}
+	if v := config["latest_only"]; v != "" {
+		latest, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latest_only %q", v)
+		}
+		if latest && imp.filter.include != nil {
+			return nil, fmt.Errorf("options latest_only and include_tags are mutually exclusive")
+		}
+		if latest {
+			imp.filter.include = []string{"latest"}
+		}
+	}
+
+	if isLocalLocation(loc) {
+		var origin string
+		if opts != nil {
+			origin = opts.Hostname
+		}
+		if imp.src, err = openLocal(origin, loc); err != nil {
+			return nil, err
+		}
+		imp.repoDir = path.Join("/", strings.TrimSuffix(filepath.Base(imp.src.Root()), ".tar"))
+		return imp, nil
+	}
+
+	regConfig := maps.Clone(config)
+	regConfig["location"] = loc
+	for _, key := range options {
+		delete(regConfig, key)
+	}
+	reg, err := storage.NewRegistry(ctx, name, regConfig)
+	if err != nil {
+		return nil, err
+	}
+	imp.src = imp.throttle(reg)
+	imp.repoDir = path.Join("/", reg.Name())
+	if reg.Name() == "" {
+		if ref != "" {
+			return nil, fmt.Errorf("location %s names no repository", config["location"])
+		}
+		imp.catalog = reg
+	}
+	return imp, nil
+}
+
+func (imp *ociImporter) Origin() string {
+	return imp.src.Origin()
+}
+
+func (imp *ociImporter) Type() string {
+	return "oci"
+}
+
+func (imp *ociImporter) Root() string {
+	if imp.ref != "" {
+		return imp.src.Root() + refSuffix(imp.ref)
+	}
+	return imp.src.Root()
+}
+
+func (imp *ociImporter) Flags() location.Flags {
+	return 0
+}
+
+func (imp *ociImporter) Ping(ctx context.Context) error {
+	return imp.src.Ping(ctx)
+}
+
+// Import emits the image named by the location, or every tagged image of
+// the repository, as an OCI image layout.
+func (imp *ociImporter) Import(ctx context.Context, records chan<- *connectors.Record, results <-chan *connectors.Result) error {
+	defer close(records)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	imp.downloads = newDownloader(ctx, imp.concurrency)
+	imp.scans = &[]*repoScan{}
+	imp.stats = &importStats{}
+	imp.admitted = &admitted{blobs: map[string]bool{}}
+
+	imp.scanned = time.Now()
+	imp.referred = map[string]bool{}
+	imp.referrerDirs = map[string]bool{"/": true}
+	if imp.mode != modeRootfs {
+		imp.state = loadState(imp.src.Origin() + imp.src.Root())
+	}
+	err := imp.importImages(ctx, records)
+	if err != nil {
+		cancel()
+	}
+	imp.downloads.wait()
+	if err != nil {
+		return err
+	}
+	imp.stats.report(imp.Root())
+
+	if err := imp.state.save(); err != nil {
+		slog.Warn("oci: could not save import state", "error", err)
+	}
+	for _, sc := range *imp.scans {
+		if err := sc.save(imp.resume); err != nil {
+			slog.Warn("oci: could not save import progress", "error", err)
+		}
+	}
+	return nil
+}
+
+func (imp *ociImporter) importImages(ctx context.Context, records chan<- *connectors.Record) error {
+	if imp.catalog != nil {
+		return imp.importCatalog(ctx, records)
+	}
+	if imp.tree == treeTags {
+		return imp.importTree(ctx, records)
+	}
+	if imp.mode == modeRootfs {
+		return imp.importRootfsImages(ctx, records)
+	}
+	if imp.ref != "" {
+		// resolved before anything is emitted, so that a missing image
+		// fails the backup cleanly
+		img, err := imp.resolveImage(ctx, imp.ref)
+		if err != nil {
+			return err
+		}
+		l, err := imp.newLayout(ctx, records)
+		if err != nil {
+			return err
+		}
+		imp.scan = imp.newScan()
+		imp.scan.use(imp.ref, img)
+		if err := l.add(ctx, img); err != nil {
+			return err
+		}
+		if imp.mode == modeBoth {
+			if err := imp.importRootfsImage(ctx, records, img, rootfsDir, l.dirs, l); err != nil {
+				return err
+			}
+			if err := l.flushDeferred(ctx, img); err != nil {
+				return err
+			}
+		}
+		if err := l.close(ctx); err != nil {
+			return err
+		}
+		// the image is all there is, it fails the import
+		if err := imp.finishScan(ctx, records); err != nil {
+			return err
+		}
+		return imp.scan.failed[imp.ref]
+	}
+	return imp.importRepository(ctx, records)
+}
+
+// importTag resolves the image of tag, unless the previous imports
+// completed it already with resume, and starts its import.  A vanished
+// tag is skipped, and a tag that cannot be resolved is reported under
+// its path.
+func (imp *ociImporter) importTag(ctx context.Context, records chan<- *connectors.Record, tag string) (*image, error) {
+	img, err := imp.resolveImage(ctx, tag)
+	if errors.Is(err, fs.ErrNotExist) {
+		// deleted since it was listed
+		slog.Warn("oci: skipping vanished tag", "tag", tag)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, imp.failTag(ctx, records, tag, imp.tagPath(tag), err)
+	}
+	if imp.resume && imp.scan.done(tag, img.desc.Digest) {
+		slog.Debug("oci: skipping tag completed by a previous import", "tag", tag)
+		return nil, nil
+	}
+	imp.scan.start(tag, img)
+	return img, nil
+}
+
+// tagPath is where the failures of tag are reported when the repository
+// is imported: /tags/<tag>, or its directory in the rootfs view and the
+// tags tree.
+func (imp *ociImporter) tagPath(tag string) string {
+	switch {
+	case imp.tree == treeTags:
+		return path.Join(imp.repoDir, escapeName(tag))
+	case imp.mode == modeRootfs:
+		return path.Join("/", tag)
+	}
+	return path.Join("/tags", tag)
+}
+
+// importRepository emits the image of every tag the filter selects, in
+// lexical order.  Only the tag names are listed up front: images are
+// resolved and emitted one at a time, so that repositories with many
+// tags are never held in memory beyond the index.
+func (imp *ociImporter) importRepository(ctx context.Context, records chan<- *connectors.Record) error {
+	l, err := imp.newLayout(ctx, records)
+	if err != nil {
+		return err
+	}
+	imp.scan = imp.newScan()
+	*imp.scans = append(*imp.scans, imp.scan)
+	err = imp.eachTag(ctx, func(tag string) error {
+		img, err := imp.importTag(ctx, records, tag)
+		if img == nil || err != nil {
+			return err
+		}
+		imp.scan.use(tag, img)
+		if err := l.add(ctx, img); err != nil {
+			return err
+		}
+		if imp.mode != modeBoth {
+			return nil
+		}
+		dir := path.Join(rootfsDir, tag)
+		if err := imp.importRootfsImage(ctx, records, img, dir, l.dirs, l); err != nil {
+			if err := imp.failTag(ctx, records, tag, dir, err); err != nil {
+				return err
+			}
+		}
+		return l.flushDeferred(ctx, img)
+	})
+	if err != nil {
+		return err
+	}
+	if err := l.close(ctx); err != nil {
+		return err
+	}
+	return imp.finishScan(ctx, records)
+}
+
+// importRootfsImages emits the root filesystem of the image named by the
+// location at the root of the snapshot, or that of every tagged image
+// under /<tag>.  Images of several platforms each get their own
+// /<os>/<arch>[/<variant>] directory.
+func (imp *ociImporter) importRootfsImages(ctx context.Context, records chan<- *connectors.Record) error {
+	if imp.ref != "" {
+		img, err := imp.resolveImage(ctx, imp.ref)
+		if err != nil {
+			return err
+		}
+		if err := send(ctx, records, imp.dirRecord("/")); err != nil {
+			return err
+		}
+		return imp.importRootfsImage(ctx, records, img, "/", map[string]bool{"/": true}, nil)
+	}
+
+	if err := send(ctx, records, imp.dirRecord("/")); err != nil {
+		return err
+	}
+	dirs := map[string]bool{"/": true}
+	imp.scan = imp.newScan()
+	*imp.scans = append(*imp.scans, imp.scan)
+	err := imp.eachTag(ctx, func(tag string) error {
+		img, err := imp.importTag(ctx, records, tag)
+		if img == nil || err != nil {
+			return err
+		}
+		if err := imp.importRootfsImage(ctx, records, img, path.Join("/", tag), dirs, nil); err != nil {
+			return imp.failTag(ctx, records, tag, path.Join("/", tag), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return imp.finishScan(ctx, records)
+}
+
+// importRootfsImage emits the root filesystem of each platform of img,
+// along with the directories in emitted it lacks.  With both views, l is
+// the layout the layers of img are handed over to once applied, which
+// reports the image and imports its referrers.
+func (imp *ociImporter) importRootfsImage(ctx context.Context, records chan<- *connectors.Record, img *image, prefix string, emitted map[string]bool, l *layout) error {
+	if l == nil {
+		if err := imp.startImage(img); err != nil {
+			return err
+		}
+	}
+	var images []*image
+	for _, leaf := range leaves(img) {
+		if !leaf.desc.attestation() {
+			images = append(images, leaf)
+		}
+	}
+	for _, leaf := range images {
+		dir := prefix
+		if len(images) > 1 && leaf.desc.Platform != nil {
+			dir = path.Join(prefix, strings.TrimPrefix(leaf.desc.Platform.dir(), "/platforms"))
+		}
+		if err := imp.mkdirs(ctx, records, emitted, dir); err != nil {
+			return err
+		}
+		if err := imp.importRootfs(ctx, records, leaf, dir, l); err != nil {
+			return err
+		}
+		if err := imp.emitMetadata(ctx, records, img, leaf, dir); err != nil {
+			return err
+		}
+	}
+	if l != nil {
+		return nil
+	}
+	return imp.importReferrers(ctx, records, img)
+}
+
+func (imp *ociImporter) Close(ctx context.Context) error {
+	return imp.src.Close(ctx)
+}
+
+// send hands rec over to the backup, unless ctx is done first.
+func send(ctx context.Context, records chan<- *connectors.Record, rec *connectors.Record) error {
+	select {
+	case records <- rec:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recordTime is the modification time of the entries the importer
+// makes up, such as directories, index.json and manifests, which the
+// registry does not date: a fixed epoch, so that importing an unchanged
+// repository twice emits identical records.
+var recordTime = time.Unix(0, 0).UTC()
+
+func (imp *ociImporter) dirRecord(pathname string) *connectors.Record {
+	fi := objects.NewFileInfo(path.Base(pathname), 0, fs.ModeDir|0o755, recordTime, 0, 0, 0, 0, 1)
+	return connectors.NewRecord(pathname, "", fi, nil, nil)
+}
+
+// linkRecord is a symbolic link to target.
+func (imp *ociImporter) linkRecord(pathname, target string) *connectors.Record {
+	fi := objects.NewFileInfo(path.Base(pathname), int64(len(target)), fs.ModeSymlink|0o777, recordTime, 0, 0, 0, 0, 1)
+	return connectors.NewRecord(pathname, target, fi, nil, nil)
+}
+
+// fileRecord is a regular file holding content already in memory.
+func (imp *ociImporter) fileRecord(pathname string, content []byte) *connectors.Record {
+	return imp.streamRecord(pathname, int64(len(content)), func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	})
+}
+
+// streamRecord is a regular file of the given size, opened when read.
+func (imp *ociImporter) streamRecord(pathname string, size int64, open func() (io.ReadCloser, error)) *connectors.Record {
+	fi := objects.NewFileInfo(path.Base(pathname), size, 0o644, recordTime, 0, 0, 0, 0, 1)
+	return connectors.NewRecord(pathname, "", fi, nil, open)
+}
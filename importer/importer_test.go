@@ -0,0 +1,53 @@
+package importer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestImportTwice imports an unchanged repository twice, its tags listed
+// in another order the second time, and expects the very same records.
+func TestImportTwice(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	f := newFakeRegistry()
+	amd64 := f.config(`{"architecture":"amd64","os":"linux","config":{"Labels":{"a":"1","b":"2","c":"3"},"Entrypoint":["/bin/x"]}}`)
+	arm64 := f.config(`{"architecture":"arm64","os":"linux"}`)
+	layer := f.blob(tarball(t, []string{"b", "a"}, map[string]string{"a": "first", "b": "second"}))
+	img := f.manifest("", ociManifestMediaType, imageManifest{SchemaVersion: 2, MediaType: ociManifestMediaType, Config: amd64, Layers: []descriptor{layer}})
+	img.Platform = &platform{OS: "linux", Architecture: "amd64"}
+	img2 := f.manifest("", ociManifestMediaType, imageManifest{SchemaVersion: 2, MediaType: ociManifestMediaType, Config: arm64, Layers: []descriptor{layer}})
+	img2.Platform = &platform{OS: "linux", Architecture: "arm64"}
+	for _, tag := range []string{"zeta", "alpha", "mid"} {
+		f.manifest(tag, ociIndexMediaType, imageIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []descriptor{img2, img}})
+	}
+	host := f.start(t)
+
+	for _, view := range []string{"blobs", "rootfs", "both"} {
+		t.Run(view, func(t *testing.T) {
+			var first []string
+			for i, tags := range [][]string{{"zeta", "alpha", "mid"}, {"mid", "zeta", "alpha"}} {
+				f.tags = tags
+				var got []string
+				for _, it := range runImport(t, map[string]string{"location": "oci://" + host + "/repo", "plain_http": "true", "view": view}, nil) {
+					fi := it.rec.FileInfo
+					got = append(got, fmt.Sprintf("%s %s %s %d %s %s %x",
+						it.rec.Pathname, it.rec.XattrName, fi.Mode(), fi.Size(), fi.ModTime().UTC().Format(time.RFC3339Nano), it.rec.Target, it.content))
+				}
+				if i == 0 {
+					first = got
+					continue
+				}
+				if len(got) != len(first) {
+					t.Fatalf("%d records, then %d", len(first), len(got))
+				}
+				for j := range got {
+					if got[j] != first[j] {
+						t.Fatalf("record %d differs:\n%s\n%s", j, first[j], got[j])
+					}
+				}
+			}
+		})
+	}
+}
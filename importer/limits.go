@@ -0,0 +1,77 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// errLimitExceeded marks an import stopped by one of its limits, which
+// aborts it rather than fail a tag: the next tags would exceed it as well,
+// and the location most likely names the wrong repository.
+var errLimitExceeded = errors.New("import limit exceeded")
+
+// importLimits are the safety rails of an import, as set by the
+// max_total_bytes, max_images and max_layer_bytes options, zero for none.
+type importLimits struct {
+	totalBytes int64
+	images     int64
+	layerBytes int64
+}
+
+// admitted accounts for the images an import admitted within its limits:
+// their number, and the size of their distinct blobs.
+type admitted struct {
+	mu     sync.Mutex
+	images int64
+	bytes  int64
+	blobs  map[string]bool
+}
+
+// admit checks img against the limits of the import before any of its
+// blobs is downloaded, from the sizes its descriptors tell, and counts it.
+// Blobs shared with images admitted already are counted once, and foreign
+// layers only when they are fetched.
+func (imp *ociImporter) admit(img *image) error {
+	a := imp.admitted
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if imp.limits.images > 0 && a.images >= imp.limits.images {
+		return imp.limitError(img, "max_images of %d reached", imp.limits.images)
+	}
+	var size int64
+	var blobs []string
+	for _, leaf := range leaves(img) {
+		for i, desc := range append([]descriptor{leaf.manifest.Config}, leaf.manifest.Layers...) {
+			if desc.Digest == "" || (desc.foreign() && imp.foreign != foreignFetch) {
+				continue
+			}
+			if i > 0 && imp.limits.layerBytes > 0 && desc.Size > imp.limits.layerBytes {
+				return imp.limitError(img, "layer %s of %d bytes exceeds max_layer_bytes of %d", desc.Digest, desc.Size, imp.limits.layerBytes)
+			}
+			if !a.blobs[desc.Digest] && !slices.Contains(blobs, desc.Digest) {
+				blobs = append(blobs, desc.Digest)
+				size += desc.Size
+			}
+		}
+	}
+	if imp.limits.totalBytes > 0 && a.bytes+size > imp.limits.totalBytes {
+		return imp.limitError(img, "max_total_bytes of %d exceeded by its %d bytes", imp.limits.totalBytes, size)
+	}
+
+	a.images++
+	a.bytes += size
+	for _, digest := range blobs {
+		a.blobs[digest] = true
+	}
+	return nil
+}
+
+// limitError is the error stopping the import at img, telling which limit
+// was hit and what was imported before.
+func (imp *ociImporter) limitError(img *image, format string, args ...any) error {
+	return fmt.Errorf("%w: %s at image %s, after %d images and %d bytes imported",
+		errLimitExceeded, fmt.Sprintf(format, args...), img.name, imp.admitted.images, imp.admitted.bytes)
+}
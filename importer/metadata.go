@@ -0,0 +1,187 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// Media types of the configs of container images, the only ones the
+// metadata is extracted from.
+const (
+	ociConfigMediaType    = "application/vnd.oci.image.config.v1+json"
+	dockerConfigMediaType = "application/vnd.docker.container.image.v1+json"
+)
+
+// maxConfigSize bounds the image configs read for their metadata.
+const maxConfigSize = 16 << 20
+
+// xattrPrefix namespaces the extended attributes the image metadata is
+// exposed as.
+const xattrPrefix = "user.oci."
+
+// imageConfig holds the fields of an image config exposed as extended
+// attributes.
+type imageConfig struct {
+	Created      string `json:"created,omitempty"`
+	Author       string `json:"author,omitempty"`
+	OS           string `json:"os,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+	Config       struct {
+		User       string            `json:"User,omitempty"`
+		Env        []string          `json:"Env,omitempty"`
+		Entrypoint []string          `json:"Entrypoint,omitempty"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		WorkingDir string            `json:"WorkingDir,omitempty"`
+		Labels     map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	History json.RawMessage `json:"history,omitempty"`
+}
+
+// emitMetadata emits the config of leaf, an image of img, as
+// dir/.oci/config.json, the history of its layers with their created_by
+// provenance as dir/.oci/history.json, and its notable fields as extended
+// attributes of dir: source repository, creation time, platform,
+// entrypoint, command, environment, labels and history.  The attestations of leaf imported
+// along with img are emitted under dir/.oci/attestations.
+func (imp *ociImporter) emitMetadata(ctx context.Context, records chan<- *connectors.Record, img, leaf *image, dir string) error {
+	desc := leaf.manifest.Config
+	if desc.MediaType != ociConfigMediaType && desc.MediaType != dockerConfigMediaType {
+		return nil
+	}
+	raw, err := imp.readBlob(ctx, desc, maxConfigSize)
+	if err != nil {
+		return fmt.Errorf("config %s: %w", desc.Digest, err)
+	}
+	var cfg imageConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return fmt.Errorf("decode config %s: %w", desc.Digest, err)
+	}
+
+	if err := send(ctx, records, imp.dirRecord(path.Join(dir, ".oci"))); err != nil {
+		return err
+	}
+	if err := send(ctx, records, imp.fileRecord(path.Join(dir, ".oci", "config.json"), raw)); err != nil {
+		return err
+	}
+	if len(cfg.History) > 0 {
+		var history bytes.Buffer
+		if err := json.Indent(&history, cfg.History, "", "  "); err != nil {
+			return fmt.Errorf("decode history of config %s: %w", desc.Digest, err)
+		}
+		if err := send(ctx, records, imp.fileRecord(path.Join(dir, ".oci", "history.json"), history.Bytes())); err != nil {
+			return err
+		}
+	}
+	if err := imp.emitAttestations(ctx, records, img, leaf, path.Join(dir, ".oci", "attestations")); err != nil {
+		return err
+	}
+
+	attrs := [][2]string{
+		{"digest", leaf.desc.Digest},
+		{"source", imp.src.Origin() + imp.src.Root()},
+		{"created", cfg.Created},
+		{"author", cfg.Author},
+		{"user", cfg.Config.User},
+		{"working_dir", cfg.Config.WorkingDir},
+		{"env", strings.Join(cfg.Config.Env, "\n")},
+		{"history", string(cfg.History)},
+	}
+	if ref := leaf.desc.Annotations[refNameAnnotation]; ref != "" {
+		attrs = append(attrs, [2]string{"ref", ref})
+	}
+	if cfg.OS != "" {
+		p := platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant}
+		attrs = append(attrs, [2]string{"platform", p.String()})
+	}
+	for _, cmd := range []struct {
+		name string
+		args []string
+	}{{"entrypoint", cfg.Config.Entrypoint}, {"cmd", cfg.Config.Cmd}} {
+		if cmd.args != nil {
+			b, _ := json.Marshal(cmd.args)
+			attrs = append(attrs, [2]string{cmd.name, string(b)})
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(cfg.Config.Labels)) {
+		attrs = append(attrs, [2]string{"label." + k, cfg.Config.Labels[k]})
+	}
+
+	for _, attr := range attrs {
+		if attr[1] == "" {
+			continue
+		}
+		value := []byte(attr[1])
+		rec := connectors.NewXattr(dir, xattrPrefix+attr[0], objects.AttributeExtended, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(value)), nil
+		})
+		rec.FileInfo = objects.NewFileInfo(path.Base(dir), int64(len(value)), 0o644, recordTime, 0, 0, 0, 0, 1)
+		if err := send(ctx, records, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlob reads a small blob, refusing those larger than limit.
+func (imp *ociImporter) readBlob(ctx context.Context, desc descriptor, limit int64) ([]byte, error) {
+	if desc.Size > limit {
+		return nil, fmt.Errorf("blob exceeds %d bytes", limit)
+	}
+	rc, err := imp.src.Blob(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return readSized(rc, desc.Size, limit)
+}
+
+// readSized reads the content of rd, which must be size bytes long, into
+// memory, refusing sizes larger than limit: only manifests and configs
+// are read whole, never blobs whose size is not bounded.  rd is read to
+// its end, where the digest of a blob is checked.
+func readSized(rd io.Reader, size, limit int64) ([]byte, error) {
+	if size < 0 || size > limit {
+		return nil, fmt.Errorf("blob exceeds %d bytes", limit)
+	}
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(rd, raw); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var extra [1]byte
+	switch _, err := io.ReadFull(rd, extra[:]); err {
+	case io.EOF:
+		return raw, nil
+	case nil:
+		return nil, fmt.Errorf("blob exceeds its size of %d bytes", size)
+	default:
+		return nil, err
+	}
+}
+
+// mkdirs emits dir and its parents, skipping those in emitted.
+func (imp *ociImporter) mkdirs(ctx context.Context, records chan<- *connectors.Record, emitted map[string]bool, dir string) error {
+	for _, d := range parents(dir) {
+		if emitted[d] {
+			continue
+		}
+		emitted[d] = true
+		if err := send(ctx, records, imp.dirRecord(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
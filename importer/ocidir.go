@@ -0,0 +1,216 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+)
+
+// source is where images are imported from: a repository of a registry,
+// or an OCI image layout on disk.
+type source interface {
+	Origin() string
+	Root() string
+	Ping(ctx context.Context) error
+
+	// Tags calls fn with each page of tags
+	Tags(ctx context.Context, fn func(tags []string) error) error
+
+	// Manifest returns the manifest ref, its media type if known and
+	// its digest
+	Manifest(ctx context.Context, ref, accept string) ([]byte, string, string, error)
+
+	// Referrers returns the referrers index of digest, fs.ErrNotExist
+	// when the source has no referrers API
+	Referrers(ctx context.Context, digest string) ([]byte, error)
+
+	// Blob returns the content of a blob, checked against its digest
+	// as it is read
+	Blob(ctx context.Context, digest string) (io.ReadCloser, error)
+
+	// Retry calls fn again on the failures worth it
+	Retry(ctx context.Context, fn func() error) error
+
+	Close(ctx context.Context) error
+}
+
+var _ source = (*storage.Registry)(nil)
+
+// layoutMarker is the file identifying an OCI image layout.
+const layoutMarker = "oci-layout"
+
+// layoutDir is an OCI image layout, such as those skopeo copy or buildx
+// --output type=oci write, in a directory or an archive: the images are
+// listed in index.json, and tagged with the
+// org.opencontainers.image.ref.name annotation of their descriptor.
+type layoutDir struct {
+	origin string
+	root   string
+	fsys   fs.FS
+}
+
+// isLocalLocation reports whether loc names an image layout or archive
+// on disk, oci+dir:///path, oci+archive:///path or oci:///path, rather
+// than a registry.
+func isLocalLocation(loc string) bool {
+	return strings.HasPrefix(loc, "oci+dir://") || strings.HasPrefix(loc, "oci+archive://") || strings.HasPrefix(loc, "oci:///")
+}
+
+// openLocal opens the image layout directory or the archive at loc.
+func openLocal(origin, loc string) (source, error) {
+	_, name, _ := strings.Cut(loc, "://")
+	name = filepath.Clean(name)
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return openArchive(origin, name)
+	}
+	return openLayoutDir(origin, name, os.DirFS(name))
+}
+
+// openLayoutDir opens the image layout of fsys, checking its marker.
+func openLayoutDir(origin, root string, fsys fs.FS) (*layoutDir, error) {
+	raw, err := fs.ReadFile(fsys, layoutMarker)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %w", root, err)
+	}
+	var marker struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(raw, &marker); err != nil || marker.ImageLayoutVersion == "" {
+		return nil, fmt.Errorf("%s is not an OCI image layout: invalid %s", root, layoutMarker)
+	}
+	return &layoutDir{origin: origin, root: root, fsys: fsys}, nil
+}
+
+func (l *layoutDir) Origin() string {
+	return l.origin
+}
+
+func (l *layoutDir) Root() string {
+	return l.root
+}
+
+func (l *layoutDir) Ping(ctx context.Context) error {
+	_, err := l.index()
+	return err
+}
+
+func (l *layoutDir) index() (*imageIndex, error) {
+	raw, err := fs.ReadFile(l.fsys, "index.json")
+	if err != nil {
+		return nil, err
+	}
+	var index imageIndex
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return nil, fmt.Errorf("decode index.json of %s: %w", l.root, err)
+	}
+	return &index, nil
+}
+
+// Tags returns the ref names of index.json, all in one page.
+func (l *layoutDir) Tags(ctx context.Context, fn func(tags []string) error) error {
+	index, err := l.index()
+	if err != nil {
+		return err
+	}
+	var tags []string
+	seen := map[string]bool{}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[refNameAnnotation]
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		tags = append(tags, name)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return fn(tags)
+}
+
+// Manifest returns the manifest ref, looking tags up in index.json.  The
+// media type is that of the descriptor of index.json, if any.
+func (l *layoutDir) Manifest(ctx context.Context, ref, accept string) ([]byte, string, string, error) {
+	index, err := l.index()
+	if err != nil {
+		return nil, "", "", err
+	}
+	digest, mediaType := "", ""
+	for _, desc := range index.Manifests {
+		if desc.Digest == ref || (!isDigest(ref) && desc.Annotations[refNameAnnotation] == ref) {
+			digest, mediaType = desc.Digest, desc.MediaType
+			break
+		}
+	}
+	if digest == "" {
+		if !isDigest(ref) {
+			return nil, "", "", fmt.Errorf("tag %s: %w", ref, fs.ErrNotExist)
+		}
+		digest = ref
+	}
+
+	pathname, err := blobPath(digest)
+	if err != nil {
+		return nil, "", "", err
+	}
+	fi, err := fs.Stat(l.fsys, strings.TrimPrefix(pathname, "/"))
+	if err != nil {
+		return nil, "", "", err
+	}
+	rc, err := l.Blob(ctx, digest)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer rc.Close()
+	raw, err := readSized(rc, fi.Size(), maxManifestSize)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("manifest %s: %w", digest, err)
+	}
+	return raw, mediaType, digest, nil
+}
+
+// Referrers is not supported: layouts hold referrers as tags, if any.
+func (l *layoutDir) Referrers(ctx context.Context, digest string) ([]byte, error) {
+	return nil, fmt.Errorf("referrers of %s: %w", digest, fs.ErrNotExist)
+}
+
+func (l *layoutDir) Blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	pathname, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.fsys.Open(strings.TrimPrefix(pathname, "/"))
+	if err != nil {
+		return nil, err
+	}
+	rc, err := storage.NewVerifyingReader(f, digest)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Retry does not retry: local reads do not fail transiently.
+func (l *layoutDir) Retry(ctx context.Context, fn func() error) error {
+	return fn()
+}
+
+func (l *layoutDir) Close(ctx context.Context) error {
+	if c, ok := l.fsys.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
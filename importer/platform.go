@@ -0,0 +1,70 @@
+package importer
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// platform is the platform an image of an index runs on.
+type platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// parsePlatform parses os/arch[/variant], e.g. linux/arm64/v8.
+func parsePlatform(v string) (*platform, error) {
+	parts := strings.Split(v, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant] or all", v)
+	}
+	p := &platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p *platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// key orders platforms, those not given first.
+func (p *platform) key() string {
+	if p == nil {
+		return ""
+	}
+	return p.String()
+}
+
+// unknown reports whether the platform is not given, or given as
+// unknown/unknown, as BuildKit does for attestation manifests.
+func (p *platform) unknown() bool {
+	return p == nil || p.OS == "" || p.Architecture == "" || (p.OS == "unknown" && p.Architecture == "unknown")
+}
+
+// matches reports whether an image for other runs on p.  A filter
+// without variant matches every variant, and arm64 images without
+// variant are v8.
+func (p *platform) matches(other *platform) bool {
+	if other == nil || p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+	if p.Variant == "" {
+		return true
+	}
+	variant := other.Variant
+	if variant == "" && other.Architecture == "arm64" {
+		variant = "v8"
+	}
+	return p.Variant == variant
+}
+
+// dir is the directory of the platform in the snapshot.
+func (p *platform) dir() string {
+	return path.Join("/platforms", p.OS, p.Architecture, p.Variant)
+}
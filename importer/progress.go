@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often the progress of a blob download is
+// reported.
+const progressInterval = 5 * time.Second
+
+// importStats counts what an import did, for the summary reported once
+// it is over.
+type importStats struct {
+	images  atomic.Int64
+	blobs   atomic.Int64
+	bytes   atomic.Int64
+	skipped atomic.Int64
+}
+
+func (st *importStats) report(root string) {
+	slog.Info("oci: import done",
+		"repository", root,
+		"images", st.images.Load(),
+		"blobs", st.blobs.Load(),
+		"bytes", st.bytes.Load(),
+		"skipped_by_dedup", st.skipped.Load())
+}
+
+// startImage starts the import of img once admitted within the limits of
+// the import, and reports it, with the number and size of the blobs of its
+// images as their descriptors tell, before any is downloaded.
+func (imp *ociImporter) startImage(img *image) error {
+	if err := imp.admit(img); err != nil {
+		return err
+	}
+	var blobs, size int64
+	for _, leaf := range leaves(img) {
+		for _, desc := range append([]descriptor{leaf.manifest.Config}, leaf.manifest.Layers...) {
+			if desc.Digest != "" {
+				blobs++
+				size += desc.Size
+			}
+		}
+	}
+	imp.stats.images.Add(1)
+	slog.Info("oci: importing image",
+		"repository", imp.src.Root(),
+		"reference", img.name,
+		"blobs", blobs,
+		"bytes", size)
+	return nil
+}
+
+// progressReader reports how much of a blob was read, every
+// progressInterval.  It wraps the checks of the blob, so that the bytes
+// read again after a dropped connection are counted once per attempt.
+type progressReader struct {
+	rd   io.Reader
+	desc descriptor
+	n    int64
+	last time.Time
+}
+
+func newProgressReader(rd io.Reader, desc descriptor) *progressReader {
+	return &progressReader{rd: rd, desc: desc, last: time.Now()}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.rd.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		slog.Info("oci: downloading blob", "digest", p.desc.Digest, "bytes", p.n, "total", p.desc.Size)
+	}
+	return n, err
+}
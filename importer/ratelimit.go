@@ -0,0 +1,213 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+)
+
+// What becomes of the import once the registry rate limit is exhausted,
+// as named by the on_rate_limit option.
+const (
+	onRateLimitWait = "wait"
+	onRateLimitFail = "fail"
+)
+
+// defaultRateLimitFloor is the number of requests left in the registry
+// rate limit below which the scan slows down.
+const defaultRateLimitFloor = 10
+
+// rateLimitRetry is how long to wait for a registry that exhausted its
+// rate limit without telling until when.
+const rateLimitRetry = time.Minute
+
+// rateLimitProgressInterval is how often a wait for the rate limit is
+// reported.
+const rateLimitProgressInterval = time.Minute
+
+// errRateLimited marks the requests refused for exceeding the registry
+// rate limit with on_rate_limit=fail, which abort the import rather than
+// fail a tag: the next ones would be refused as well.
+var errRateLimited = errors.New("rate limited")
+
+// throttledSource is a repository of a registry whose requests keep
+// within the rate limit the registry announces, as Docker Hub does.  The
+// store already honors Retry-After within its retry policy; once the
+// quota falls below floor, requests are spread over the rest of its
+// window so that the scan slows down rather than exhausts it, and once it
+// is exhausted they wait until the registry accepts them again, or fail.
+type throttledSource struct {
+	*storage.Registry
+	floor   int64
+	onLimit string
+
+	// next is when the next request may be sent while slowed down
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (imp *ociImporter) throttle(reg *storage.Registry) *throttledSource {
+	return &throttledSource{Registry: reg, floor: imp.rateLimitFloor, onLimit: imp.onRateLimit}
+}
+
+func (s *throttledSource) Tags(ctx context.Context, fn func(tags []string) error) error {
+	listed := false
+	for {
+		if err := s.pace(ctx); err != nil {
+			return err
+		}
+		var fnErr error
+		err := s.Registry.Tags(ctx, func(tags []string) error {
+			listed = true
+			fnErr = fn(tags)
+			return fnErr
+		})
+		until, ok := s.refused(err)
+		if !ok || (fnErr != nil && err == fnErr) {
+			return err
+		}
+		// the pages handed to fn are not listed again
+		if listed || s.onLimit == onRateLimitFail {
+			return rateLimitError(until, err)
+		}
+		if err := s.waitUntil(ctx, until); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *throttledSource) Manifest(ctx context.Context, ref, accept string) (raw []byte, mediaType, digest string, err error) {
+	err = s.do(ctx, func() error {
+		raw, mediaType, digest, err = s.Registry.Manifest(ctx, ref, accept)
+		return err
+	})
+	return raw, mediaType, digest, err
+}
+
+func (s *throttledSource) Referrers(ctx context.Context, digest string) (raw []byte, err error) {
+	err = s.do(ctx, func() error {
+		raw, err = s.Registry.Referrers(ctx, digest)
+		return err
+	})
+	return raw, err
+}
+
+func (s *throttledSource) Blob(ctx context.Context, digest string) (rc io.ReadCloser, err error) {
+	err = s.do(ctx, func() error {
+		rc, err = s.Registry.Blob(ctx, digest)
+		return err
+	})
+	return rc, err
+}
+
+// do sends the request fn once the rate limit allows, and sends it again
+// once the registry accepts requests again if it was refused for
+// exceeding its rate limit, unless on_rate_limit=fail.
+func (s *throttledSource) do(ctx context.Context, fn func() error) error {
+	for {
+		if err := s.pace(ctx); err != nil {
+			return err
+		}
+		err := fn()
+		until, ok := s.refused(err)
+		if !ok {
+			return err
+		}
+		if s.onLimit == onRateLimitFail {
+			return rateLimitError(until, err)
+		}
+		if err := s.waitUntil(ctx, until); err != nil {
+			return err
+		}
+	}
+}
+
+// refused reports whether err is the registry refusing a request for
+// exceeding its rate limit, along with when it accepts requests again:
+// as it asked through Retry-After, or once a request of its window is
+// given back.
+func (s *throttledSource) refused(err error) (time.Time, bool) {
+	wait, limited := storage.RateLimited(err)
+	if !limited {
+		return time.Time{}, false
+	}
+	if wait <= 0 {
+		wait = rateLimitRetry
+		if rl, ok := s.RateLimit(); ok && rl.Limit > 0 && rl.Window > 0 {
+			wait = rl.Window / time.Duration(rl.Limit)
+		}
+	}
+	return time.Now().Add(wait), true
+}
+
+// rateLimitError is err, refused by the registry until then with
+// on_rate_limit=fail.
+func rateLimitError(until time.Time, err error) error {
+	return fmt.Errorf("%w until %s: %w", errRateLimited, until.Format(time.RFC3339), err)
+}
+
+// pace waits for the turn of the next request while the quota of the
+// registry is below the floor, the requests left being spread over its
+// window.
+func (s *throttledSource) pace(ctx context.Context) error {
+	rl, ok := s.RateLimit()
+	if !ok || s.floor <= 0 || rl.Remaining >= s.floor || rl.Window <= 0 {
+		return nil
+	}
+	interval := rl.Window / time.Duration(max(rl.Remaining, 1))
+
+	s.mu.Lock()
+	now := time.Now()
+	slot := s.next
+	if slot.Before(now) {
+		slot = now
+	}
+	s.next = slot.Add(interval)
+	s.mu.Unlock()
+
+	delay := slot.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	slog.Info("oci: registry rate limit running low, slowing down",
+		"registry", s.Origin(),
+		"remaining", rl.Remaining,
+		"delay", delay.Round(time.Millisecond))
+	return sleep(ctx, delay)
+}
+
+// waitUntil waits for the rate limit to be lifted at until, reporting the
+// wait as it goes.
+func (s *throttledSource) waitUntil(ctx context.Context, until time.Time) error {
+	for {
+		left := time.Until(until)
+		if left <= 0 {
+			return nil
+		}
+		slog.Info("oci: registry rate limit exhausted, waiting",
+			"registry", s.Origin(),
+			"until", until.Format(time.RFC3339),
+			"left", left.Round(time.Second))
+		if err := sleep(ctx, min(left, rateLimitProgressInterval)); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,24 @@
+package importer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[A-Za-z0-9=_-]+$`)
+
+// isDigest reports whether ref is a digest rather than a tag.
+func isDigest(ref string) bool {
+	return strings.Contains(ref, ":")
+}
+
+// blobPath is where the blob digest lives in the snapshot, following the
+// OCI image layout.
+func blobPath(digest string) (string, error) {
+	if !digestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	algo, hex, _ := strings.Cut(digest, ":")
+	return "/blobs/" + algo + "/" + hex, nil
+}
@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// referrersDir is where the referrers of the imported manifests, such as
+// signatures, SBOMs and attestations, are stored: an OCI image layout per
+// subject, under <subject-digest>/.
+const referrersDir = "/.oci/referrers"
+
+// importReferrers emits the referrers of every manifest of img, when
+// enabled, along with their blobs.
+func (imp *ociImporter) importReferrers(ctx context.Context, records chan<- *connectors.Record, img *image) error {
+	if !imp.referrers {
+		return nil
+	}
+	var subjects []*image
+	var walk func(*image)
+	walk = func(img *image) {
+		subjects = append(subjects, img)
+		for _, child := range img.children {
+			walk(child)
+		}
+	}
+	walk(img)
+
+	for _, subject := range subjects {
+		digest := subject.desc.Digest
+		if imp.referred[digest] {
+			continue
+		}
+		imp.referred[digest] = true
+		if err := imp.importSubjectReferrers(ctx, records, digest); err != nil {
+			return fmt.Errorf("referrers of %s: %w", digest, err)
+		}
+	}
+	return nil
+}
+
+func (imp *ociImporter) importSubjectReferrers(ctx context.Context, records chan<- *connectors.Record, digest string) error {
+	list, err := imp.listReferrers(ctx, digest)
+	if err != nil {
+		return err
+	}
+	index := newImageIndex()
+	for _, desc := range list {
+		if len(imp.referrerTypes) == 0 || matchAny(imp.referrerTypes, desc.ArtifactType) {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+	if len(index.Manifests) == 0 {
+		return nil
+	}
+
+	dir := path.Join(referrersDir, digest)
+	if err := imp.mkdirs(ctx, records, imp.referrerDirs, path.Join(dir, "blobs", "sha256")); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, desc := range index.Manifests {
+		accept := desc.MediaType
+		if accept == "" {
+			accept = ociManifestMediaType
+		}
+		raw, _, _, err := imp.src.Manifest(ctx, desc.Digest, accept)
+		if err != nil {
+			return err
+		}
+		var man imageManifest
+		if err := json.Unmarshal(raw, &man); err != nil {
+			return fmt.Errorf("decode referrer %s: %w", desc.Digest, err)
+		}
+		pathname, err := blobPath(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := send(ctx, records, imp.fileRecord(path.Join(dir, pathname), raw)); err != nil {
+			return err
+		}
+		for _, blob := range append([]descriptor{man.Config}, man.Layers...) {
+			if blob.Digest == "" {
+				continue
+			}
+			if seen[blob.Digest] {
+				imp.stats.skipped.Add(1)
+				continue
+			}
+			seen[blob.Digest] = true
+			rec, err := imp.blobRecord(ctx, dir, desc.Digest, blob)
+			if err != nil {
+				return err
+			}
+			if err := send(ctx, records, rec); err != nil {
+				rec.Close()
+				return err
+			}
+		}
+	}
+
+	raw, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return send(ctx, records, imp.fileRecord(path.Join(dir, "index.json"), raw))
+}
+
+// listReferrers returns the descriptors of the referrers of digest, from
+// the referrers API or, for registries without it, from the index tagged
+// sha256-<hex> following the tag schema.
+func (imp *ociImporter) listReferrers(ctx context.Context, digest string) ([]descriptor, error) {
+	raw, err := imp.src.Referrers(ctx, digest)
+	if errors.Is(err, fs.ErrNotExist) {
+		raw, _, _, err = imp.src.Manifest(ctx, strings.Replace(digest, ":", "-", 1), ociIndexMediaType)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index imageIndex
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return nil, fmt.Errorf("decode referrers: %w", err)
+	}
+	return index.Manifests, nil
+}
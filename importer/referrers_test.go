@@ -0,0 +1,45 @@
+package importer
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestRootfsReferrers imports the root filesystem of an image along with
+// its referrers, listed by the tag of the tag schema, and expects their
+// blobs under the directory of their subject.
+func TestRootfsReferrers(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	f := newFakeRegistry()
+	layer := f.blob(tarball(t, []string{"hello"}, map[string]string{"hello": "world"}))
+	img := f.manifest("latest", ociManifestMediaType, imageManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        f.config(`{"architecture":"amd64","os":"linux"}`),
+		Layers:        []descriptor{layer},
+	})
+	signature := f.blob([]byte("signature"))
+	referrer := f.manifest("", ociManifestMediaType, imageManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        f.config(`{}`),
+		Layers:        []descriptor{signature},
+	})
+	referrer.ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	f.manifest(strings.Replace(img.Digest, ":", "-", 1), ociIndexMediaType, imageIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []descriptor{referrer}})
+	host := f.start(t)
+
+	got := map[string]string{}
+	for _, it := range runImport(t, map[string]string{"location": "oci://" + host + "/repo:latest", "plain_http": "true", "view": "rootfs", "include_referrers": "true"}, nil) {
+		got[it.rec.Pathname] = string(it.content)
+	}
+	if got["/hello"] != "world" {
+		t.Errorf("/hello holds %q, want world", got["/hello"])
+	}
+	blob := path.Join(referrersDir, img.Digest, "blobs", "sha256", strings.TrimPrefix(signature.Digest, "sha256:"))
+	if got[blob] != "signature" {
+		t.Errorf("%s holds %q, want the signature", blob, got[blob])
+	}
+}
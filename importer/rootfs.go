@@ -0,0 +1,405 @@
+package importer
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// Whiteouts of the OCI layer format: .wh.<name> deletes name from the
+// layers below, .wh..wh..opq hides everything the layers below have in
+// its directory.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// rootfs flattens the layers of an image into its root filesystem.
+//
+// Layers are applied from the top one down, so that the first entry met
+// for a path is the one of the merged tree and its content can be handed
+// to the backup straight from the layer stream: nothing is buffered, and
+// every layer is downloaded once.  Hardlinks are the exception: their
+// target may come later in the stream, so they are emitted last and read
+// their content from a second download of the layer holding it.
+type rootfs struct {
+	imp     *ociImporter
+	records chan<- *connectors.Record
+	prefix  string
+	name    string
+	layers  []descriptor
+
+	// blobs is the layout the layers are handed over to once applied,
+	// with both views
+	blobs *layout
+
+	// entries maps the paths of the merged tree to whether they are
+	// directories
+	entries map[string]bool
+
+	// deleted and opaque are the whiteouts of the layers applied so far
+	deleted map[string]bool
+	opaque  map[string]bool
+
+	// sizes maps layer:path to the size of the regular files, for
+	// hardlinks to find their target
+	sizes map[string]int64
+	links []hardlink
+}
+
+// hardlink is a hardlink of layer to target, emitted once every layer
+// has been applied.
+type hardlink struct {
+	layer    int
+	pathname string
+	target   string
+	hdr      *tar.Header
+}
+
+// importRootfs emits the root filesystem of img under prefix, which the
+// caller emits.  With both views, the layers deferred by the layout l are
+// handed over to it once applied, so that each is downloaded once.
+func (imp *ociImporter) importRootfs(ctx context.Context, records chan<- *connectors.Record, img *image, prefix string, l *layout) error {
+	var layers []descriptor
+	for _, desc := range img.manifest.Layers {
+		if desc.foreign() && imp.foreign != foreignFetch {
+			if err := imp.checkForeign(img, desc); err != nil {
+				return err
+			}
+			continue
+		}
+		layers = append(layers, desc)
+	}
+	r := &rootfs{
+		imp:     imp,
+		records: records,
+		prefix:  prefix,
+		name:    img.name,
+		layers:  layers,
+		blobs:   l,
+		entries: map[string]bool{"/": true},
+		deleted: map[string]bool{},
+		opaque:  map[string]bool{},
+		sizes:   map[string]int64{},
+	}
+
+	// layers are downloaded ahead, in the order they are applied
+	fctx, cancel := context.WithCancel(ctx)
+	blobs := make(chan *download, len(r.layers))
+	defer func() {
+		cancel()
+		for dl := range blobs {
+			dl.Close()
+		}
+	}()
+	go func() {
+		defer close(blobs)
+		for i := len(r.layers) - 1; i >= 0; i-- {
+			dl, err := imp.downloads.fetch(fctx, imp, r.name, r.layers[i])
+			if err != nil {
+				return
+			}
+			blobs <- dl
+		}
+	}()
+
+	for i := len(r.layers) - 1; i >= 0; i-- {
+		dl, ok := <-blobs
+		if !ok {
+			return ctx.Err()
+		}
+		if err := r.apply(ctx, i, io.NopCloser(dl)); err != nil {
+			dl.Close()
+			return fmt.Errorf("layer %s: %w", r.layers[i].Digest, err)
+		}
+		if err := r.handOver(ctx, i, dl); err != nil {
+			return err
+		}
+	}
+	for _, link := range r.links {
+		if err := send(ctx, records, r.linkRecord(ctx, link)); err != nil {
+			return err
+		}
+	}
+
+	// directories only implied by the paths of their content
+	implied := map[string]bool{}
+	for name := range r.entries {
+		for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+			if _, ok := r.entries[dir]; !ok {
+				implied[dir] = true
+			}
+		}
+	}
+	for _, dir := range slices.Sorted(maps.Keys(implied)) {
+		if err := send(ctx, records, imp.dirRecord(r.pathname(dir))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathname is where name of the root filesystem lives in the snapshot.
+func (r *rootfs) pathname(name string) string {
+	return path.Join(r.prefix, name)
+}
+
+// hidden reports whether name, met in a layer, is not part of the merged
+// tree: a layer above has it already, deleted it or one of its parents,
+// made a parent opaque, or replaced a parent by something else than a
+// directory.
+func (r *rootfs) hidden(name string) bool {
+	if _, ok := r.entries[name]; ok || r.deleted[name] {
+		return true
+	}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if r.deleted[dir] || r.opaque[dir] {
+			return true
+		}
+		if isDir, ok := r.entries[dir]; ok && !isDir {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+// handOver passes the download of layer i, once applied, to the layout
+// if it deferred its record, and closes it otherwise.
+func (r *rootfs) handOver(ctx context.Context, i int, dl *download) error {
+	desc := r.layers[i]
+	if r.blobs == nil || !r.blobs.deferred[desc.Digest] {
+		return dl.Close()
+	}
+	delete(r.blobs.deferred, desc.Digest)
+	return r.blobs.emitDownload(ctx, desc, dl)
+}
+
+// apply emits the entries of layer i, read from blob, that are part of
+// the merged tree.
+func (r *rootfs) apply(ctx context.Context, i int, blob io.ReadCloser) error {
+	rc, err := layerStream(blob, r.layers[i])
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// whiteouts only apply to the layers below
+	deleted, opaque := map[string]bool{}, map[string]bool{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name := cleanName(hdr.Name)
+		if name == "/" {
+			continue
+		}
+		base := path.Base(name)
+		if base == whiteoutOpaque {
+			opaque[path.Dir(name)] = true
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleted[path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix))] = true
+			continue
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			r.sizes[fmt.Sprintf("%d:%s", i, name)] = hdr.Size
+		}
+		if r.hidden(name) {
+			continue
+		}
+		r.entries[name] = hdr.Typeflag == tar.TypeDir
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if err := r.handoff(ctx, name, hdr, tr); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			r.links = append(r.links, hardlink{layer: i, pathname: name, target: cleanName(hdr.Linkname), hdr: hdr})
+		case tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			// device nodes and fifos only carry metadata
+			rec := connectors.NewRecord(r.pathname(name), hdr.Linkname, fileInfo(hdr, 0), nil, nil)
+			if err := send(ctx, r.records, rec); err != nil {
+				return err
+			}
+		default:
+			delete(r.entries, name)
+		}
+	}
+	for name := range deleted {
+		r.deleted[name] = true
+	}
+	for name := range opaque {
+		r.opaque[name] = true
+	}
+
+	// read to the end of the blob so its digest gets checked
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+// handoff emits a regular file and streams its content from the layer
+// to the backup, returning once the backup read or closed it.
+func (r *rootfs) handoff(ctx context.Context, name string, hdr *tar.Header, content io.Reader) error {
+	pr, pw := io.Pipe()
+	stop := context.AfterFunc(ctx, func() {
+		pr.CloseWithError(ctx.Err())
+	})
+	defer stop()
+
+	rec := connectors.NewRecord(r.pathname(name), "", fileInfo(hdr, hdr.Size), nil, nil)
+	rec.Reader = pr
+	if err := send(ctx, r.records, rec); err != nil {
+		return err
+	}
+
+	// the backup closes content it has no use for, e.g. when unchanged
+	// since the previous snapshot
+	_, err := io.Copy(pw, content)
+	pw.CloseWithError(err)
+	if errors.Is(err, io.ErrClosedPipe) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// linkRecord is a hardlink emitted as a copy of its target, read from the
+// topmost layer at or below the link holding the target.
+func (r *rootfs) linkRecord(ctx context.Context, link hardlink) *connectors.Record {
+	pathname := r.pathname(link.pathname)
+	for i := link.layer; i >= 0; i-- {
+		size, ok := r.sizes[fmt.Sprintf("%d:%s", i, link.target)]
+		if !ok {
+			continue
+		}
+		fi := fileInfo(link.hdr, size)
+		return connectors.NewRecord(pathname, "", fi, nil, func() (io.ReadCloser, error) {
+			return r.openEntry(ctx, i, link.target)
+		})
+	}
+	return connectors.NewError(pathname, fmt.Errorf("hardlink target %s not found", link.target))
+}
+
+// openEntry returns the content of the last entry for name in layer i.
+func (r *rootfs) openEntry(ctx context.Context, i int, name string) (io.ReadCloser, error) {
+	rc, err := r.openLayer(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last entry wins, so the whole layer is scanned before the
+	// matching one is read
+	ordinal, found := 0, -1
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && cleanName(hdr.Name) == name {
+			found = ordinal
+		}
+		ordinal++
+	}
+	rc.Close()
+	if found < 0 {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+
+	if rc, err = r.openLayer(ctx, i); err != nil {
+		return nil, err
+	}
+	tr = tar.NewReader(rc)
+	for ordinal = 0; ordinal <= found; ordinal++ {
+		if _, err := tr.Next(); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{tr, rc}, nil
+}
+
+// openLayer returns the uncompressed tar stream of layer i.
+func (r *rootfs) openLayer(ctx context.Context, i int) (io.ReadCloser, error) {
+	blob, err := r.imp.openBlob(ctx, r.name, r.layers[i])
+	if err != nil {
+		return nil, err
+	}
+	return layerStream(blob, r.layers[i])
+}
+
+// layerStream returns the uncompressed tar stream of the blob of layer
+// desc, which it closes when closed.
+func layerStream(blob io.ReadCloser, desc descriptor) (io.ReadCloser, error) {
+	rd, err := decompress(blob, desc)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{rd, closers{rd, blob}}, nil
+}
+
+// closers closes each of its elements, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// cleanName returns the absolute, cleaned path of a tar entry.
+func cleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+// fileInfo converts the metadata of a tar entry.
+func fileInfo(hdr *tar.Header, size int64) objects.FileInfo {
+	fi := objects.NewFileInfo(path.Base(cleanName(hdr.Name)), size, hdr.FileInfo().Mode(), hdr.ModTime,
+		mkdev(hdr.Devmajor, hdr.Devminor), 0, uint64(hdr.Uid), uint64(hdr.Gid), 1)
+	fi.Lusername = hdr.Uname
+	fi.Lgroupname = hdr.Gname
+	return fi
+}
+
+// mkdev encodes a device number the way Linux does.
+func mkdev(major, minor int64) uint64 {
+	maj, min := uint64(major), uint64(minor)
+	return (maj&0xfffff000)<<32 | (maj&0xfff)<<8 | (min&0xffffff00)<<12 | min&0xff
+}
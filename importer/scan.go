@@ -0,0 +1,181 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// repoScan tracks the import of the tags of a repository: the blobs each
+// tag uses, and those that could not be imported, so that a failed tag
+// does not cost the others and is reported once the repository has been
+// scanned.  The tags imported completely are kept for the next import,
+// which skips them with resume.
+type repoScan struct {
+	file string
+
+	// previous maps the tags completed by the previous imports to their
+	// manifest digest, completed those of this one
+	previous  map[string]string
+	completed map[string]string
+
+	// pending counts the downloads in progress
+	pending sync.WaitGroup
+
+	mu sync.Mutex
+
+	// users maps the digests of blobs to the tags using them; failed
+	// maps the tags not imported, and blobs the blobs not downloaded,
+	// to why
+	users  map[string][]string
+	failed map[string]error
+	blobs  map[string]error
+}
+
+// newScan starts the scan of the repository of the importer, loading the
+// tags completed by the previous imports with resume.
+func (imp *ociImporter) newScan() *repoScan {
+	sc := &repoScan{
+		previous:  map[string]string{},
+		completed: map[string]string{},
+		users:     map[string][]string{},
+		failed:    map[string]error{},
+		blobs:     map[string]error{},
+	}
+	file, err := cacheFile(imp.src.Origin()+imp.src.Root(), ".progress.json")
+	if err != nil {
+		slog.Debug("oci: no cache directory, progress not kept", "error", err)
+		return sc
+	}
+	sc.file = file
+	if imp.resume {
+		if err := readCacheFile(sc.file, &sc.previous); err != nil {
+			slog.Warn("oci: ignoring import progress", "file", sc.file, "error", err)
+			sc.previous = map[string]string{}
+		}
+	}
+	return sc
+}
+
+// done reports whether tag was completed by a previous import, with the
+// same manifest.
+func (sc *repoScan) done(tag, digest string) bool {
+	return sc.previous[tag] == digest
+}
+
+// start records the import of img as that of tag.
+func (sc *repoScan) start(tag string, img *image) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.completed[tag] = img.desc.Digest
+}
+
+// use records that tag uses the blobs of the images of img, which fail
+// it if they cannot be downloaded.
+func (sc *repoScan) use(tag string, img *image) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, leaf := range leaves(img) {
+		for _, desc := range append([]descriptor{leaf.manifest.Config}, leaf.manifest.Layers...) {
+			if desc.Digest != "" {
+				sc.users[desc.Digest] = append(sc.users[desc.Digest], tag)
+			}
+		}
+	}
+}
+
+// fail records that tag could not be imported.
+func (sc *repoScan) fail(tag string, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.failed[tag]; !ok {
+		sc.failed[tag] = err
+	}
+	delete(sc.completed, tag)
+}
+
+// failTag records that tag could not be imported, reporting err under
+// pathname, and the import goes on with the next tag.  It is aborted
+// instead when ctx is done, or when the registry rate limit is exhausted
+// with on_rate_limit=fail: the next tags would fail as well.
+func (imp *ociImporter) failTag(ctx context.Context, records chan<- *connectors.Record, tag, pathname string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if aborts(err) {
+		return err
+	}
+	imp.scan.fail(tag, err)
+	return send(ctx, records, connectors.NewError(pathname, err))
+}
+
+// aborts reports whether err aborts the import rather than fail a tag or
+// repository: the registry rate limit is exhausted with
+// on_rate_limit=fail, or a limit of the import is reached.
+func aborts(err error) bool {
+	return errors.Is(err, errRateLimited) || errors.Is(err, errLimitExceeded)
+}
+
+// failBlob records that the blob digest could not be downloaded, which
+// fails the tags using it.
+func (sc *repoScan) failBlob(digest string, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.blobs[digest] = err
+}
+
+// finishScan waits for the downloads of the repository, and fails the
+// tags using a blob that could not be downloaded, each reported as an
+// error on its path when the repository is imported.  An error listing
+// every tag not imported is then reported at the root, so that the
+// snapshot tells what it misses: the import goes on.
+func (imp *ociImporter) finishScan(ctx context.Context, records chan<- *connectors.Record) error {
+	sc := imp.scan
+	sc.pending.Wait()
+
+	for _, digest := range slices.Sorted(maps.Keys(sc.blobs)) {
+		imp.state.remove(digest)
+		for _, tag := range sc.users[digest] {
+			if _, ok := sc.failed[tag]; ok {
+				continue
+			}
+			sc.fail(tag, sc.blobs[digest])
+			if imp.ref != "" {
+				continue
+			}
+			if err := send(ctx, records, connectors.NewError(imp.tagPath(tag), sc.blobs[digest])); err != nil {
+				return err
+			}
+		}
+	}
+	if len(sc.failed) == 0 || imp.ref != "" {
+		return nil
+	}
+
+	tags := slices.Sorted(maps.Keys(sc.failed))
+	err := fmt.Errorf("%d tags of %s not imported: %s", len(tags), imp.src.Root(), strings.Join(tags, ", "))
+	slog.Warn("oci: tags not imported", "repository", imp.src.Root(), "tags", tags)
+	return send(ctx, records, connectors.NewError("/", err))
+}
+
+// save keeps the tags completed for the next import: with resume, those
+// completed before are kept as well.
+func (sc *repoScan) save(resume bool) error {
+	if sc.file == "" {
+		return nil
+	}
+	if resume {
+		for tag, digest := range sc.completed {
+			sc.previous[tag] = digest
+		}
+		return writeCacheFile(sc.file, sc.previous)
+	}
+	return writeCacheFile(sc.file, sc.completed)
+}
@@ -0,0 +1,126 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// importState records the digests of the blobs a repository was imported
+// with, and when each was first imported, so that the next import skips
+// downloading them.  Their records then carry the same file info as in
+// the previous snapshot, which the backup recognizes as unchanged and
+// reuses without reading: a blob is only fetched if the backup asks for
+// it after all.  Blobs are matched by digest, so retagged images are
+// skipped as well.  A nil state, that of the rootfs view, remembers
+// nothing: every blob is imported.
+type importState struct {
+	file     string
+	previous map[string]int64
+	current  map[string]int64
+}
+
+// cacheFile returns the file of the user cache directory keeping what
+// the imports of key leave for the next, with the given suffix.
+func cacheFile(key, suffix string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, "plakar", "oci-importer", hex.EncodeToString(sum[:])+suffix), nil
+}
+
+// readCacheFile decodes the JSON file name into v.  A missing file is
+// not an error, v is left as it is.
+func readCacheFile(name string, v any) error {
+	raw, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// writeCacheFile replaces the file name with the JSON encoding of v.
+func writeCacheFile(name string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// loadState loads the state of the previous import of key.  A missing or
+// unreadable state only disables the optimization.
+func loadState(key string) *importState {
+	st := &importState{previous: map[string]int64{}, current: map[string]int64{}}
+	file, err := cacheFile(key, ".json")
+	if err != nil {
+		slog.Debug("oci: no cache directory, importing every blob", "error", err)
+		return st
+	}
+	st.file = file
+	if err := readCacheFile(st.file, &st.previous); err != nil {
+		slog.Warn("oci: ignoring import state", "file", st.file, "error", err)
+		st.previous = map[string]int64{}
+	}
+	return st
+}
+
+// imported reports whether digest was imported by the previous import.
+func (st *importState) imported(digest string) bool {
+	if st == nil {
+		return false
+	}
+	_, ok := st.previous[digest]
+	return ok
+}
+
+// add records digest as imported by this import, and returns the
+// modification time of its record: that of its first import, or now.
+func (st *importState) add(digest string, now time.Time) time.Time {
+	if st == nil {
+		return time.Unix(now.Unix(), 0)
+	}
+	ts, ok := st.current[digest]
+	if !ok {
+		if ts, ok = st.previous[digest]; !ok {
+			ts = now.Unix()
+		}
+		st.current[digest] = ts
+	}
+	return time.Unix(ts, 0)
+}
+
+// remove forgets digest, which could not be imported after all.
+func (st *importState) remove(digest string) {
+	if st == nil {
+		return
+	}
+	delete(st.current, digest)
+}
+
+// save persists the digests of this import for the next one, dropping
+// those no longer referenced.
+func (st *importState) save() error {
+	if st == nil || st.file == "" {
+		return nil
+	}
+	return writeCacheFile(st.file, st.current)
+}
@@ -0,0 +1,321 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors"
+)
+
+// Trees, as named by the tree option: the OCI image layout, or one
+// directory per tag.
+const (
+	treeOCI  = "oci"
+	treeTags = "tags"
+)
+
+// digestsDir is the directory of the links from the digests of the
+// manifests to the images of the tags tree.
+const digestsDir = "_digests"
+
+// tagTree emits the images of a repository in one directory per tag, for
+// browsing rather than for the exporter:
+//
+//	/<repository>/<tag>/index.json            index of a multi-platform
+//	                                          image
+//	/<repository>/<tag>/manifest.json         manifest of the image, under
+//	                                          /<os>/<arch>[/<variant>] for
+//	                                          multi-platform images
+//	/<repository>/<tag>/config.json           config of the image
+//	/<repository>/<tag>/layers/<n>-<hex>.tar.gz
+//	                                          layers, in order, with the
+//	                                          extension of their compression
+//	/<repository>/_digests/sha256/<hex>       link to the directory of the
+//	                                          manifest
+//
+// In the rootfs view, the directory of a tag holds the root filesystem of
+// its image instead.  A blob shared by several images is stored with the
+// first, and linked to from the others, so that it is downloaded once.
+type tagTree struct {
+	imp     *ociImporter
+	records chan<- *connectors.Record
+	dirs    map[string]bool
+
+	// blobs maps the digests of the blobs emitted to their path, and
+	// manifests those of the manifests linked from _digests
+	blobs     map[string]string
+	manifests map[string]bool
+}
+
+func (imp *ociImporter) newTagTree(ctx context.Context, records chan<- *connectors.Record) (*tagTree, error) {
+	t := &tagTree{
+		imp:       imp,
+		records:   records,
+		dirs:      map[string]bool{},
+		blobs:     map[string]string{},
+		manifests: map[string]bool{},
+	}
+	if err := imp.mkdirs(ctx, records, t.dirs, "/"); err != nil {
+		return nil, err
+	}
+	if err := imp.mkdirs(ctx, records, t.dirs, imp.repoDir); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// importTree emits the image named by the location, or every tagged image
+// of the repository, as a tags tree.
+func (imp *ociImporter) importTree(ctx context.Context, records chan<- *connectors.Record) error {
+	if imp.ref != "" {
+		img, err := imp.resolveImage(ctx, imp.ref)
+		if err != nil {
+			return err
+		}
+		t, err := imp.newTagTree(ctx, records)
+		if err != nil {
+			return err
+		}
+		imp.scan = imp.newScan()
+		if imp.mode != modeRootfs {
+			imp.scan.use(imp.ref, img)
+		}
+		if err := t.add(ctx, imp.ref, img); err != nil {
+			return err
+		}
+		if err := imp.finishScan(ctx, records); err != nil {
+			return err
+		}
+		return imp.scan.failed[imp.ref]
+	}
+
+	t, err := imp.newTagTree(ctx, records)
+	if err != nil {
+		return err
+	}
+	imp.scan = imp.newScan()
+	*imp.scans = append(*imp.scans, imp.scan)
+	err = imp.eachTag(ctx, func(tag string) error {
+		img, err := imp.importTag(ctx, records, tag)
+		if img == nil || err != nil {
+			return err
+		}
+		if imp.mode != modeRootfs {
+			imp.scan.use(tag, img)
+			return t.add(ctx, tag, img)
+		}
+		if err := t.add(ctx, tag, img); err != nil {
+			return imp.failTag(ctx, records, tag, imp.tagPath(tag), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return imp.finishScan(ctx, records)
+}
+
+// add emits img in the directory of tag.
+func (t *tagTree) add(ctx context.Context, tag string, img *image) error {
+	dir := path.Join(t.imp.repoDir, escapeName(tag))
+	if t.imp.mode == modeRootfs {
+		if err := t.imp.importRootfsImage(ctx, t.records, img, dir, t.dirs, nil); err != nil {
+			return err
+		}
+		return t.link(ctx, img.desc.Digest, dir)
+	}
+
+	if err := t.imp.startImage(img); err != nil {
+		return err
+	}
+	if err := t.imp.mkdirs(ctx, t.records, t.dirs, dir); err != nil {
+		return err
+	}
+	if img.children != nil {
+		if err := send(ctx, t.records, t.imp.fileRecord(path.Join(dir, "index.json"), img.raw)); err != nil {
+			return err
+		}
+		if err := t.link(ctx, img.desc.Digest, dir); err != nil {
+			return err
+		}
+	}
+
+	var images, attestations []*image
+	for _, leaf := range leaves(img) {
+		if leaf.desc.attestation() {
+			attestations = append(attestations, leaf)
+		} else {
+			images = append(images, leaf)
+		}
+	}
+	for _, leaf := range images {
+		leafDir := dir
+		if len(images) > 1 && leaf.desc.Platform != nil {
+			leafDir = path.Join(dir, strings.TrimPrefix(leaf.desc.Platform.dir(), "/platforms"))
+		}
+		if err := t.addImage(ctx, leaf, leafDir); err != nil {
+			return err
+		}
+		if err := t.imp.emitMetadata(ctx, t.records, img, leaf, leafDir); err != nil {
+			return err
+		}
+	}
+	for _, leaf := range attestations {
+		pathname, err := blobPath(leaf.desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := t.addImage(ctx, leaf, path.Join(dir, "attestations", path.Base(pathname))); err != nil {
+			return err
+		}
+	}
+	return t.imp.importReferrers(ctx, t.records, img)
+}
+
+// addImage emits the manifest, config and layers of img in dir.
+func (t *tagTree) addImage(ctx context.Context, img *image, dir string) error {
+	if err := t.imp.mkdirs(ctx, t.records, t.dirs, dir); err != nil {
+		return err
+	}
+	if err := send(ctx, t.records, t.imp.fileRecord(path.Join(dir, "manifest.json"), img.raw)); err != nil {
+		return err
+	}
+	if err := t.link(ctx, img.desc.Digest, dir); err != nil {
+		return err
+	}
+	if desc := img.manifest.Config; desc.Digest != "" {
+		if err := t.addBlob(ctx, img, path.Join(dir, "config.json"), desc); err != nil {
+			return err
+		}
+	}
+	if len(img.manifest.Layers) == 0 {
+		return nil
+	}
+
+	layers := path.Join(dir, "layers")
+	if err := t.imp.mkdirs(ctx, t.records, t.dirs, layers); err != nil {
+		return err
+	}
+	for i, desc := range img.manifest.Layers {
+		pathname, err := blobPath(desc.Digest)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%03d-%s", i+1, path.Base(pathname))
+		if desc.foreign() && t.imp.foreign != foreignFetch {
+			if err := t.imp.checkForeign(img, desc); err != nil {
+				return err
+			}
+			raw, err := json.Marshal(desc)
+			if err != nil {
+				return err
+			}
+			if err := send(ctx, t.records, t.imp.fileRecord(path.Join(layers, name+".foreign.json"), raw)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := t.addBlob(ctx, img, path.Join(layers, name+layerExt(desc.MediaType)), desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBlob emits the blob desc of img at pathname, or a link to where it
+// was emitted already.
+func (t *tagTree) addBlob(ctx context.Context, img *image, pathname string, desc descriptor) error {
+	if target, ok := t.blobs[desc.Digest]; ok {
+		t.imp.stats.skipped.Add(1)
+		return send(ctx, t.records, t.imp.linkRecord(pathname, relPath(path.Dir(pathname), target)))
+	}
+	t.blobs[desc.Digest] = pathname
+	rec, err := t.imp.blobFile(ctx, pathname, img.name, desc)
+	if err != nil {
+		return err
+	}
+	if err := send(ctx, t.records, rec); err != nil {
+		rec.Close()
+		return err
+	}
+	return nil
+}
+
+// link emits the link from the manifest digest to dir under _digests,
+// unless the manifest was linked already.
+func (t *tagTree) link(ctx context.Context, digest, dir string) error {
+	if t.manifests[digest] {
+		return nil
+	}
+	t.manifests[digest] = true
+	pathname, err := blobPath(digest)
+	if err != nil {
+		return err
+	}
+	pathname = path.Join(t.imp.repoDir, digestsDir, strings.TrimPrefix(pathname, "/blobs"))
+	if err := t.imp.mkdirs(ctx, t.records, t.dirs, path.Dir(pathname)); err != nil {
+		return err
+	}
+	return send(ctx, t.records, t.imp.linkRecord(pathname, relPath(path.Dir(pathname), dir)))
+}
+
+// layerExt is the file extension of layers of the given media type.
+func layerExt(mediaType string) string {
+	switch mediaTypeCompression(mediaType) {
+	case compressionNone:
+		return ".tar"
+	case compressionGzip:
+		return ".tar.gz"
+	case compressionZstd:
+		return ".tar.zst"
+	}
+	return ""
+}
+
+// escapeName makes name, such as a tag, a valid file name.  Bytes other
+// than ASCII letters, digits, '-', '.' and '_' are percent-encoded, as are
+// a leading '.' or '_', so that no file is named . or .., or clashes with
+// _digests.  The escaping is reversed by url.PathUnescape.
+func escapeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case i == 0 && (c == '.' || c == '_'):
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_':
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// relPath is the relative path from the directory from to target, both
+// absolute and clean.
+func relPath(from, target string) string {
+	src := strings.Split(strings.TrimPrefix(from, "/"), "/")
+	dst := strings.Split(strings.TrimPrefix(target, "/"), "/")
+	if from == "/" {
+		src = nil
+	}
+	if target == "/" {
+		dst = nil
+	}
+	n := 0
+	for n < len(src) && n < len(dst) && src[n] == dst[n] {
+		n++
+	}
+	elems := make([]string, 0, len(src)-n+len(dst)-n)
+	for range src[n:] {
+		elems = append(elems, "..")
+	}
+	elems = append(elems, dst[n:]...)
+	if len(elems) == 0 {
+		return "."
+	}
+	return strings.Join(elems, "/")
+}
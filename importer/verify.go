@@ -0,0 +1,76 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/PlakarKorp/integration-oci/storage"
+)
+
+// What becomes of a blob whose content does not match its descriptor:
+// its image fails, or it is imported as it is with a warning.
+const (
+	verifyStrict = "strict"
+	verifyWarn   = "warn"
+)
+
+// errBlobMismatch is matched by the errors reporting a blob whose digest
+// or size is not that of its descriptor.
+var errBlobMismatch = errors.New("blob does not match its descriptor")
+
+// checkedBlob checks the size of a blob against its descriptor as it is
+// read.  Its digest is checked by the reader of the source, whose
+// mismatches are reported the same way.
+type checkedBlob struct {
+	rc   io.ReadCloser
+	imp  *ociImporter
+	ref  string
+	desc descriptor
+
+	n        int64
+	reported bool
+}
+
+func (b *checkedBlob) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.n += int64(n)
+
+	var mismatch error
+	switch {
+	case b.reported:
+	case b.n > b.desc.Size:
+		mismatch = fmt.Errorf("size exceeds the %d bytes of the descriptor", b.desc.Size)
+	case (err == io.EOF || errors.Is(err, storage.ErrDigestMismatch)) && b.n != b.desc.Size:
+		mismatch = fmt.Errorf("size is %d bytes, the descriptor says %d", b.n, b.desc.Size)
+	case errors.Is(err, storage.ErrDigestMismatch):
+		mismatch = err
+	}
+	if mismatch == nil {
+		if errors.Is(err, storage.ErrDigestMismatch) {
+			// reported already
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	b.reported = true
+	mismatch = fmt.Errorf("image %s%s: blob %s: %w: %w", b.imp.src.Root(), refSuffix(b.ref), b.desc.Digest, errBlobMismatch, mismatch)
+	if b.imp.verify == verifyStrict {
+		return n, mismatch
+	}
+	slog.Warn("oci: importing blob that does not match its descriptor",
+		"repository", b.imp.src.Root(),
+		"reference", b.ref,
+		"digest", b.desc.Digest,
+		"error", mismatch)
+	if errors.Is(err, storage.ErrDigestMismatch) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *checkedBlob) Close() error {
+	return b.rc.Close()
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+
+	sdk "github.com/PlakarKorp/go-kloset-sdk"
+	"github.com/PlakarKorp/integration-oci/exporter"
+)
+
+func main() {
+	sdk.EntrypointExporter(os.Args, exporter.New)
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+
+	sdk "github.com/PlakarKorp/go-kloset-sdk"
+	"github.com/PlakarKorp/integration-oci/importer"
+)
+
+func main() {
+	sdk.EntrypointImporter(os.Args, importer.New)
+}
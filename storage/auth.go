@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// challenge is a parsed WWW-Authenticate header.
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenge parses a single WWW-Authenticate challenge such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(header string) challenge {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	ch := challenge{scheme: strings.ToLower(scheme), params: map[string]string{}}
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		k, v, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		if strings.HasPrefix(v, `"`) {
+			end := strings.Index(v[1:], `"`)
+			if end < 0 {
+				ch.params[k] = v[1:]
+				break
+			}
+			ch.params[k] = v[1 : end+1]
+			rest = v[end+2:]
+		} else {
+			val, tail, _ := strings.Cut(v, ",")
+			ch.params[k] = strings.TrimSpace(val)
+			rest = tail
+		}
+	}
+	return ch
+}
+
+// tokenAuth holds the bearer token obtained from the registry's token
+// service after a Bearer challenge.
+type tokenAuth struct {
+	mu    sync.Mutex
+	token string
+}
+
+func (t *tokenAuth) get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.token
+}
+
+func (t *tokenAuth) set(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = token
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// scopes returns the token scopes requested for this store, always
+// including pull and push on the configured repository, if any, and those
+// resources are routed to, and pull on the repositories blobs are
+// mounted from.
+func (s *ociStore) scopes(ch challenge) []string {
+	var scopes []string
+	if s.repo != "" {
+		scopes = append(scopes, "repository:"+s.repo+":pull,push")
+	}
+	for _, repo := range s.cfg.Repos {
+		if sc := "repository:" + repo + ":pull,push"; !slices.Contains(scopes, sc) {
+			scopes = append(scopes, sc)
+		}
+	}
+	for _, from := range s.cfg.MountFrom {
+		scopes = append(scopes, "repository:"+from+":pull")
+	}
+	if sc := ch.params["scope"]; sc != "" && !slices.Contains(scopes, sc) {
+		scopes = append(scopes, strings.Fields(sc)...)
+	}
+	return scopes
+}
+
+// fetchToken answers a Bearer challenge by requesting a token from the
+// realm it designates, using the configured credentials if any.
+func (s *ociStore) fetchToken(ctx context.Context, ch challenge) (string, error) {
+	realm := ch.params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("bearer challenge realm: %w", err)
+	}
+	q := u.Query()
+	if svc := ch.params["service"]; svc != "" {
+		q.Set("service", svc)
+	}
+	for _, sc := range s.scopes(ch) {
+		q.Add("scope", sc)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", redactError(err)
+	}
+	req.Header.Set("User-Agent", userAgent())
+	s.setExtraHeaders(req)
+	if s.cfg.Username != "" || s.cfg.Password != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", redactError(err)
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &authError{status: resp.Status, realm: redactURL(realm)}
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tr); err != nil {
+		return "", fmt.Errorf("decode token response: %w", err)
+	}
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("token service returned no token")
+	}
+	s.auth.set(token)
+	return token, nil
+}
+
+// trustedHost reports whether credentials may be sent to host: the
+// registry itself or one of the configured redirect hosts.
+func (s *ociStore) trustedHost(host string) bool {
+	if strings.EqualFold(host, s.host) {
+		return true
+	}
+	for _, h := range s.cfg.RedirectHosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// setExtraHeaders adds the extra_headers to req, for trusted hosts only:
+// they may carry API keys, not meant for third-party blob stores.  Each
+// request gets its own copy of the values.
+func (s *ociStore) setExtraHeaders(req *http.Request) {
+	if !s.trustedHost(req.URL.Host) {
+		return
+	}
+	for k, vv := range s.cfg.ExtraHeaders {
+		req.Header[k] = slices.Clone(vv)
+	}
+}
+
+// authorize sets the Authorization header of req from the configured
+// credentials, preferring a static bearer token, then a token obtained
+// from the token service, then basic credentials.  Nothing is attached
+// for hosts other than trusted ones, so following a Location to a
+// third-party blob store never leaks credentials.
+func (s *ociStore) authorize(req *http.Request) {
+	if !s.trustedHost(req.URL.Host) {
+		req.Header.Del("Authorization")
+		return
+	}
+	if s.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.BearerToken)
+	} else if token := s.auth.get(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if s.cfg.Username != "" || s.cfg.Password != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+}
+
+// checkRedirect is the client's redirect policy.  Blob downloads are
+// commonly redirected to presigned object storage URLs, which reject
+// requests that also carry an Authorization header: credentials, and the
+// extra headers that may carry them, are therefore only kept for trusted
+// hosts, while the Range header of the
+// original request is always carried over.
+func (s *ociStore) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	if s.rewrite.url(req.URL) {
+		req.Host = ""
+	}
+	if s.trustedHost(req.URL.Host) {
+		s.authorize(req)
+	} else {
+		req.Header.Del("Authorization")
+		req.Header.Del("Cookie")
+		for k := range s.cfg.ExtraHeaders {
+			req.Header.Del(k)
+		}
+	}
+	if rng := via[0].Header.Get("Range"); rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	return nil
+}
+
+// authError reports that the token service rejected our credentials.
+type authError struct {
+	status string
+	realm  string
+}
+
+func (e *authError) Error() string {
+	return fmt.Sprintf("authentication rejected by %s: %s", e.realm, e.status)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// TestBasePath runs a store against a registry served under a sub-path,
+// given in the location or with base_path.
+func TestBasePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		repo    string
+		options []string
+		chunked bool
+	}{
+		{name: "location", repo: "registry/api//plakar"},
+		{name: "location chunked", repo: "registry/api//plakar", chunked: true},
+		{name: "base_path", repo: "plakar", options: []string{"base_path", "/registry/api/"}},
+		{name: "base_path chunked", repo: "plakar", options: []string{"base_path", "registry/api"}, chunked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRegistry()
+			f.prefix = "/registry/api"
+			host := f.start(t)
+
+			config := map[string]string{"location": "oci://" + host + "/" + tt.repo, "plain_http": "true"}
+			for i := 0; i+1 < len(tt.options); i += 2 {
+				config[tt.options[i]] = tt.options[i+1]
+			}
+			if tt.chunked {
+				config["upload_chunked"] = "true"
+				config["upload_chunk_size"] = "16"
+			}
+			s, err := newStore(context.Background(), config, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			mac := objects.MAC{1}
+			payload := []byte("a state under a prefixed registry")
+			if _, err := s.Put(ctx, storage.StorageResourceState, mac, bytes.NewReader(payload)); err != nil {
+				t.Fatal(err)
+			}
+			macs, err := s.List(ctx, storage.StorageResourceState)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(macs) != 1 || macs[0] != mac {
+				t.Fatalf("listed %x, want %x", macs, mac)
+			}
+			rc, err := s.Get(ctx, storage.StorageResourceState, mac, nil)
+			if got := readAll(t, rc, err); !bytes.Equal(got, payload) {
+				t.Fatalf("read %q, want %q", got, payload)
+			}
+			if err := s.Delete(ctx, storage.StorageResourceState, mac); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := f.tagged("plakar", fmt.Sprintf("state-%x", mac)); ok {
+				t.Fatal("state still tagged")
+			}
+
+			for _, r := range f.logged() {
+				if !strings.HasPrefix(r.path, "/registry/api/v2/plakar/") {
+					t.Fatalf("%s %s outside the registry prefix", r.method, r.path)
+				}
+			}
+		})
+	}
+}
+
+func TestBasePathConflict(t *testing.T) {
+	_, err := newStore(context.Background(), map[string]string{
+		"location":  "oci://registry.example.com/a//repo",
+		"base_path": "b",
+	}, false)
+	if err == nil || !strings.Contains(err.Error(), `base path "a" in location conflicts with base_path "b"`) {
+		t.Fatalf("error %v, want a base path conflict", err)
+	}
+}
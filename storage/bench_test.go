@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// BenchmarkPutSmall puts small states, the writes a backup makes the
+// most of, to the fake registry.
+func BenchmarkPutSmall(b *testing.B) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	s := openFake(b, f.start(b))
+	payload := bytes.Repeat([]byte("x"), 512)
+
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		mac := objects.MAC{byte(i), byte(i >> 8), byte(i >> 16)}
+		if _, err := s.Put(ctx, storage.StorageResourceState, mac, bytes.NewReader(payload)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetSmall reads a small state back from the fake registry.
+func BenchmarkGetSmall(b *testing.B) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	s := openFake(b, f.start(b))
+	payload := bytes.Repeat([]byte("x"), 512)
+	mac := objects.MAC{1}
+	if _, err := s.Put(ctx, storage.StorageResourceState, mac, bytes.NewReader(payload)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		rc, err := s.Get(ctx, storage.StorageResourceState, mac, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			b.Fatal(err)
+		}
+		rc.Close()
+	}
+}
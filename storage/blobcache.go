@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+)
+
+// defaultCacheMaxBytes bounds the blob cache when cache_max_bytes is not
+// set.
+const defaultCacheMaxBytes = 1 << 30
+
+// cacheTempMaxAge is the age past which a temporary file of the blob
+// cache, left behind by a process that died while filling it, is removed.
+const cacheTempMaxAge = time.Hour
+
+// blobCache keeps the blobs read in full on disk, under
+// <dir>/sha256/<hex>, so that the reads of a blob read before are served
+// locally, ranged reads included.  It is shared by the stores of the
+// process, and by the processes given the same directory: a blob is
+// written to a temporary file, checked against its digest as it is read,
+// and renamed in place, so that the cache only ever holds complete and
+// correct blobs.  Past max bytes, the least recently used blobs are
+// removed, recency being the modification time of their file, which each
+// read refreshes.  A nil cache holds nothing.
+type blobCache struct {
+	dir string
+	max int64
+
+	// mu serializes the evictions of the process
+	mu sync.Mutex
+}
+
+func newBlobCache(dir string, max int64) (*blobCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "sha256"), 0o700); err != nil {
+		return nil, fmt.Errorf("cache_dir: %w", err)
+	}
+	return &blobCache{dir: dir, max: max}, nil
+}
+
+// path is the file of the blob digest in the cache, false for digests it
+// does not hold.
+func (c *blobCache) path(digest string) (string, bool) {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", false
+	}
+	return filepath.Join(c.dir, "sha256", hexDigest), true
+}
+
+// get returns rg of the blob digest of the given size, or all of it when
+// rg is nil, if the cache holds it.
+func (c *blobCache) get(digest string, size int64, rg *storage.Range) (io.ReadCloser, bool, error) {
+	if c == nil {
+		return nil, false, nil
+	}
+	pathname, ok := c.path(digest)
+	if !ok {
+		return nil, false, nil
+	}
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, false, nil
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != size {
+		f.Close()
+		return nil, false, nil
+	}
+	now := time.Now()
+	os.Chtimes(pathname, now, now)
+
+	if rg == nil {
+		return f, true, nil
+	}
+	end := uint64(size)
+	if rg.Length != 0 {
+		end = rg.Offset + uint64(rg.Length)
+	}
+	if rg.Offset >= uint64(size) || end > uint64(size) {
+		f.Close()
+		return nil, true, ErrRangeNotSatisfiable
+	}
+	return &readCloser{Reader: io.NewSectionReader(f, int64(rg.Offset), int64(end-rg.Offset)), Closer: f}, true, nil
+}
+
+// populate returns rc, the blob digest of the given size, copying it to
+// the cache as it is read.  rc must check the blob against its digest as
+// it is read, as a verifyingReader does: the copy is only kept once rc
+// is read to its end without error, and is dropped otherwise.
+func (c *blobCache) populate(rc io.ReadCloser, digest string, size int64) io.ReadCloser {
+	if c == nil || size > c.max {
+		return rc
+	}
+	pathname, ok := c.path(digest)
+	if !ok {
+		return rc
+	}
+	f, err := os.CreateTemp(filepath.Dir(pathname), ".tmp-*")
+	if err != nil {
+		slog.Debug("oci: blob cache unavailable", "error", err)
+		return rc
+	}
+	return &cachingReader{rc: rc, cache: c, f: f, pathname: pathname}
+}
+
+// cachingReader copies what is read of a blob to a temporary file of
+// the cache, renamed in place once the blob is read to its end.
+type cachingReader struct {
+	rc       io.ReadCloser
+	cache    *blobCache
+	f        *os.File
+	pathname string
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if r.f == nil {
+		return n, err
+	}
+	if n > 0 {
+		if _, werr := r.f.Write(p[:n]); werr != nil {
+			slog.Debug("oci: could not write to the blob cache", "error", werr)
+			r.discard()
+			return n, err
+		}
+	}
+	switch {
+	case err == io.EOF:
+		r.commit()
+	case err != nil:
+		r.discard()
+	}
+	return n, err
+}
+
+func (r *cachingReader) commit() {
+	f := r.f
+	r.f = nil
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if err := os.Rename(f.Name(), r.pathname); err != nil {
+		slog.Debug("oci: could not write to the blob cache", "error", err)
+		os.Remove(f.Name())
+		return
+	}
+	r.cache.evict()
+}
+
+func (r *cachingReader) discard() {
+	if r.f != nil {
+		r.f.Close()
+		os.Remove(r.f.Name())
+		r.f = nil
+	}
+}
+
+func (r *cachingReader) Close() error {
+	r.discard()
+	return r.rc.Close()
+}
+
+// evict removes the least recently used blobs until the cache fits in
+// its size, along with the temporary files of processes long gone.
+// Processes evicting at the same time may remove more than needed, which
+// only costs fetching those blobs again.
+func (c *blobCache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := filepath.Join(c.dir, "sha256")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Debug("oci: could not list the blob cache", "error", err)
+		return
+	}
+	type cached struct {
+		pathname string
+		size     int64
+		used     time.Time
+	}
+	var blobs []cached
+	var total int64
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		pathname := filepath.Join(dir, e.Name())
+		if strings.HasPrefix(e.Name(), ".tmp-") {
+			if time.Since(fi.ModTime()) > cacheTempMaxAge {
+				os.Remove(pathname)
+			}
+			continue
+		}
+		blobs = append(blobs, cached{pathname: pathname, size: fi.Size(), used: fi.ModTime()})
+		total += fi.Size()
+	}
+	if total <= c.max {
+		return
+	}
+
+	slices.SortFunc(blobs, func(a, b cached) int {
+		return a.used.Compare(b.used)
+	})
+	for _, b := range blobs {
+		if total <= c.max {
+			break
+		}
+		if err := os.Remove(b.pathname); err == nil || errors.Is(err, fs.ErrNotExist) {
+			total -= b.size
+		}
+	}
+}
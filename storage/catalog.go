@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const catalogPageSize = 100
+
+// ErrCatalogUnsupported is returned when the registry does not let its
+// repositories be listed.
+var ErrCatalogUnsupported = errors.New("catalog listing not supported; specify a repository")
+
+// errStopCatalog ends a catalog listing early without error.
+var errStopCatalog = errors.New("stop catalog")
+
+type catalogList struct {
+	Repositories []string `json:"repositories"`
+}
+
+// catalogPages calls fn with each page of the _catalog endpoint,
+// following Link headers or, failing them, the last repository of the
+// page.
+func (s *ociStore) catalogPages(ctx context.Context, fn func(repos []string) error) error {
+	next := s.baseURL("_catalog?n=" + strconv.Itoa(catalogPageSize))
+	seen := map[string]struct{}{}
+
+	for next != "" {
+		if _, ok := seen[next]; ok {
+			return fmt.Errorf("_catalog pagination loops on %s", redactURL(next))
+		}
+		seen[next] = struct{}{}
+
+		pageCtx, cancel := s.controlContext(ctx)
+		rc, resp, err := s.do(pageCtx, "GET", next, nil, nil)
+		if err != nil {
+			cancel()
+			if resp != nil {
+				switch resp.StatusCode {
+				case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed:
+					return fmt.Errorf("registry %s: %w: %w", s.base, ErrCatalogUnsupported, err)
+				}
+			}
+			return err
+		}
+		var cl catalogList
+		err = json.NewDecoder(rc).Decode(&cl)
+		drainAndClose(rc)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("registry %s: decode _catalog: %w", s.base, err)
+		}
+		if len(cl.Repositories) == 0 {
+			break
+		}
+		if err := fn(cl.Repositories); err != nil {
+			if errors.Is(err, errStopCatalog) {
+				return nil
+			}
+			return err
+		}
+
+		next = ""
+		if link := parseNextLink(resp.Header.Get("Link")); link != "" {
+			next, err = s.resolveLocation(resp, link)
+			if err != nil {
+				return err
+			}
+		} else if len(cl.Repositories) == catalogPageSize {
+			last := cl.Repositories[len(cl.Repositories)-1]
+			next = s.baseURL("_catalog?n=" + strconv.Itoa(catalogPageSize) + "&last=" + url.QueryEscape(last))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of the payload layers, set by the compression option.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// layerMediaType is the media type of the payload layers stored as they
+// are given; a compressed layer has the compression as a suffix, e.g.
+// application/octet-stream+zstd.
+const layerMediaType = "application/octet-stream"
+
+// compressedTag reports whether the payload of tag is compressed when a
+// compression is set: states and locks are, while packfiles, already
+// compressed by plakar and read by range, never are, nor is the
+// configuration, which other tools may read.
+func compressedTag(tag string) bool {
+	return strings.HasPrefix(tag, "state-") || strings.HasPrefix(tag, "locks-")
+}
+
+// layerCompression returns the compression of a payload layer according
+// to its media type.  Layers written before compression existed are
+// application/octet-stream, and read as they are.
+func layerCompression(mediaType string) (string, error) {
+	switch mediaType {
+	case "", layerMediaType:
+		return compressionNone, nil
+	case layerMediaType + "+" + compressionGzip:
+		return compressionGzip, nil
+	case layerMediaType + "+" + compressionZstd:
+		return compressionZstd, nil
+	}
+	return "", fmt.Errorf("oci: unsupported payload layer media type %s", mediaType)
+}
+
+// compress returns rd compressed with algo, compressed by a goroutine as
+// it is read.  Closing the reader stops the goroutine.
+func compress(rd io.Reader, algo string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var w io.WriteCloser
+		switch algo {
+		case compressionGzip:
+			w = gzip.NewWriter(pw)
+		case compressionZstd:
+			zw, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			w = zw
+		}
+		_, err := copyBuffer(w, rd)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decompress returns rg of the uncompressed content of rc, a layer
+// compressed with algo, or all of it when rg is nil.  The range is cut
+// out of the whole content client-side, which is why the resources read
+// by range are never compressed.  rc is read to its end once the content
+// is, so that a verifyingReader under it checks the layer.
+func decompress(rc io.ReadCloser, algo string, rg *storage.Range) (io.ReadCloser, error) {
+	d := &decompressingReader{rc: rc}
+	switch algo {
+	case compressionGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decompress layer: %w", err)
+		}
+		d.rd, d.close = zr, func() { zr.Close() }
+	case compressionZstd:
+		zr, err := zstd.NewReader(rc,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true))
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decompress layer: %w", err)
+		}
+		d.rd, d.close = zr, zr.Close
+	default:
+		return rc, nil
+	}
+	if rg == nil {
+		return d, nil
+	}
+
+	if _, err := io.CopyN(io.Discard, d, int64(rg.Offset)); err != nil {
+		d.Close()
+		if err == io.EOF {
+			return nil, ErrRangeNotSatisfiable
+		}
+		return nil, err
+	}
+	if rg.Length == 0 {
+		return d, nil
+	}
+	return &readCloser{Reader: io.LimitReader(d, int64(rg.Length)), Closer: d}, nil
+}
+
+type decompressingReader struct {
+	rc    io.ReadCloser
+	rd    io.Reader
+	close func()
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	n, err := d.rd.Read(p)
+	if err == io.EOF {
+		// the layer must hold nothing past the compressed stream
+		if m, derr := io.Copy(io.Discard, d.rc); derr != nil {
+			return n, derr
+		} else if m > 0 {
+			return n, fmt.Errorf("decompress layer: %d trailing bytes", m)
+		}
+	}
+	return n, err
+}
+
+func (d *decompressingReader) Close() error {
+	d.close()
+	return d.rc.Close()
+}
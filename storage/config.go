@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// optionSource identifies where a configuration value came from.  Sources
+// are declared from lowest to highest precedence.
+type optionSource int
+
+const (
+	sourceDefault optionSource = iota
+	sourceUserinfo
+	sourceQuery
+	sourceEnv
+	sourceConfig
+)
+
+func (src optionSource) String() string {
+	switch src {
+	case sourceDefault:
+		return "default"
+	case sourceUserinfo:
+		return "location userinfo"
+	case sourceQuery:
+		return "location query"
+	case sourceEnv:
+		return "environment"
+	case sourceConfig:
+		return "config"
+	default:
+		return "unknown"
+	}
+}
+
+// envPrefix is prepended to the upper-cased option name to form the
+// environment variable overriding it, e.g. PLAKAR_OCI_USERNAME.
+const envPrefix = "PLAKAR_OCI_"
+
+// credentialKeys are options for which two sources disagreeing is an
+// error rather than a warning: silently authenticating as the wrong
+// identity is never what the user meant.
+var credentialKeys = map[string]bool{
+	"username":          true,
+	"password":          true,
+	"bearer_token":      true,
+	"bearer_token_file": true,
+}
+
+// knownOptions lists every option the store understands.
+var knownOptions = []string{
+	"base_path",
+	"bearer_token",
+	"bearer_token_file",
+	"burst",
+	"cache_dir",
+	"cache_max_bytes",
+	"compression",
+	"connect_timeout",
+	"control_timeout",
+	"delete_blobs",
+	"delete_concurrency",
+	"download_bandwidth",
+	"download_concurrency",
+	"download_part_size",
+	"extra_headers",
+	"force",
+	"host_rewrites",
+	"idle_conn_timeout",
+	"layer_cache_size",
+	"lock_ttl",
+	"locks_repo",
+	"max_conns_per_host",
+	"max_idle_conns_per_host",
+	"max_inflight",
+	"max_inflight_reads",
+	"max_inflight_writes",
+	"mirrors",
+	"mount_from",
+	"packfiles_repo",
+	"password",
+	"plain_http",
+	"prefetch_states",
+	"proxy_url",
+	"read_only",
+	"redirect_hosts",
+	"replica_concurrency",
+	"replica_location",
+	"replica_queue_size",
+	"requests_per_second",
+	"require_content_length",
+	"response_header_timeout",
+	"retry_after_max",
+	"retry_max",
+	"retry_max_elapsed",
+	"size_scan_limit",
+	"state_repo",
+	"tls_handshake_timeout",
+	"tls_pin_sha256",
+	"tls_verify",
+	"upload_bandwidth",
+	"upload_chunk_size",
+	"upload_chunked",
+	"username",
+}
+
+// optionAliases maps the other names options are known by to the option
+// itself.  Aliases are not listed as valid options.
+var optionAliases = map[string]string{
+	"chunk_size": "upload_chunk_size",
+}
+
+// setOption sets key, or the option it is an alias of, in src.  An
+// option set under both of its names in one source must agree.
+func setOption(src map[string]string, key, value, where string) error {
+	if option, ok := optionAliases[key]; ok {
+		key = option
+	}
+	if other, ok := src[key]; ok && other != value {
+		return fmt.Errorf("option %s set twice in %s, with different values", key, where)
+	}
+	src[key] = value
+	return nil
+}
+
+func knownOption(key string) bool {
+	if _, ok := optionAliases[key]; ok {
+		return true
+	}
+
+	_, ok := slices.BinarySearch(knownOptions, key)
+	return ok
+}
+
+// exclusiveOptions are pairs of options that may not both be set.
+var exclusiveOptions = [][2]string{
+	{"bearer_token", "bearer_token_file"},
+}
+
+// unknownOptionError reports an option the store does not understand,
+// suggesting the closest known one to catch typos.
+func unknownOptionError(key, where string) error {
+	best, bestDist := "", len(key)/2+2
+	for _, known := range knownOptions {
+		if d := editDistance(key, known); d < bestDist {
+			best, bestDist = known, d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("unknown option %q in %s, did you mean %q?", key, where, best)
+	}
+	return fmt.Errorf("unknown option %q in %s, valid options are: %s", key, where, strings.Join(knownOptions, ", "))
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// defaultOptions holds the profile defaults, the lowest precedence source.
+var defaultOptions = map[string]string{}
+
+// resolveOptions merges every configuration source into a single map
+// following a strict precedence: explicit config key > environment
+// override > location query parameter > location userinfo > default.
+// When two sources set the same key to different values, a warning naming
+// both sources and the winning value is logged, except for credentials
+// where the conflict is reported as an error.
+func resolveOptions(config map[string]string, u *url.URL, environ []string) (map[string]string, error) {
+	sources := make([]map[string]string, sourceConfig+1)
+	sources[sourceDefault] = defaultOptions
+
+	sources[sourceUserinfo] = map[string]string{}
+	if u.User != nil {
+		if name := u.User.Username(); name != "" {
+			sources[sourceUserinfo]["username"] = name
+		}
+		if passwd, ok := u.User.Password(); ok {
+			sources[sourceUserinfo]["password"] = passwd
+		}
+	}
+
+	sources[sourceQuery] = map[string]string{}
+	for k, vv := range u.Query() {
+		if !knownOption(k) {
+			return nil, unknownOptionError(k, "location query")
+		}
+		if len(vv) > 0 {
+			if err := setOption(sources[sourceQuery], k, vv[len(vv)-1], "location query"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sources[sourceEnv] = map[string]string{}
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, envPrefix))
+		if !knownOption(key) {
+			slog.Warn("oci: ignoring unknown option in environment", "variable", name)
+			continue
+		}
+		if err := setOption(sources[sourceEnv], key, value, "environment"); err != nil {
+			return nil, err
+		}
+	}
+
+	sources[sourceConfig] = map[string]string{}
+	for k, v := range config {
+		if k == "location" {
+			continue
+		}
+		if !knownOption(k) {
+			return nil, unknownOptionError(k, "config")
+		}
+		if err := setOption(sources[sourceConfig], k, v, "config"); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := map[string]struct{}{}
+	for _, src := range sources {
+		for k := range src {
+			keys[k] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, pair := range exclusiveOptions {
+		if _, ok := keys[pair[0]]; ok {
+			if _, ok := keys[pair[1]]; ok {
+				return nil, fmt.Errorf("options %s and %s are mutually exclusive", pair[0], pair[1])
+			}
+		}
+	}
+
+	out := make(map[string]string, len(sorted))
+	for _, key := range sorted {
+		winner := sourceDefault - 1
+		for src := sourceConfig; src >= sourceDefault; src-- {
+			if _, ok := sources[src][key]; ok {
+				winner = src
+				break
+			}
+		}
+		value := sources[winner][key]
+		out[key] = value
+
+		for src := winner - 1; src >= sourceDefault; src-- {
+			other, ok := sources[src][key]
+			if !ok || other == value {
+				continue
+			}
+			if credentialKeys[key] {
+				return nil, fmt.Errorf("conflicting values for %q in %s and %s", key, winner, src)
+			}
+			// the values are left out, they may carry credentials
+			slog.Warn("oci: conflicting option values",
+				"option", key,
+				"winner", winner.String(),
+				"overridden", src.String())
+			break
+		}
+	}
+	return out, nil
+}
+
+// parseOptions resolves the options of a store from its config map and
+// the process environment.
+func parseOptions(config map[string]string, u *url.URL) (map[string]string, error) {
+	return resolveOptions(config, u, os.Environ())
+}
+
+// sizeUnits are the suffixes accepted by ParseSize, longest first so that
+// "KiB" is not mistaken for "B".
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseSize parses a byte count with an optional unit suffix, e.g. 512,
+// 64MiB or 1GB.
+func ParseSize(v string) (int64, error) {
+	v = strings.TrimSpace(v)
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if len(v) > len(unit.suffix) && strings.EqualFold(v[len(v)-len(unit.suffix):], unit.suffix) {
+			factor = unit.factor
+			v = strings.TrimSpace(v[:len(v)-len(unit.suffix)])
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	if n > 0 && factor > (1<<63-1)/n {
+		return 0, fmt.Errorf("size %q overflows", v)
+	}
+	return n * factor, nil
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// TestConcurrentGetsConnections reads packfiles in parallel, which must
+// spread over as many connections as max_conns_per_host allows.
+func TestConcurrentGetsConnections(t *testing.T) {
+	const readers = 8
+
+	tests := []struct {
+		name        string
+		options     []string
+		wantAtLeast int64
+		wantAtMost  int64
+	}{
+		{name: "default", wantAtLeast: readers, wantAtMost: readers},
+		{name: "max_conns_per_host=2", options: []string{"max_conns_per_host", "2"}, wantAtLeast: 2, wantAtMost: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				conns    atomic.Int64
+				inflight atomic.Int64
+				peak     atomic.Int64
+			)
+			f := newFakeRegistry()
+			f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/sha256:") {
+					n := inflight.Add(1)
+					defer inflight.Add(-1)
+					for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+					}
+					time.Sleep(50 * time.Millisecond)
+				}
+				return false
+			}
+			srv := httptest.NewUnstartedServer(f)
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.Start()
+			t.Cleanup(srv.Close)
+			s := openFake(t, strings.TrimPrefix(srv.URL, "http://"), tt.options...)
+
+			ctx := context.Background()
+			var macs []objects.MAC
+			for i := range readers {
+				mac := objects.MAC{byte(i)}
+				if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader(mac[:])); err != nil {
+					t.Fatal(err)
+				}
+				macs = append(macs, mac)
+			}
+			// resolved up front, so that only the blob GETs run in parallel
+			for _, mac := range macs {
+				rc, err := s.Get(ctx, storage.StorageResourcePackfile, mac, &storage.Range{Length: 1})
+				readAll(t, rc, err)
+			}
+			peak.Store(0)
+			before := conns.Load()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, readers)
+			for _, mac := range macs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rc, err := s.Get(ctx, storage.StorageResourcePackfile, mac, nil)
+					if err == nil {
+						_, err = io.Copy(io.Discard, rc)
+						rc.Close()
+					}
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if p := peak.Load(); p < tt.wantAtLeast || p > tt.wantAtMost {
+				t.Fatalf("%d blob GETs in flight at once, want %d to %d", p, tt.wantAtLeast, tt.wantAtMost)
+			}
+			if n := conns.Load(); n > tt.wantAtMost+before || n < tt.wantAtLeast {
+				t.Fatalf("%d connections opened, want %d to %d", n, tt.wantAtLeast, tt.wantAtMost+before)
+			}
+		})
+	}
+}
+
+// paddedWriter records whether the handler wrote a body.
+type paddedWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *paddedWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *paddedWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// TestSequentialConnections runs 100 operations one after the other,
+// failed ones included, which must open no connection past those of the
+// first put, uploading its payload and the empty config in parallel.
+// Responses get a body where the registry sends none, as some do, which
+// must be drained and closed for the connections to be reused.
+func TestSequentialConnections(t *testing.T) {
+	var conns atomic.Int64
+	f := newFakeRegistry()
+	padding := bytes.Repeat([]byte(" "), 8<<10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &paddedWriter{ResponseWriter: w, status: http.StatusOK}
+		f.ServeHTTP(pw, r)
+		if !pw.wrote && r.Method != http.MethodHead && pw.status != http.StatusNoContent && pw.status != http.StatusNotModified {
+			w.Write(padding)
+		}
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	s := openFake(t, strings.TrimPrefix(srv.URL, "http://"))
+
+	ctx := context.Background()
+	var first int64
+	for i := range 100 {
+		if i == 1 {
+			first = conns.Load()
+		}
+		mac := objects.MAC{byte(i / 4)}
+		var err error
+		switch i % 4 {
+		case 0:
+			_, err = s.Put(ctx, storage.StorageResourceState, mac, bytes.NewReader(mac[:]))
+		case 1:
+			var rc io.ReadCloser
+			if rc, err = s.Get(ctx, storage.StorageResourceState, mac, nil); err == nil {
+				_, err = io.Copy(io.Discard, rc)
+				rc.Close()
+			}
+		case 2:
+			if _, err = s.Get(ctx, storage.StorageResourcePackfile, mac, nil); err == nil {
+				t.Fatal("missing packfile read")
+			}
+			err = nil
+		case 3:
+			_, err = s.List(ctx, storage.StorageResourceState)
+		}
+		if err != nil {
+			t.Fatalf("operation %d: %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != first || n > 2 {
+		t.Fatalf("%d connections opened, %d by the first put", n, first)
+	}
+}
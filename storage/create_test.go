@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCreateProbesDelete(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	host := f.start(t)
+	s := openFake(t, host)
+
+	if err := s.Create(ctx, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	tags, manifests, blobs := len(f.tags["repo"]), len(f.manifests), len(f.blobs)
+	f.mu.Unlock()
+	// CONFIG, its manifest, and its payload and config blobs
+	if tags != 1 || manifests != 1 || blobs != 2 {
+		t.Fatalf("%d tags, %d manifests and %d blobs left, want the configuration only", tags, manifests, blobs)
+	}
+
+	for name, open := range map[string]func(s *ociStore) error{
+		"Create": func(*ociStore) error { return nil },
+		"Open": func(s *ociStore) error {
+			_, err := s.Open(ctx)
+			return err
+		},
+		"Ping": func(s *ociStore) error { return s.Ping(ctx) },
+	} {
+		r := s
+		if name != "Create" {
+			r = openFake(t, host)
+		}
+		if err := open(r); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if mode, err := r.Mode(ctx); err != nil || mode&ModeDelete == 0 {
+			t.Errorf("%s: mode %b, %v, want deletion allowed", name, mode, err)
+		}
+	}
+}
+
+func TestCreateExisting(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	s := openFake(t, f.start(t))
+
+	if err := s.Create(ctx, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	f.reset()
+	if err := s.Create(ctx, []byte("config")); !errors.Is(err, ErrAlreadyInitialized) {
+		t.Fatalf("second create: %v, want ErrAlreadyInitialized", err)
+	}
+	for _, r := range f.logged() {
+		if r.method != http.MethodGet && r.method != http.MethodHead {
+			t.Errorf("%s %s written to the existing repository", r.method, r.path)
+		}
+	}
+}
+
+func TestCreateDeleteDisabled(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodDelete || !strings.Contains(r.URL.Path, "/manifests/") {
+			return false
+		}
+		fakeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+		return true
+	}
+	s := openFake(t, f.start(t))
+
+	if err := s.Create(ctx, []byte("config")); !errors.Is(err, ErrDeleteDisabled) {
+		t.Fatalf("create: %v, want ErrDeleteDisabled", err)
+	}
+	f.mu.Lock()
+	tags := len(f.tags["repo"])
+	f.mu.Unlock()
+	if tags != 0 {
+		t.Fatalf("%d tags left behind by the probe", tags)
+	}
+	if mode, err := s.Mode(ctx); err != nil || mode&ModeDelete != 0 {
+		t.Fatalf("mode %b, %v, want deletion refused", mode, err)
+	}
+}
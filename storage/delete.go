@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+	"golang.org/x/sync/errgroup"
+)
+
+// deleteManifest deletes the manifest with the given digest.  Registries
+// with deletion disabled, such as a stock registry:2, answer 405: this is
+// reported as ErrDeleteDisabled, and remembered so later deletes fail
+// without a round trip.
+func (s *ociStore) deleteManifest(ctx context.Context, digest string) error {
+	if s.deleteDisabled.Load() {
+		return fmt.Errorf("%w: %s", ErrDeleteDisabled, s.base)
+	}
+	resp, err := s.doRepo(ctx, "DELETE", "/manifests/"+url.PathEscape(digest), nil, nil)
+	if resp != nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		s.deleteDisabled.Store(true)
+		return fmt.Errorf("%w: %s: %v", ErrDeleteDisabled, s.base, err)
+	}
+	return err
+}
+
+// ModeDelete is set in the Mode of stores whose registry lets manifests
+// be deleted, as found when the repository was created.  storage.Mode has
+// no bit for it; callers that do not know of it ignore it.
+const ModeDelete storage.Mode = 1 << 8
+
+// deleteAnnotation records on the CONFIG manifest whether the registry
+// let manifests be deleted when the repository was created, for Ping,
+// Open and Mode to tell without writing.
+const deleteAnnotation = "org.plakar.delete"
+
+// probeDelete checks that the registry lets manifests be deleted by
+// pushing a throwaway manifest, untagged, and deleting it along with its
+// blob.  When deletion is disabled they cannot be removed and are left
+// behind, unreferenced by any tag.
+func (s *ociStore) probeDelete(ctx context.Context) error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	payload, size, _, err := s.pushBlob(ctx, bytes.NewReader(b[:]))
+	if err != nil {
+		return fmt.Errorf("delete probe: %w", err)
+	}
+	if err := s.pushEmptyConfig(ctx); err != nil {
+		return fmt.Errorf("delete probe: %w", err)
+	}
+	body, err := marshalManifest(descriptor{MediaType: layerMediaType, Digest: payload, Size: size}, nil)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	h := http.Header{}
+	h.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	if _, err := s.doRepo(ctx, "PUT", "/manifests/"+url.PathEscape(digest), bytes.NewReader(body), h); err != nil {
+		s.deleteBlob(ctx, payload)
+		return fmt.Errorf("delete probe: %w", err)
+	}
+
+	if err := s.deleteManifest(ctx, digest); err != nil {
+		if errors.Is(err, ErrDeleteDisabled) {
+			slog.Warn("oci: registry has deletion disabled, pruning and maintenance will fail", "registry", s.base)
+		}
+		return err
+	}
+	s.deleteEnabled.Store(true)
+	s.deleteBlob(ctx, payload)
+	return nil
+}
+
+// learnDelete records what the annotations of the CONFIG manifest tell of
+// the deletion of manifests.
+func (s *ociStore) learnDelete(annotations map[string]string) {
+	switch annotations[deleteAnnotation] {
+	case "enabled":
+		s.deleteEnabled.Store(true)
+	case "disabled":
+		s.deleteDisabled.Store(true)
+	}
+}
+
+// configAnnotations are the annotations of the CONFIG manifest: whether
+// the registry lets manifests be deleted, if known.
+func (s *ociStore) configAnnotations() map[string]string {
+	switch {
+	case s.deleteDisabled.Load():
+		return map[string]string{deleteAnnotation: "disabled"}
+	case s.deleteEnabled.Load():
+		return map[string]string{deleteAnnotation: "enabled"}
+	}
+	return nil
+}
+
+// defaultDeleteConcurrency is the number of deletions DeleteMany runs in
+// parallel.
+const defaultDeleteConcurrency = 8
+
+// DeleteError aggregates the failures of a DeleteMany call, keyed by the
+// MAC of the resource that could not be deleted.
+type DeleteError struct {
+	Errors map[objects.MAC]error
+}
+
+func (e *DeleteError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for mac, err := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%x: %v", mac, err))
+	}
+	sort.Strings(msgs)
+	if len(msgs) > 3 {
+		msgs = append(msgs[:3], fmt.Sprintf("and %d more", len(msgs)-3))
+	}
+	return fmt.Sprintf("oci: failed to delete %d resources: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *DeleteError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// DeleteMany deletes many resources, DeleteConcurrency at a time, which
+// is what makes pruning thousands of packfiles bearable on high-latency
+// registries.  Failures are collected in a DeleteError; errors that
+// would hit every remaining deletion the same way, such as rejected
+// credentials or deletion being disabled, stop the run instead of being
+// repeated thousands of times.  With DeleteBlobs set, the layer blobs of
+// the deleted resources are removed once they all are.
+func (s *ociStore) DeleteMany(ctx context.Context, res storage.StorageResource, macs []objects.MAC) error {
+	if err := s.storeFor(res).writeError(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		mu     sync.Mutex
+		failed = map[objects.MAC]error{}
+		layers []string
+		g      errgroup.Group
+	)
+	g.SetLimit(s.cfg.DeleteConcurrency)
+	for _, mac := range macs {
+		if ctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			l, err := s.delete(ctx, res, mac)
+			if err != nil && fatalDeleteError(err) {
+				cancel(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			layers = append(layers, l...)
+			if err != nil {
+				failed[mac] = err
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// the blobs of the deleted manifests are checked against the others
+	// once for the whole batch
+	if len(layers) > 0 {
+		if err := s.storeFor(res).deleteUnreferenced(ctx, layers); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Errors: failed}
+	}
+	return nil
+}
+
+// fatalDeleteError reports whether err will fail every other deletion
+// as well.
+func fatalDeleteError(err error) bool {
+	return errors.Is(err, ErrUnauthorized) ||
+		errors.Is(err, ErrDenied) ||
+		errors.Is(err, ErrDeleteDisabled)
+}
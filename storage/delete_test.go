@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestDeleteBlobsKeepsSharedBlobs(t *testing.T) {
+	ctx := context.Background()
+	payload := []byte("identical payload")
+	blob := sha256Digest(payload)
+
+	for _, many := range []bool{false, true} {
+		name := "Delete"
+		if many {
+			name = "DeleteMany"
+		}
+		t.Run(name, func(t *testing.T) {
+			f := newFakeRegistry()
+			s := openFake(t, f.start(t), "delete_blobs", "true")
+
+			a, b := objects.MAC{1}, objects.MAC{2}
+			for _, mac := range []objects.MAC{a, b} {
+				if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader(payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			del := func(mac objects.MAC) error {
+				if many {
+					return s.DeleteMany(ctx, storage.StorageResourcePackfile, []objects.MAC{mac})
+				}
+				return s.Delete(ctx, storage.StorageResourcePackfile, mac)
+			}
+
+			if err := del(a); err != nil {
+				t.Fatal(err)
+			}
+			if !f.hasBlob(blob) {
+				t.Fatal("blob still referenced by the other packfile was deleted")
+			}
+			rc, err := s.Get(ctx, storage.StorageResourcePackfile, b, nil)
+			got := readAll(t, rc, err)
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("read %q, want %q", got, payload)
+			}
+
+			if err := del(b); err != nil {
+				t.Fatal(err)
+			}
+			if f.hasBlob(blob) {
+				t.Fatal("blob no longer referenced was left behind")
+			}
+		})
+	}
+}
+
+// TestDeleteIdenticalPayloads deletes one of two states with the same
+// payload: deleting a manifest by digest takes every tag pointing at it
+// along, so the other must not share it.
+func TestDeleteIdenticalPayloads(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	s := openFake(t, f.start(t))
+
+	payload := []byte("identical state")
+	a, b := objects.MAC{1}, objects.MAC{2}
+	for _, mac := range []objects.MAC{a, b} {
+		if _, err := s.Put(ctx, storage.StorageResourceState, mac, bytes.NewReader(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ma, _ := f.tagged("repo", fmt.Sprintf("state-%x", a))
+	mb, _ := f.tagged("repo", fmt.Sprintf("state-%x", b))
+	if bytes.Equal(ma, mb) {
+		t.Fatal("identical payloads share a manifest")
+	}
+
+	if err := s.Delete(ctx, storage.StorageResourceState, a); err != nil {
+		t.Fatal(err)
+	}
+	macs, err := s.List(ctx, storage.StorageResourceState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 1 || macs[0] != b {
+		t.Fatalf("listed %x, want %x only", macs, b)
+	}
+	rc, err := s.Get(ctx, storage.StorageResourceState, b, nil)
+	if got := readAll(t, rc, err); !bytes.Equal(got, payload) {
+		t.Fatalf("read %q, want %q", got, payload)
+	}
+}
+
+// TestDeleteBlobsWalksTagsOnce deletes packfiles one at a time and
+// expects the tags to be walked for the blobs they reference once, not
+// for every packfile.
+func TestDeleteBlobsWalksTagsOnce(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	s := openFake(t, f.start(t), "delete_blobs", "true")
+
+	const n = 20
+	for i := range n {
+		if _, err := s.Put(ctx, storage.StorageResourcePackfile, objects.MAC{byte(i)}, bytes.NewReader([]byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.reset()
+	for i := range n {
+		if err := s.Delete(ctx, storage.StorageResourcePackfile, objects.MAC{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if f.hasBlob(sha256Digest([]byte{byte(i)})) {
+			t.Fatalf("blob of packfile %d left behind", i)
+		}
+	}
+	if lists := f.count(http.MethodGet, "/tags/list"); lists != 1 {
+		t.Errorf("tags listed %d times, want once", lists)
+	}
+	// one per deletion, and those of the walk
+	if gets := f.count(http.MethodGet, "/manifests/"); gets > 2*n {
+		t.Errorf("%d manifests fetched, want %d at most", gets, 2*n)
+	}
+}
+
+// TestDeleteBlobsAfterPut puts a payload again once the references are
+// counted, and expects the blob to survive the deletion of the first
+// packfile holding it.
+func TestDeleteBlobsAfterPut(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	s := openFake(t, f.start(t), "delete_blobs", "true")
+
+	payload := []byte("reused payload")
+	a, b, c := objects.MAC{1}, objects.MAC{2}, objects.MAC{3}
+	for _, mac := range []objects.MAC{a, b} {
+		if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader([]byte(fmt.Sprintf("other %x", mac)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Put(ctx, storage.StorageResourcePackfile, c, bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+	// counts the references
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, storage.StorageResourcePackfile, a, bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, c); err != nil {
+		t.Fatal(err)
+	}
+	if !f.hasBlob(sha256Digest(payload)) {
+		t.Fatal("blob put again after the references were counted was deleted")
+	}
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, a); err != nil {
+		t.Fatal(err)
+	}
+	if f.hasBlob(sha256Digest(payload)) {
+		t.Fatal("blob no longer referenced was left behind")
+	}
+}
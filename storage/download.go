@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+)
+
+// defaultDownloadConcurrency is the number of parts of a large blob
+// fetched at once by default.
+const defaultDownloadConcurrency = 4
+
+// defaultDownloadPartSize is the size of the parts a blob larger than it
+// is fetched in by default.
+const defaultDownloadPartSize = 16 << 20
+
+// getParts fetches the content of a layer larger than a part as
+// DownloadConcurrency ranged GETs at once, reassembled in order, which
+// makes better use of links where a single stream is bound by latency.
+// The first part is streamed as it arrives, the others are fetched into
+// memory, at most DownloadConcurrency parts ahead of the reader.  A
+// registry ignoring the Range header answers the first part with the
+// whole blob, which is then read as a single stream.
+func (s *ociStore) getParts(ctx context.Context, layer descriptor) (io.ReadCloser, error) {
+	partSize := s.cfg.DownloadPartSize
+	first := &storage.Range{Length: uint32(partSize)}
+	h := http.Header{}
+	h.Set("Range", rangeHeader(first))
+	rc, resp, err := s.doRepoBlobRC(ctx, layer.Digest, h)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return rc, nil
+	}
+	if rc, err = checkRange(first, resp, rc); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &partsReader{
+		s:        s,
+		ctx:      ctx,
+		cancel:   cancel,
+		layer:    layer,
+		partSize: partSize,
+		cur:      rc,
+		parts:    make([]chan partResult, (layer.Size+partSize-1)/partSize),
+		next:     1,
+	}
+	for i := 1; i < len(r.parts) && i <= s.cfg.DownloadConcurrency; i++ {
+		r.fetch(i)
+	}
+	return r, nil
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// partsReader reads the parts of a blob in order, starting the fetch of
+// a part as the one DownloadConcurrency parts before it is reached, so
+// that DownloadConcurrency fetches run while a part is read.
+type partsReader struct {
+	s        *ociStore
+	ctx      context.Context
+	cancel   context.CancelFunc
+	layer    descriptor
+	partSize int64
+
+	// cur is the part being read, nil between parts
+	cur io.ReadCloser
+
+	// parts holds the result of each part once its fetch is started
+	parts []chan partResult
+
+	// next is the index of the part to read after cur
+	next int
+	err  error
+}
+
+// fetch starts the fetch of part i, retried as reads are.
+func (r *partsReader) fetch(i int) {
+	ch := make(chan partResult, 1)
+	r.parts[i] = ch
+	offset := int64(i) * r.partSize
+	rg := &storage.Range{Offset: uint64(offset), Length: uint32(min(r.partSize, r.layer.Size-offset))}
+	go func() {
+		var data []byte
+		err := r.s.retryRead(r.ctx, func() error {
+			rc, err := r.s.getBlob(r.ctx, r.layer, rg)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			data = make([]byte, rg.Length)
+			if _, err := io.ReadFull(rc, data); err != nil {
+				return fmt.Errorf("read blob %s at %d: %w", r.layer.Digest, rg.Offset, err)
+			}
+			return nil
+		})
+		ch <- partResult{data: data, err: err}
+	}()
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if r.next >= len(r.parts) {
+			r.err = io.EOF
+			break
+		}
+
+		var res partResult
+		select {
+		case res = <-r.parts[r.next]:
+		case <-r.ctx.Done():
+			res.err = r.ctx.Err()
+		}
+		if res.err != nil {
+			r.err = res.err
+			break
+		}
+		r.cur = io.NopCloser(bytes.NewReader(res.data))
+		if ahead := r.next + r.s.cfg.DownloadConcurrency; ahead < len(r.parts) {
+			r.fetch(ahead)
+		}
+		r.next++
+	}
+	return 0, r.err
+}
+
+// Close cancels the fetches in flight.
+func (r *partsReader) Close() error {
+	r.cancel()
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
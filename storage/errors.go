@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+)
+
+// ErrDigestMismatch is matched by every DigestMismatchError so callers can
+// tell corrupted content apart from missing content with errors.Is.
+var ErrDigestMismatch = errors.New("oci: digest mismatch")
+
+// DigestMismatchError is returned when content fetched from the registry
+// does not hash to the digest the registry announced for it.
+type DigestMismatchError struct {
+	Ref      string
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("oci: digest mismatch for %s: expected %s, got %s", e.Ref, e.Expected, e.Actual)
+}
+
+func (e *DigestMismatchError) Is(target error) bool {
+	return target == ErrDigestMismatch
+}
+
+// ErrAlreadyInitialized is returned by Create when the repository already
+// holds a kloset configuration.
+var ErrAlreadyInitialized = errors.New("oci: repository already initialized")
+
+// ErrReadOnly is returned by every write to a store opened with
+// read_only, before any request is made.  It matches kloset's
+// storage.ErrNotWritable.
+var ErrReadOnly = fmt.Errorf("oci: store is read-only: %w", storage.ErrNotWritable)
+
+// ErrDeleteDisabled is returned when the registry refuses to delete
+// manifests, which is the default of registry:2.
+var ErrDeleteDisabled = errors.New("oci: registry has deletion disabled, see REGISTRY_STORAGE_DELETE_ENABLED")
+
+// ErrConflict is matched by every ConflictError.
+var ErrConflict = errors.New("oci: concurrent modification")
+
+// ConflictError is returned when a conditional write finds that the tag
+// no longer points at the manifest it was conditioned on.  An empty
+// Expected means the tag was expected not to exist.
+type ConflictError struct {
+	Tag      string
+	Expected string
+	Actual   string
+}
+
+func (e *ConflictError) Error() string {
+	if e.Expected == "" {
+		if e.Actual == "" {
+			return fmt.Sprintf("oci: %s was created concurrently", e.Tag)
+		}
+		return fmt.Sprintf("oci: %s already exists as %s", e.Tag, e.Actual)
+	}
+	if e.Actual == "" {
+		return fmt.Sprintf("oci: %s was modified concurrently, expected %s", e.Tag, e.Expected)
+	}
+	return fmt.Sprintf("oci: %s was modified concurrently, expected %s, found %s", e.Tag, e.Expected, e.Actual)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// errPreconditionFailed is returned when a conditional manifest PUT is
+// refused with 412.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// secretParams lists query parameters that may carry credentials or
+// upload-session state and must never appear in error messages.
+var secretParams = []string{
+	"_state",
+	"token",
+	"access_token",
+	"refresh_token",
+	"sig",
+	"signature",
+	"x-amz-signature",
+	"x-amz-credential",
+	"x-amz-security-token",
+	"x-goog-signature",
+	"x-goog-credential",
+}
+
+// redactURL returns rawURL with userinfo and secret-bearing query
+// parameters replaced, so it is safe to include in errors and logs.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<unparseable url>"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			for _, secret := range secretParams {
+				if strings.EqualFold(k, secret) {
+					q.Set(k, "REDACTED")
+				}
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redactError rewrites the URL carried by net/http errors.
+func redactError(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return &url.Error{Op: uerr.Op, URL: redactURL(uerr.URL), Err: uerr.Err}
+	}
+	return err
+}
+
+// Sentinels matched by RegistryError for the well-known error codes of
+// the distribution spec.
+var (
+	ErrManifestUnknown = errors.New("oci: manifest unknown")
+	ErrBlobUnknown     = errors.New("oci: blob unknown")
+	ErrNameUnknown     = errors.New("oci: repository name unknown")
+	ErrDenied          = errors.New("oci: access denied")
+	ErrUnauthorized    = errors.New("oci: authentication required")
+	ErrTooManyRequests = errors.New("oci: too many requests")
+)
+
+var registryErrorCodes = map[string]error{
+	"MANIFEST_UNKNOWN":      ErrManifestUnknown,
+	"BLOB_UNKNOWN":          ErrBlobUnknown,
+	"MANIFEST_BLOB_UNKNOWN": ErrBlobUnknown,
+	"NAME_UNKNOWN":          ErrNameUnknown,
+	"DENIED":                ErrDenied,
+	"UNAUTHORIZED":          ErrUnauthorized,
+	"TOOMANYREQUESTS":       ErrTooManyRequests,
+}
+
+// RegistryErrorDetail is one entry of the error body defined by the
+// distribution spec.
+type RegistryErrorDetail struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// RegistryError is returned for every non-2xx registry response.  It
+// matches the sentinel of each error code it carries, and fs.ErrNotExist
+// when the resource does not exist, which is how kloset backends report
+// missing resources.
+type RegistryError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Errors     []RegistryErrorDetail
+
+	// body is the raw response body, kept for messages when it is not a
+	// spec error document
+	body string
+}
+
+// newRegistryError builds a RegistryError from a failed response and
+// its, possibly truncated, body.
+func newRegistryError(method, rawURL string, resp *http.Response, body []byte) *RegistryError {
+	e := &RegistryError{
+		Method:     method,
+		URL:        redactURL(rawURL),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+	var doc struct {
+		Errors []RegistryErrorDetail `json:"errors"`
+	}
+	if json.Unmarshal(body, &doc) == nil && len(doc.Errors) > 0 {
+		e.Errors = doc.Errors
+	} else {
+		e.body = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+func (e *RegistryError) Error() string {
+	msg := fmt.Sprintf("oci %s %s: %s", e.Method, e.URL, e.Status)
+	for _, d := range e.Errors {
+		msg += ": " + d.Code
+		if d.Message != "" {
+			msg += " (" + d.Message + ")"
+		}
+	}
+	if e.body != "" {
+		msg += ": " + e.body
+	}
+	return msg
+}
+
+// Code returns the first error code of the response, if any.
+func (e *RegistryError) Code() string {
+	if len(e.Errors) == 0 {
+		return ""
+	}
+	return e.Errors[0].Code
+}
+
+func (e *RegistryError) Is(target error) bool {
+	if target == fs.ErrNotExist {
+		return e.notFound()
+	}
+	for _, d := range e.Errors {
+		if registryErrorCodes[d.Code] == target {
+			return true
+		}
+	}
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrDenied
+	case http.StatusTooManyRequests:
+		return target == ErrTooManyRequests
+	}
+	return false
+}
+
+func (e *RegistryError) notFound() bool {
+	for _, d := range e.Errors {
+		switch d.Code {
+		case "MANIFEST_UNKNOWN", "BLOB_UNKNOWN", "NAME_UNKNOWN":
+			return true
+		}
+	}
+	return e.StatusCode == http.StatusNotFound
+}
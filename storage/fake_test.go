@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry is an in-memory registry speaking enough of the
+// distribution API for the store: manifests by tag and digest, blobs with
+// ranges, chunked and monolithic uploads and paginated tag lists.  Every
+// request is logged, and hook may answer a request before the registry
+// does.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	tags      map[string]map[string]string
+	uploads   map[string]*bytes.Buffer
+	nextID    int
+	requests  []fakeRequest
+
+	// prefix is the path the registry is served under
+	prefix string
+
+	// pageSize caps the tags of a tags/list page, zero means no cap
+	pageSize int
+
+	// noDigestHeader strips Docker-Content-Digest from manifest responses
+	noDigestHeader bool
+
+	// hook answers the requests it returns true for
+	hook func(w http.ResponseWriter, r *http.Request) bool
+}
+
+type fakeRequest struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+
+	// contentLength is -1 for bodies sent chunked
+	contentLength int64
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		tags:      map[string]map[string]string{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+}
+
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// start serves the registry and returns its host.
+func (f *fakeRegistry) start(t testing.TB) string {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// count returns the number of requests of method whose path contains
+// part.
+func (f *fakeRegistry) count(method, part string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r.method == method && strings.Contains(r.path, part) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRegistry) logged() []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests)
+}
+
+func (f *fakeRegistry) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = nil
+}
+
+// tagged returns the manifest repo:tag points at.
+func (f *fakeRegistry) tagged(repo, tag string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.tags[repo][tag]
+	if !ok {
+		return nil, false
+	}
+	return f.manifests[d], true
+}
+
+func (f *fakeRegistry) hasBlob(digest string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.blobs[digest]
+	return ok
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":"fake"}]}`, code)
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, fakeRequest{
+		method:        r.Method,
+		path:          r.URL.Path,
+		query:         r.URL.Query(),
+		header:        r.Header.Clone(),
+		contentLength: r.ContentLength,
+	})
+	hook := f.hook
+	f.mu.Unlock()
+	if hook != nil && hook(w, r) {
+		return
+	}
+
+	p, ok := strings.CutPrefix(r.URL.Path, f.prefix+"/v2/")
+	if !ok {
+		if r.URL.Path == f.prefix+"/v2" {
+			return
+		}
+		fakeError(w, http.StatusNotFound, "NOT_FOUND")
+		return
+	}
+	if p == "" {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasSuffix(p, "/tags/list"):
+		f.serveTags(w, r, strings.TrimSuffix(p, "/tags/list"))
+	case strings.Contains(p, "/manifests/"):
+		repo, ref, _ := strings.Cut(p, "/manifests/")
+		f.serveManifest(w, r, repo, ref)
+	case strings.Contains(p, "/blobs/uploads/"):
+		repo, id, _ := strings.Cut(p, "/blobs/uploads/")
+		f.serveUpload(w, r, repo, id)
+	case strings.Contains(p, "/blobs/"):
+		_, digest, _ := strings.Cut(p, "/blobs/")
+		f.serveBlob(w, r, digest)
+	default:
+		fakeError(w, http.StatusNotFound, "NOT_FOUND")
+	}
+}
+
+func (f *fakeRegistry) serveTags(w http.ResponseWriter, r *http.Request, repo string) {
+	var tags []string
+	for tag := range f.tags[repo] {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	if last := r.URL.Query().Get("last"); last != "" {
+		i, _ := slices.BinarySearch(tags, last)
+		for i < len(tags) && tags[i] <= last {
+			i++
+		}
+		tags = tags[i:]
+	}
+	n := len(tags)
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v < n {
+		n = v
+	}
+	if f.pageSize > 0 && f.pageSize < n {
+		n = f.pageSize
+	}
+	if n < len(tags) {
+		next := url.Values{"n": {strconv.Itoa(n)}, "last": {tags[n-1]}}
+		w.Header().Set("Link", fmt.Sprintf(`<%s/v2/%s/tags/list?%s>; rel="next"`, f.prefix, repo, next.Encode()))
+	}
+	json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": tags[:n]})
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	digest := ref
+	if !strings.HasPrefix(ref, "sha256:") {
+		digest = f.tags[repo][ref]
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		raw, ok := f.manifests[digest]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(raw, &m)
+		w.Header().Set("Content-Type", m.MediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+		if !f.noDigestHeader {
+			w.Header().Set("Docker-Content-Digest", digest)
+		}
+		if r.Method == http.MethodGet {
+			w.Write(raw)
+		}
+
+	case http.MethodPut:
+		raw, _ := io.ReadAll(r.Body)
+		var m ociManifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			fakeError(w, http.StatusBadRequest, "MANIFEST_INVALID")
+			return
+		}
+		for _, d := range append([]descriptor{m.Config}, m.Layers...) {
+			if _, ok := f.blobs[d.Digest]; !ok {
+				fakeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN")
+				return
+			}
+		}
+		cur, exists := f.tags[repo][ref]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || `"`+cur+`"` != match) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		digest = sha256Digest(raw)
+		f.manifests[digest] = raw
+		if !strings.HasPrefix(ref, "sha256:") {
+			if f.tags[repo] == nil {
+				f.tags[repo] = map[string]string{}
+			}
+			f.tags[repo][ref] = digest
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		if !strings.HasPrefix(ref, "sha256:") {
+			fakeError(w, http.StatusBadRequest, "UNSUPPORTED")
+			return
+		}
+		if _, ok := f.manifests[ref]; !ok {
+			fakeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		// as the spec has it, every tag of the manifest goes with it
+		delete(f.manifests, ref)
+		for tag, d := range f.tags[repo] {
+			if d == ref {
+				delete(f.tags[repo], tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeRegistry) serveBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	b, ok := f.blobs[digest]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Docker-Content-Digest", digest)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	case http.MethodDelete:
+		delete(f.blobs, digest)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	if r.Method == http.MethodPost && id == "" {
+		f.nextID++
+		id = strconv.Itoa(f.nextID)
+		f.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", fmt.Sprintf("%s/v2/%s/blobs/uploads/%s", f.prefix, repo, id))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	buf, ok := f.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN")
+		return
+	}
+	location := fmt.Sprintf("%s/v2/%s/blobs/uploads/%s", f.prefix, repo, id)
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Location", location)
+		if buf.Len() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		if cr := r.Header.Get("Content-Range"); cr != "" {
+			start, _, _ := strings.Cut(cr, "-")
+			if n, err := strconv.Atoi(start); err != nil || n != buf.Len() {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
+		io.Copy(buf, r.Body)
+		w.Header().Set("Location", location)
+		if buf.Len() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		io.Copy(buf, r.Body)
+		digest := r.URL.Query().Get("digest")
+		if sha256Digest(buf.Bytes()) != digest {
+			fakeError(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+		f.blobs[digest] = bytes.Clone(buf.Bytes())
+		delete(f.uploads, id)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// openFake opens a store on the repository repo of the registry served
+// at host, with the given options on top.
+func openFake(t testing.TB, host string, options ...string) *ociStore {
+	t.Helper()
+	config := map[string]string{"location": "oci://" + host + "/repo", "plain_http": "true"}
+	for i := 0; i+1 < len(options); i += 2 {
+		config[options[i]] = options[i+1]
+	}
+	s, err := newStore(context.Background(), config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// readAll reads and closes rc.
+func readAll(t *testing.T, rc io.ReadCloser, err error) []byte {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
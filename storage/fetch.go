@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultFetcher downloads URLs for sources without a registry, such as
+// image layouts on disk, with the default timeouts of the store and the
+// proxy of the environment.
+var defaultFetcher = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   defaultConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		ForceAttemptHTTP2:     true,
+	},
+}
+
+// FetchURL downloads rawURL, an http or https URL, for sources without a
+// registry such as image layouts on disk.
+func FetchURL(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	return fetchURL(ctx, defaultFetcher, rawURL)
+}
+
+// FetchURL downloads rawURL, an http or https URL out of the registry
+// such as those foreign layers list, through the transport of the store:
+// its proxy, TLS settings and timeouts apply, but neither its credentials
+// nor its extra headers are sent.
+func (r *Registry) FetchURL(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	return fetchURL(ctx, r.s.fetcher, rawURL)
+}
+
+// fetchURL refuses any scheme but http and https, which would let a
+// manifest make us read local files or reach other services; redirects
+// are held to them by net/http.
+func fetchURL(ctx context.Context, client *http.Client, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", redactURL(rawURL), err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s: only http and https URLs are fetched", redactURL(rawURL))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		drainAndClose(resp.Body)
+		return nil, fmt.Errorf("GET %s: %s", redactURL(rawURL), resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// plakarTagPrefixes are the prefixes of every tag this store creates
+// besides CONFIG.  GC never looks at other tags.
+var plakarTagPrefixes = []string{"packfiles-", "state-", "locks-", "probe-delete-"}
+
+// GCReport lists what GC removed, or would remove in dry-run mode.
+type GCReport struct {
+	Tags  []string
+	Blobs []string
+}
+
+// GC removes the debris interrupted operations leave in the repository:
+// tags carrying a plakar prefix but no valid MAC, which List skips, and
+// leftover delete probes, along with the layer blobs only they
+// reference.  Tags without a plakar prefix are never touched.  The
+// distribution API has no way to enumerate blobs, so blobs that were
+// uploaded but never referenced by any manifest cannot be found.
+//
+// With dryRun set nothing is deleted and the report lists what would be.
+// Every repository resources are routed to is collected.
+func (s *ociStore) GC(ctx context.Context, dryRun bool) (*GCReport, error) {
+	if s.cfg.ReadOnly && !dryRun {
+		return nil, ErrReadOnly
+	}
+
+	report := &GCReport{}
+	for _, r := range s.stores() {
+		rep, err := r.gc(ctx, dryRun)
+		if rep != nil {
+			report.Tags = append(report.Tags, rep.Tags...)
+			report.Blobs = append(report.Blobs, rep.Blobs...)
+		}
+		if err != nil {
+			return report, fmt.Errorf("gc %s: %w", r.repo, err)
+		}
+	}
+	return report, nil
+}
+
+func (s *ociStore) gc(ctx context.Context, dryRun bool) (*GCReport, error) {
+	tags, err := s.listTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var stray, valid []string
+	for _, tag := range tags {
+		switch {
+		case strayTag(tag):
+			stray = append(stray, tag)
+		case tag == "CONFIG" || hasPlakarPrefix(tag):
+			valid = append(valid, tag)
+		}
+	}
+
+	report := &GCReport{}
+	if len(stray) == 0 {
+		return report, nil
+	}
+
+	// layers of the stray tags are candidates, unless a valid tag
+	// references them too
+	candidates := map[string]struct{}{}
+	manifests := map[string]string{}
+	for _, tag := range stray {
+		man, digest, err := s.manifestOf(ctx, tag)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifests[tag] = digest
+		for _, layer := range man.Layers {
+			candidates[layer.Digest] = struct{}{}
+		}
+	}
+	// deleting by digest removes every tag pointing at the manifest, so
+	// stray tags sharing one with a valid tag are left alone
+	referenced, shared, err := s.referencedLayers(ctx, valid)
+	if err != nil {
+		return nil, err
+	}
+	for digest := range referenced {
+		delete(candidates, digest)
+	}
+
+	for _, tag := range stray {
+		digest, ok := manifests[tag]
+		if !ok {
+			continue
+		}
+		if _, ok := shared[digest]; ok {
+			continue
+		}
+		if !dryRun {
+			if err := s.deleteManifest(ctx, digest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return report, fmt.Errorf("gc: delete tag %s: %w", tag, err)
+			}
+		}
+		report.Tags = append(report.Tags, tag)
+	}
+	for digest := range candidates {
+		if !dryRun {
+			resp, err := s.doRepo(ctx, "DELETE", "/blobs/"+url.PathEscape(digest), nil, nil)
+			switch {
+			case err == nil:
+			case resp != nil && resp.StatusCode == http.StatusMethodNotAllowed:
+				slog.Warn("oci: gc: blob deletion disabled on registry, leaving blobs behind", "registry", s.base)
+				return report, nil
+			case errors.Is(err, fs.ErrNotExist):
+				continue
+			default:
+				return report, fmt.Errorf("gc: delete blob %s: %w", digest, err)
+			}
+		}
+		report.Blobs = append(report.Blobs, digest)
+	}
+	return report, nil
+}
+
+// referencedLayers returns the layer blobs the manifests of tags
+// reference, and the digests of those manifests.  Tags deleted since
+// they were listed are skipped.
+func (s *ociStore) referencedLayers(ctx context.Context, tags []string) (layers, manifests map[string]struct{}, err error) {
+	layers, manifests = map[string]struct{}{}, map[string]struct{}{}
+	for _, tag := range tags {
+		man, digest, err := s.manifestOf(ctx, tag)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		manifests[digest] = struct{}{}
+		for _, layer := range man.Layers {
+			layers[layer.Digest] = struct{}{}
+		}
+	}
+	return layers, manifests, nil
+}
+
+// blobRefs counts the plakar tags whose manifest references each layer
+// blob, for the deletes of the store to tell the blobs nothing uses any
+// longer.  It is built by walking the tags once, the first time a blob
+// may be deleted, and kept current with the puts and deletes of the
+// store from then on, so that pruning does not walk every tag for every
+// packfile deleted.
+type blobRefs struct {
+	mu     sync.Mutex
+	built  bool
+	tags   map[string][]string
+	counts map[string]int
+}
+
+// set records layers as those of the manifest tag points at now.
+func (r *blobRefs) set(tag string, layers []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.built {
+		return
+	}
+	r.unref(tag)
+	r.tags[tag] = layers
+	for _, layer := range layers {
+		r.counts[layer]++
+	}
+}
+
+// drop forgets the manifest of tag, deleted.
+func (r *blobRefs) drop(tag string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.built {
+		r.unref(tag)
+	}
+}
+
+func (r *blobRefs) unref(tag string) {
+	for _, layer := range r.tags[tag] {
+		if r.counts[layer]--; r.counts[layer] <= 0 {
+			delete(r.counts, layer)
+		}
+	}
+	delete(r.tags, tag)
+}
+
+// reset discards the counts, to be built again.
+func (r *blobRefs) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tags, r.counts, r.built = nil, nil, false
+}
+
+func (r *blobRefs) referenced(digest string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[digest] > 0
+}
+
+// buildBlobRefs walks the plakar tags for the layers their manifests reference,
+// unless done already.  A tag deleted during the walk may still be
+// counted, which leaves its blobs behind rather than lose them.
+func (s *ociStore) buildBlobRefs(ctx context.Context) error {
+	s.refs.mu.Lock()
+	built := s.refs.built
+	s.refs.mu.Unlock()
+	if built {
+		return nil
+	}
+
+	tags, err := s.listTags(ctx)
+	if err != nil {
+		return err
+	}
+	refs := map[string][]string{}
+	counts := map[string]int{}
+	for _, tag := range tags {
+		if tag != "CONFIG" && !hasPlakarPrefix(tag) {
+			continue
+		}
+		man, _, err := s.manifestOf(ctx, tag)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, layer := range man.Layers {
+			refs[tag] = append(refs[tag], layer.Digest)
+			counts[layer.Digest]++
+		}
+	}
+
+	s.refs.mu.Lock()
+	defer s.refs.mu.Unlock()
+	s.refs.tags, s.refs.counts, s.refs.built = refs, counts, true
+	return nil
+}
+
+// deleteUnreferenced deletes the given layer blobs, but those a manifest
+// of the repository still references: resources with identical payloads
+// share a blob, uploaded once.  The puts of the store wait for it, and it
+// for them, so that a put reusing a blob in the meantime keeps it.  The
+// puts of other clients are not known: blobs are only safely deleted
+// while no other client writes to the repository, as plakar ensures by
+// locking it for maintenance.
+func (s *ociStore) deleteUnreferenced(ctx context.Context, layers []string) error {
+	s.sweepMu.Lock()
+	defer s.sweepMu.Unlock()
+	if err := s.buildBlobRefs(ctx); err != nil {
+		return err
+	}
+
+	for _, digest := range layers {
+		if s.refs.referenced(digest) {
+			continue
+		}
+		resp, err := s.doRepo(ctx, "DELETE", "/blobs/"+url.PathEscape(digest), nil, nil)
+		switch {
+		case err == nil:
+		case resp != nil && resp.StatusCode == http.StatusMethodNotAllowed:
+			slog.Debug("oci: blob deletion disabled on registry", "digest", digest)
+			return nil
+		case errors.Is(err, fs.ErrNotExist):
+		default:
+			return fmt.Errorf("delete blob %s: %w", digest, err)
+		}
+	}
+	return nil
+}
+
+// manifestOf fetches and decodes the manifest ref points to.
+func (s *ociStore) manifestOf(ctx context.Context, ref string) (*ociManifest, string, error) {
+	raw, digest, err := s.fetchManifest(ctx, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	var man ociManifest
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return nil, "", fmt.Errorf("decode manifest %s: %w", ref, err)
+	}
+	return &man, digest, nil
+}
+
+func hasPlakarPrefix(tag string) bool {
+	for _, prefix := range plakarTagPrefixes {
+		if strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// strayTag reports whether tag was created by this store but is not one
+// List would return: a delete probe, or a resource tag whose suffix is
+// not a hex MAC.
+func strayTag(tag string) bool {
+	if strings.HasPrefix(tag, "probe-delete-") {
+		return true
+	}
+	for _, prefix := range plakarTagPrefixes {
+		if suffix, ok := strings.CutPrefix(tag, prefix); ok {
+			b, err := hex.DecodeString(suffix)
+			return err != nil || len(b) != 32
+		}
+	}
+	return false
+}
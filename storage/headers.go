@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Version is the version of the integration reported in the User-Agent,
+// set at build time with
+// -ldflags "-X github.com/PlakarKorp/integration-oci/storage.Version=v1.2.3".
+var Version = "devel"
+
+const sdkModule = "github.com/PlakarKorp/go-kloset-sdk"
+
+// userAgent returns the User-Agent sent on every request, so registry
+// operators can tell plakar traffic apart.
+var userAgent = sync.OnceValue(func() string {
+	sdk := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == sdkModule {
+				sdk = dep.Version
+				if dep.Replace != nil && dep.Replace.Version != "" {
+					sdk = dep.Replace.Version
+				}
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("plakar-integration-oci/%s (go-kloset-sdk/%s)", Version, sdk)
+})
+
+// reservedHeaders are set by the store itself and may not be overridden
+// through extra_headers.
+var reservedHeaders = []string{
+	"Authorization",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Host",
+	"If-Match",
+	"If-None-Match",
+	"Range",
+}
+
+// parseExtraHeaders parses the extra_headers option, semicolon-separated
+// "Key: Value" pairs.
+func parseExtraHeaders(v string) (http.Header, error) {
+	h := http.Header{}
+	for _, pair := range strings.Split(v, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid extra_headers entry %q, expected \"Key: Value\"", pair)
+		}
+		for _, reserved := range reservedHeaders {
+			if strings.EqualFold(key, reserved) {
+				return nil, fmt.Errorf("extra_headers may not set %s", reserved)
+			}
+		}
+		h.Add(key, strings.TrimSpace(value))
+	}
+	return h, nil
+}
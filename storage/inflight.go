@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// inflight bounds the requests in flight to a registry, with separate
+// budgets for reads and writes so that a backup saturating uploads does
+// not starve the reads it depends on.  A nil inflight is unbounded.
+type inflight struct {
+	reads, writes   *semaphore.Weighted
+	nreads, nwrites atomic.Int64
+}
+
+// newInflight returns the budgets configured in cfg, nil when neither is
+// bounded.
+func newInflight(cfg ociConfig) *inflight {
+	if cfg.MaxInflightReads <= 0 && cfg.MaxInflightWrites <= 0 {
+		return nil
+	}
+	f := &inflight{}
+	if cfg.MaxInflightReads > 0 {
+		f.reads = semaphore.NewWeighted(int64(cfg.MaxInflightReads))
+	}
+	if cfg.MaxInflightWrites > 0 {
+		f.writes = semaphore.NewWeighted(int64(cfg.MaxInflightWrites))
+	}
+	return f
+}
+
+// acquire takes a slot of the budget of method, waiting for one to free
+// up, and returns the function releasing it.
+func (f *inflight) acquire(ctx context.Context, method string) (func(), error) {
+	if f == nil {
+		return func() {}, nil
+	}
+	sem, n := f.writes, &f.nwrites
+	if method == "GET" || method == "HEAD" {
+		sem, n = f.reads, &f.nreads
+	}
+	if sem != nil {
+		if !sem.TryAcquire(1) {
+			slog.Debug("oci: waiting for an in-flight slot", "method", method, "reads", f.nreads.Load(), "writes", f.nwrites.Load())
+			if err := sem.Acquire(ctx, 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	n.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			n.Add(-1)
+			if sem != nil {
+				sem.Release(1)
+			}
+		})
+	}, nil
+}
+
+// InFlight returns the number of read and write requests currently in
+// flight to the registry, bodies still being streamed included.  Both are
+// zero when max_inflight is not set.
+func (s *ociStore) InFlight() (reads, writes int64) {
+	if s.inflight == nil {
+		return 0, 0
+	}
+	return s.inflight.nreads.Load(), s.inflight.nwrites.Load()
+}
+
+// releaseCloser releases the in-flight slot of a request when its body
+// is closed.
+type releaseCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
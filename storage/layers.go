@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// defaultLayerCacheSize is the number of tags whose payload layer is
+// remembered by default.
+const defaultLayerCacheSize = 4096
+
+// layerEntry is the payload layer a tag resolved to, along with the
+// digest of the manifest that named it.
+type layerEntry struct {
+	layer    descriptor
+	manifest string
+}
+
+// layerCache remembers the payload layer of the most recently used tags,
+// so that the ranged reads plakar makes of a packfile go straight to the
+// blob rather than fetching its manifest every time.  A nil cache
+// remembers nothing.
+type layerCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type layerCacheItem struct {
+	tag   string
+	entry layerEntry
+}
+
+// newLayerCache returns a cache of size entries, or nil when size is
+// zero.
+func newLayerCache(size int) *layerCache {
+	if size <= 0 {
+		return nil
+	}
+	return &layerCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// cacheableTag reports whether the layer of tag may be remembered: the
+// payload of packfiles and states is named by its MAC and never changes,
+// while locks and the configuration are rewritten by other processes.
+func cacheableTag(tag string) bool {
+	return strings.HasPrefix(tag, "packfiles-") || strings.HasPrefix(tag, "state-")
+}
+
+func (c *layerCache) get(tag string) (layerEntry, bool) {
+	if c == nil {
+		return layerEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[tag]
+	if !ok {
+		return layerEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*layerCacheItem).entry, true
+}
+
+func (c *layerCache) set(tag string, entry layerEntry) {
+	if c == nil || !cacheableTag(tag) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[tag]; ok {
+		elem.Value.(*layerCacheItem).entry = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[tag] = c.order.PushFront(&layerCacheItem{tag: tag, entry: entry})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*layerCacheItem).tag)
+	}
+}
+
+func (c *layerCache) remove(tag string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[tag]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, tag)
+	}
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// schemes are the location schemes accepted by the store.  oci+http and
+// oci+https select the transport explicitly; bare oci uses HTTPS unless
+// plain_http is set; oci+unix talks plain HTTP over a Unix domain socket.
+var schemes = []string{"oci", "oci+http", "oci+https", "oci+unix"}
+
+// unixHost is the host requests to a registry behind a Unix domain socket
+// are addressed to; it only ends up in the Host header.
+const unixHost = "localhost"
+
+// parseLocation splits a location into its scheme and a URL holding the
+// registry host, exactly as written, and the repository path.  Hosts may
+// be names, possibly fully qualified with a trailing dot, or IP literals,
+// IPv6 ones in brackets, each optionally followed by a port.
+//
+// Unix domain sockets are written oci+unix:///path/to/socket:/repo; the
+// socket path is returned and the URL is addressed to unixHost.
+func parseLocation(location string) (string, string, *url.URL, error) {
+	scheme, loc, ok := strings.Cut(location, "://")
+	if !ok {
+		scheme, loc = "oci", location
+	}
+	if !slices.Contains(schemes, scheme) {
+		return "", "", nil, fmt.Errorf("unsupported location scheme %q, expected oci://, oci+http://, oci+https:// or oci+unix://", scheme)
+	}
+
+	if scheme == "oci+unix" {
+		i := strings.LastIndex(loc, ":")
+		if i < 0 {
+			return "", "", nil, fmt.Errorf("location %q: expected oci+unix:///path/to/socket:/repository", location)
+		}
+		socket, rest := loc[:i], loc[i+1:]
+		if !strings.HasPrefix(socket, "/") {
+			return "", "", nil, fmt.Errorf("location %q: socket path must be absolute", location)
+		}
+		u, err := url.Parse("http://" + unixHost + "/" + strings.TrimLeft(rest, "/"))
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid location %q: %w", location, err)
+		}
+		return scheme, socket, u, nil
+	}
+
+	// credentials in the location must not end up in error messages
+	authority, path, _ := strings.Cut(loc, "/")
+	if _, hostport, ok := strings.Cut(authority, "@"); ok {
+		authority = hostport
+		location = scheme + "://" + authority + "/" + path
+	}
+	if authority == "" {
+		return "", "", nil, fmt.Errorf("location %q has no registry host", location)
+	}
+	if !strings.HasPrefix(authority, "[") && strings.Count(authority, ":") > 1 {
+		return "", "", nil, fmt.Errorf("location %q: IPv6 addresses must be enclosed in brackets, e.g. [::1]:5000", location)
+	}
+
+	u, err := url.Parse("https://" + loc)
+	if err != nil {
+		// url.Error would repeat the location, credentials included
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return "", "", nil, fmt.Errorf("invalid location %q: %w", location, err)
+	}
+	if host := u.Hostname(); host == "" {
+		return "", "", nil, fmt.Errorf("location %q has no registry host", location)
+	} else if strings.HasPrefix(u.Host, "[") && net.ParseIP(host) == nil {
+		return "", "", nil, fmt.Errorf("location %q: invalid IPv6 address %q", location, host)
+	}
+	if port := u.Port(); strings.HasSuffix(u.Host, ":") || (port != "" && port[0] == '0' && len(port) > 1) {
+		return "", "", nil, fmt.Errorf("location %q: invalid port", location)
+	}
+	return scheme, "", u, nil
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// Annotations set on lock manifests so that stale locks can be told
+// apart from live ones without fetching their payload.
+const (
+	lockOwnerAnnotation   = "org.plakar.lock.owner"
+	lockCreatedAnnotation = "org.plakar.lock.created"
+	lockExpiresAnnotation = "org.plakar.lock.expires"
+)
+
+// defaultLockTTL is how long after it was last written a lock is
+// considered stale and may be removed by other processes.
+const defaultLockTTL = 15 * time.Minute
+
+// lockTable remembers the manifest digest of every lock written by this
+// process, so a lock is only ever refreshed or deleted by its owner.
+type lockTable struct {
+	mu      sync.Mutex
+	digests map[string]string
+}
+
+func (t *lockTable) get(tag string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.digests[tag]
+}
+
+func (t *lockTable) set(tag, digest string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.digests == nil {
+		t.digests = map[string]string{}
+	}
+	t.digests[tag] = digest
+}
+
+func (t *lockTable) remove(tag string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.digests, tag)
+}
+
+// lockOwner identifies this process in lock annotations.
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// putLock writes a lock manifest, refusing with a ConflictError to
+// overwrite a lock held by someone else.  The tag is created with
+// If-None-Match, or refreshed with If-Match when this process owns it;
+// since not every registry honors conditional requests, the tag is read
+// back afterwards to make sure our manifest is the one that won.
+func (s *ociStore) putLock(ctx context.Context, tag string, rd io.Reader) (int64, error) {
+	owned := s.locks.get(tag)
+
+	current, err := s.headManifestDigest(ctx, tag)
+	switch {
+	case err == nil && current != owned:
+		return 0, &ConflictError{Tag: tag, Expected: owned, Actual: current}
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return 0, err
+	}
+
+	h := http.Header{}
+	if owned != "" && err == nil {
+		h.Set("If-Match", `"`+owned+`"`)
+	} else {
+		h.Set("If-None-Match", "*")
+	}
+	now := time.Now().UTC()
+	annotations := map[string]string{
+		lockOwnerAnnotation:   lockOwner(),
+		lockCreatedAnnotation: now.Format(time.RFC3339),
+		lockExpiresAnnotation: now.Add(s.cfg.LockTTL).Format(time.RFC3339),
+	}
+
+	size, digest, err := s.putTagged(ctx, tag, rd, annotations, h)
+	if errors.Is(err, errPreconditionFailed) {
+		return 0, &ConflictError{Tag: tag, Expected: owned}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	current, err = s.headManifestDigest(ctx, tag)
+	if err != nil {
+		return 0, fmt.Errorf("verify lock %s: %w", tag, err)
+	}
+	if current != digest {
+		return 0, &ConflictError{Tag: tag, Expected: digest, Actual: current}
+	}
+	s.locks.set(tag, digest)
+	return size, nil
+}
+
+// deleteLock removes a lock manifest.  A lock written by this process is
+// only deleted if the tag still points at the manifest we wrote; other
+// locks, typically stale ones being cleaned up, are deleted by the digest
+// observed just before.
+func (s *ociStore) deleteLock(ctx context.Context, tag string) error {
+	owned := s.locks.get(tag)
+
+	current, err := s.headManifestDigest(ctx, tag)
+	if err != nil {
+		return err
+	}
+	if owned != "" && current != owned {
+		return &ConflictError{Tag: tag, Expected: owned, Actual: current}
+	}
+
+	if err := s.deleteManifest(ctx, current); err != nil {
+		return err
+	}
+	s.locks.remove(tag)
+	return nil
+}
+
+// listLocks lists the locks of the repository, opportunistically
+// removing those written more than LockTTL ago by crashed processes so
+// they do not pile up, unless the store is read-only.  Failing to remove
+// a stale lock is only logged.
+func (s *ociStore) listLocks(ctx context.Context) ([]objects.MAC, error) {
+	macs, err := s.listByPrefix(ctx, "locks-")
+	if err != nil {
+		return nil, err
+	}
+
+	out := macs[:0]
+	for _, mac := range macs {
+		tag := fmt.Sprintf("locks-%x", mac)
+		if s.locks.get(tag) == "" && !s.cfg.ReadOnly {
+			created, digest, err := s.lockCreated(ctx, tag)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				slog.Warn("oci: failed to inspect lock", "tag", tag, "error", err)
+			} else if !created.IsZero() && time.Since(created) > s.cfg.LockTTL {
+				// delete the manifest inspected, not whatever the tag
+				// points at now, in case its owner refreshed it since
+				if err := s.deleteManifest(ctx, digest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					slog.Warn("oci: failed to remove stale lock", "tag", tag, "created", created, "error", err)
+				} else {
+					slog.Debug("oci: removed stale lock", "tag", tag, "created", created)
+					continue
+				}
+			}
+		}
+		out = append(out, mac)
+	}
+	return out, nil
+}
+
+// lockCreated returns the creation time recorded on a lock manifest, or
+// the zero time for locks written without one, along with the manifest
+// digest.
+func (s *ociStore) lockCreated(ctx context.Context, tag string) (time.Time, string, error) {
+	raw, digest, err := s.fetchManifest(ctx, tag)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	var man ociManifest
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return time.Time{}, "", fmt.Errorf("decode manifest: %w", err)
+	}
+	v, ok := man.Annotations[lockCreatedAnnotation]
+	if !ok {
+		return time.Time{}, digest, nil
+	}
+	created, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("lock %s: invalid %s annotation %q", tag, lockCreatedAnnotation, v)
+	}
+	return created, digest, nil
+}
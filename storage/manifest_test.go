@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// TestDeleteWithoutDigestHeader deletes from a registry whose manifest
+// responses lack Docker-Content-Digest: the digest is the hash of the
+// manifest exactly as served, whitespace included.
+func TestDeleteWithoutDigestHeader(t *testing.T) {
+	f := newFakeRegistry()
+	f.noDigestHeader = true
+	s := openFake(t, f.start(t))
+
+	raw := []byte("{\n  \"schemaVersion\": 2,\n  \"mediaType\": \"application/vnd.oci.image.manifest.v1+json\",\n  \"layers\": []\n}\n")
+	digest := sha256Digest(raw)
+	deleted, kept := objects.MAC{1}, objects.MAC{2}
+	f.manifests[digest] = raw
+	f.manifests["sha256:other"] = []byte(`{"schemaVersion":2}`)
+	f.tags["repo"] = map[string]string{
+		fmt.Sprintf("state-%x", deleted): digest,
+		fmt.Sprintf("state-%x", kept):    "sha256:other",
+	}
+
+	if err := s.Delete(context.Background(), storage.StorageResourceState, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	var methods []string
+	for _, r := range f.logged() {
+		methods = append(methods, r.method)
+		if r.method == http.MethodDelete && !strings.HasSuffix(r.path, "/manifests/"+digest) {
+			t.Fatalf("deleted %s, want the manifest %s", r.path, digest)
+		}
+	}
+	if got := strings.Join(methods, " "); got != "HEAD GET DELETE" {
+		t.Fatalf("requests %s, want HEAD GET DELETE", got)
+	}
+	if _, ok := f.tagged("repo", fmt.Sprintf("state-%x", deleted)); ok {
+		t.Fatal("state still tagged")
+	}
+	if _, ok := f.tagged("repo", fmt.Sprintf("state-%x", kept)); !ok {
+		t.Fatal("other state deleted")
+	}
+}
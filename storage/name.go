@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	tagRegexp    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+	digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[A-Za-z0-9=_-]+$`)
+)
+
+// validateRepo checks a repository name against the distribution spec
+// grammar: slash-separated components of lowercase alphanumerics joined
+// by single separators ".", "_", "__" or runs of "-".
+func validateRepo(repo string) error {
+	for _, comp := range strings.Split(repo, "/") {
+		if comp == "" {
+			return fmt.Errorf("invalid repository name %q: empty path component", repo)
+		}
+		if err := validateComponent(comp); err != nil {
+			return fmt.Errorf("invalid repository name %q: %w", repo, err)
+		}
+	}
+	return nil
+}
+
+func validateComponent(comp string) error {
+	isAlnum := func(c byte) bool {
+		return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+	}
+
+	for i := 0; i < len(comp); {
+		c := comp[i]
+		if isAlnum(c) {
+			i++
+			continue
+		}
+		if i == 0 {
+			return fmt.Errorf("component %q must start with a lowercase letter or digit, not %q", comp, c)
+		}
+
+		// a separator: ".", "_", "__" or one or more "-"
+		j := i
+		switch c {
+		case '.':
+			j++
+		case '_':
+			j++
+			if j < len(comp) && comp[j] == '_' {
+				j++
+			}
+		case '-':
+			for j < len(comp) && comp[j] == '-' {
+				j++
+			}
+		default:
+			return fmt.Errorf("character %q is not allowed", c)
+		}
+		if j == len(comp) {
+			return fmt.Errorf("component %q must end with a lowercase letter or digit", comp)
+		}
+		if !isAlnum(comp[j]) {
+			return fmt.Errorf("component %q has consecutive separators at %q", comp, comp[i:j+1])
+		}
+		i = j
+	}
+	return nil
+}
+
+// escapeRepo escapes each path component of a repository name while
+// preserving the slashes separating them.
+func escapeRepo(repo string) string {
+	comps := strings.Split(repo, "/")
+	for i, comp := range comps {
+		comps[i] = url.PathEscape(comp)
+	}
+	return strings.Join(comps, "/")
+}
+
+// ValidTag reports whether tag follows the grammar of tags of the
+// distribution spec.
+func ValidTag(tag string) bool {
+	return tagRegexp.MatchString(tag)
+}
+
+// SplitReference splits the tag or digest off a location such as
+// oci://ghcr.io/org/image:v1.2 or oci://ghcr.io/org/image@sha256:...,
+// returning the location of the repository and the reference, empty when
+// the location names the whole repository.  The importer and exporter
+// take such locations, the store does not.
+func SplitReference(loc string) (string, string, error) {
+	loc, query, hasQuery := strings.Cut(loc, "?")
+	if hasQuery {
+		query = "?" + query
+	}
+
+	// the reference lives in the last path component, past the host
+	_, rest, ok := strings.Cut(loc, "://")
+	if !ok {
+		rest = loc
+	}
+	slash := strings.LastIndex(rest, "/")
+	if slash < 0 {
+		return loc + query, "", nil
+	}
+	name := rest[slash+1:]
+	prefix := loc[:len(loc)-len(name)]
+
+	if repo, digest, ok := strings.Cut(name, "@"); ok {
+		if !digestRegexp.MatchString(digest) {
+			return "", "", fmt.Errorf("invalid digest %q in location", digest)
+		}
+		return prefix + repo + query, digest, nil
+	}
+	if repo, tag, ok := strings.Cut(name, ":"); ok {
+		if !tagRegexp.MatchString(tag) {
+			return "", "", fmt.Errorf("invalid tag %q in location", tag)
+		}
+		return prefix + repo + query, tag, nil
+	}
+	return loc + query, "", nil
+}
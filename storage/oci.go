@@ -9,101 +9,942 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/PlakarKorp/kloset/connectors/storage"
 	"github.com/PlakarKorp/kloset/location"
 	"github.com/PlakarKorp/kloset/objects"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 func init() {
-	storage.Register("oci", 0, New)
+	for _, scheme := range schemes {
+		storage.Register(scheme, 0, New)
+	}
+}
+
+type ociConfig struct {
+	Username    string
+	Password    string
+	BearerToken string
+
+	// Repos lists every repository the store addresses: the main one
+	// and those resources are routed to.
+	Repos []string
+
+	// MountFrom lists repositories of the same registry from which
+	// blobs are mounted rather than uploaded when they exist there.
+	MountFrom []string
+
+	// ExtraHeaders are added to every request to the registry, and to
+	// the redirect hosts.
+	ExtraHeaders http.Header
+
+	// RedirectHosts are hosts besides the registry's own that may
+	// receive our credentials when a Location points to them.
+	RedirectHosts []string
+
+	// UploadChunked switches uploads from a single streaming PATCH to a
+	// sequence of PATCHes of UploadChunkSize bytes.
+	UploadChunked   bool
+	UploadChunkSize int64
+
+	// UploadBandwidth and DownloadBandwidth limit the bytes per second
+	// sent in upload bodies and received in blob bodies, by all the
+	// transfers of the store together; zero means unlimited.
+	UploadBandwidth   int64
+	DownloadBandwidth int64
+
+	// RequireContentLength spools payloads of unknown length before
+	// uploading them so an exact Content-Length can be sent.
+	RequireContentLength bool
+
+	// ReadOnly refuses every write before it reaches the registry.
+	ReadOnly bool
+
+	// Force lets Create overwrite the configuration of an existing
+	// repository.
+	Force bool
+
+	// DeleteBlobs makes Delete also remove the layer blobs of the
+	// manifests it deletes, for registries without automatic garbage
+	// collection.
+	DeleteBlobs bool
+
+	// DeleteConcurrency bounds the number of parallel deletions of
+	// DeleteMany.
+	DeleteConcurrency int
+
+	// SizeScanLimit bounds the number of manifests fetched by Size,
+	// beyond which the size is extrapolated.  Zero means no limit.
+	SizeScanLimit int
+
+	// LayerCacheSize is the number of tags whose payload layer is
+	// remembered, sparing ranged reads a manifest fetch; zero disables
+	// the cache.
+	LayerCacheSize int
+
+	// CacheDir is the directory of the blob cache, which keeps the blobs
+	// read in full on disk, up to CacheMaxBytes; empty means no cache.
+	CacheDir      string
+	CacheMaxBytes int64
+
+	// DownloadConcurrency is the number of ranged GETs a blob larger than
+	// DownloadPartSize is read with at once; one reads every blob as a
+	// single stream.
+	DownloadConcurrency int
+	DownloadPartSize    int64
+
+	// Compression is the compression of the payload of the states and
+	// locks written, none, gzip or zstd.
+	Compression string
+
+	// PrefetchStates makes List resolve the manifests of the states it
+	// returns in parallel, for the reads of them that follow.
+	PrefetchStates bool
+
+	// LockTTL is the age past which a lock left behind by another
+	// process is considered stale and removed.
+	LockTTL time.Duration
+
+	// RequestsPerSecond and Burst limit the request rate client-side.
+	RequestsPerSecond float64
+	Burst             int
+
+	// MaxInflightReads and MaxInflightWrites bound the requests in
+	// flight, streamed bodies included; zero means unbounded.
+	MaxInflightReads  int
+	MaxInflightWrites int
+
+	RetryMax        int
+	RetryMaxElapsed time.Duration
+	RetryAfterMax   time.Duration
+
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSHandshakeTimeout   time.Duration
+	IdleConnTimeout       time.Duration
+
+	MaxConnsPerHost     int
+	MaxIdleConnsPerHost int
+
+	// ControlTimeout bounds small control requests such as manifest
+	// and tag operations; blob transfers are only bounded by their
+	// context.
+	ControlTimeout time.Duration
 }
 
 type ociStore struct {
-	client *http.Client
-	base   string
-	repo   string
+	client   *http.Client
+	base     string
+	basePath string
+	scheme   string
+	socket   string
+	proxy    func(*url.URL) (*url.URL, error)
+	host     string
+	repo     string
+	cfg      ociConfig
+	auth     *tokenAuth
+
+	// mirrors are registries reads fall back to, in order, when this
+	// one is unreachable
+	mirrors []*ociStore
+
+	// fetcher downloads URLs out of the registry, such as those of
+	// foreign layers: the transport of the store, dialing their host
+	fetcher *http.Client
+
+	// replica receives a copy of every write when replica_location is
+	// set
+	replica *replicator
+
+	// repos holds the stores of resources routed to their own
+	// repository
+	repos map[storage.StorageResource]*ociStore
+
+	// layers caches the payload layer of tags read or written, and blobs
+	// the blobs read, when cache_dir is set
+	layers *layerCache
+	blobs  *blobCache
+
+	// refs counts the references to layer blobs, with DeleteBlobs set,
+	// and sweepMu keeps the puts of the store and the deletion of blobs
+	// apart
+	refs    blobRefs
+	sweepMu sync.RWMutex
+
+	// resolving coalesces the concurrent resolutions of a tag
+	resolving singleflight.Group
+
+	// configDigest is the digest of the CONFIG manifest read by Open,
+	// which UpdateConfig conditions its write on
+	configMu     sync.Mutex
+	configDigest string
+
+	// emptyConfig uploads the config blob of the manifests written
+	emptyConfig uploadOnce
+
+	locks lockTable
+	sizes sizeCache
+
+	mountUnsupported      atomic.Bool
+	uploadCleanupFailures atomic.Int64
+	lengthRequired        atomic.Bool
+	deleteDisabled        atomic.Bool
+
+	// deleteEnabled is set once the registry is known to let manifests
+	// be deleted
+	deleteEnabled atomic.Bool
+
+	// rewrite is the host_rewrites rule applied to the location, and
+	// logical the location as given, which identifies the repository
+	rewrite *hostRewrite
+	logical *logicalLocation
+
+	limiter           *tokenBucket
+	uploadBandwidth   *tokenBucket
+	downloadBandwidth *tokenBucket
+	inflight          *inflight
+	quota             *quota
+	rateLimitWarned   atomic.Int64
+
+	// pushDenied is set when the push probe, run by the first write,
+	// found we may only pull
+	pushProbed atomic.Bool
+	pushDenied atomic.Bool
 }
 
 func New(ctx context.Context, name string, config map[string]string) (storage.Store, error) {
-	loc := strings.TrimPrefix(config["location"], "oci://")
-	u, err := url.Parse("http://" + loc)
+	s, err := newStore(ctx, config, true)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newStore configures a store from its config.  Unless requireRepo is
+// set, the location may name the registry alone, for the importer to
+// list its repositories.
+func newStore(ctx context.Context, config map[string]string, requireRepo bool) (*ociStore, error) {
+	scheme, socket, u, err := parseLocation(config["location"])
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := parseOptions(config, u)
 	if err != nil {
 		return nil, err
 	}
 
-	repo := strings.Trim(u.Path, "/")
-	if repo == "" {
-		return nil, fmt.Errorf("need a repo")
+	// registries served under a path prefix are written either as
+	// host/prefix//repo or with the base_path option
+	basePath := strings.Trim(opts["base_path"], "/")
+	repo := strings.TrimLeft(u.Path, "/")
+	if prefix, rest, ok := strings.Cut(repo, "//"); ok {
+		if basePath != "" && basePath != strings.Trim(prefix, "/") {
+			return nil, fmt.Errorf("base path %q in location conflicts with base_path %q", prefix, basePath)
+		}
+		basePath, repo = strings.Trim(prefix, "/"), rest
+	}
+	repo = strings.Trim(repo, "/")
+	if repo == "" && requireRepo {
+		return nil, fmt.Errorf("location %s://%s has no repository path, e.g. %s://%s/my-org/plakar", scheme, u.Host, scheme, u.Host)
+	}
+	if repo != "" {
+		if err := validateRepo(repo); err != nil {
+			return nil, err
+		}
+	}
+
+	plainHTTP := scheme == "oci+http"
+	if v := opts["plain_http"]; v != "" && scheme == "oci" {
+		if plainHTTP, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid plain_http %q", v)
+		}
+	}
+	if plainHTTP {
+		u.Scheme = "http"
+		scheme = "oci+http"
+	}
+	if socket != "" {
+		u.Scheme = "http"
+	}
+
+	var rewrite *hostRewrite
+	var logical *logicalLocation
+	if v := opts["host_rewrites"]; v != "" && socket == "" {
+		rules, err := parseHostRewrites(v)
+		if err != nil {
+			return nil, err
+		}
+		if rewrite = findHostRewrite(rules, u.Host, repo); rewrite != nil {
+			logical = &logicalLocation{host: u.Host, basePath: basePath, repo: repo}
+			u.Scheme, u.Host, basePath = rewrite.scheme, rewrite.host, rewrite.basePath
+			if repo, err = rewrite.repo(repo); err != nil {
+				return nil, err
+			}
+			slog.Debug("oci: location rewritten", "from", logical.host+"/"+logical.repo, "to", u.Host+"/"+repo)
+		}
+	}
+	tlsVerify := true
+	if v := opts["tls_verify"]; v != "" {
+		if tlsVerify, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid tls_verify %q", v)
+		}
 	}
 
 	u.Path = ""
+	if basePath != "" {
+		u.Path = "/" + basePath
+	}
+	u.User = nil
+	u.RawQuery = ""
 	base := strings.TrimRight(u.String(), "/")
 
+	cfg := ociConfig{
+		Username:        opts["username"],
+		Password:        opts["password"],
+		BearerToken:     opts["bearer_token"],
+		RetryMax:        defaultRetryMax,
+		RetryMaxElapsed: defaultRetryMaxElapsed,
+		RetryAfterMax:   defaultRetryAfterMax,
+		UploadChunkSize: defaultUploadChunkSize,
+		LockTTL:         defaultLockTTL,
+		LayerCacheSize:  defaultLayerCacheSize,
+		CacheDir:        opts["cache_dir"],
+		CacheMaxBytes:   defaultCacheMaxBytes,
+
+		DownloadConcurrency: defaultDownloadConcurrency,
+		DownloadPartSize:    defaultDownloadPartSize,
+
+		DeleteConcurrency: defaultDeleteConcurrency,
+
+		ConnectTimeout:        defaultConnectTimeout,
+		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		ControlTimeout:        defaultControlTimeout,
+
+		MaxConnsPerHost:     defaultMaxConnsPerHost,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+	}
+	if v := opts["upload_chunked"]; v != "" {
+		if cfg.UploadChunked, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid upload_chunked %q", v)
+		}
+	}
+	if v := opts["read_only"]; v != "" {
+		if cfg.ReadOnly, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid read_only %q", v)
+		}
+	}
+	if v := opts["force"]; v != "" {
+		if cfg.Force, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid force %q", v)
+		}
+	}
+	if v := opts["delete_blobs"]; v != "" {
+		if cfg.DeleteBlobs, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid delete_blobs %q", v)
+		}
+	}
+	switch cfg.Compression = opts["compression"]; cfg.Compression {
+	case "":
+		cfg.Compression = compressionNone
+	case compressionNone, compressionGzip, compressionZstd:
+	default:
+		return nil, fmt.Errorf("invalid compression %q, expected none, gzip or zstd", cfg.Compression)
+	}
+	if v := opts["prefetch_states"]; v != "" {
+		if cfg.PrefetchStates, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid prefetch_states %q", v)
+		}
+	}
+	if v := opts["delete_concurrency"]; v != "" {
+		if cfg.DeleteConcurrency, err = strconv.Atoi(v); err != nil || cfg.DeleteConcurrency <= 0 {
+			return nil, fmt.Errorf("invalid delete_concurrency %q", v)
+		}
+	}
+	if v := opts["require_content_length"]; v != "" {
+		if cfg.RequireContentLength, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid require_content_length %q", v)
+		}
+	}
+	if v := opts["upload_chunk_size"]; v != "" {
+		if cfg.UploadChunkSize, err = ParseSize(v); err != nil || cfg.UploadChunkSize <= 0 {
+			return nil, fmt.Errorf("invalid upload_chunk_size %q", v)
+		}
+	}
+	if v := opts["cache_max_bytes"]; v != "" {
+		if cfg.CacheDir == "" {
+			return nil, fmt.Errorf("cache_max_bytes requires cache_dir")
+		}
+		if cfg.CacheMaxBytes, err = ParseSize(v); err != nil || cfg.CacheMaxBytes <= 0 {
+			return nil, fmt.Errorf("invalid cache_max_bytes %q", v)
+		}
+	}
+	if v := opts["download_part_size"]; v != "" {
+		if cfg.DownloadPartSize, err = ParseSize(v); err != nil || cfg.DownloadPartSize <= 0 || cfg.DownloadPartSize > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid download_part_size %q", v)
+		}
+	}
+	if v := opts["upload_bandwidth"]; v != "" {
+		if cfg.UploadBandwidth, err = ParseSize(v); err != nil {
+			return nil, fmt.Errorf("invalid upload_bandwidth %q", v)
+		}
+	}
+	if v := opts["download_bandwidth"]; v != "" {
+		if cfg.DownloadBandwidth, err = ParseSize(v); err != nil {
+			return nil, fmt.Errorf("invalid download_bandwidth %q", v)
+		}
+	}
+	if v := opts["bearer_token_file"]; v != "" {
+		b, err := os.ReadFile(v)
+		if err != nil {
+			return nil, fmt.Errorf("bearer_token_file: %w", err)
+		}
+		if cfg.BearerToken = strings.TrimSpace(string(b)); cfg.BearerToken == "" {
+			return nil, fmt.Errorf("bearer_token_file %s is empty", v)
+		}
+	}
+	if v := opts["extra_headers"]; v != "" {
+		if cfg.ExtraHeaders, err = parseExtraHeaders(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, host := range strings.Split(opts["redirect_hosts"], ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.RedirectHosts = append(cfg.RedirectHosts, host)
+		}
+	}
+	for _, from := range strings.Split(opts["mount_from"], ",") {
+		if from = strings.Trim(strings.TrimSpace(from), "/"); from != "" {
+			if err := validateRepo(from); err != nil {
+				return nil, fmt.Errorf("mount_from: %w", err)
+			}
+			if from, err = rewrite.repo(from); err != nil {
+				return nil, fmt.Errorf("mount_from: %w", err)
+			}
+			if from == repo {
+				continue
+			}
+			cfg.MountFrom = append(cfg.MountFrom, from)
+		}
+	}
+	cfg.Repos = []string{repo}
+	resourceRepos := map[storage.StorageResource]string{}
+	for res, key := range resourceRepoOptions {
+		r := strings.Trim(strings.TrimSpace(opts[key]), "/")
+		if r == "" {
+			continue
+		}
+		if err := validateRepo(r); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		if r, err = rewrite.repo(r); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		if r == repo {
+			continue
+		}
+		resourceRepos[res] = r
+		if !slices.Contains(cfg.Repos, r) {
+			cfg.Repos = append(cfg.Repos, r)
+		}
+	}
+	if v := opts["retry_max"]; v != "" {
+		if cfg.RetryMax, err = strconv.Atoi(v); err != nil || cfg.RetryMax < 0 {
+			return nil, fmt.Errorf("invalid retry_max %q", v)
+		}
+	}
+	if v := opts["retry_max_elapsed"]; v != "" {
+		if cfg.RetryMaxElapsed, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid retry_max_elapsed %q: %w", v, err)
+		}
+	}
+	if v := opts["retry_after_max"]; v != "" {
+		if cfg.RetryAfterMax, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid retry_after_max %q: %w", v, err)
+		}
+	}
+
+	for key, d := range map[string]*time.Duration{
+		"connect_timeout":         &cfg.ConnectTimeout,
+		"response_header_timeout": &cfg.ResponseHeaderTimeout,
+		"tls_handshake_timeout":   &cfg.TLSHandshakeTimeout,
+		"idle_conn_timeout":       &cfg.IdleConnTimeout,
+		"control_timeout":         &cfg.ControlTimeout,
+	} {
+		if v := opts[key]; v != "" {
+			if *d, err = time.ParseDuration(v); err != nil || *d < 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, v)
+			}
+		}
+	}
+	for key, n := range map[string]*int{
+		"max_conns_per_host":      &cfg.MaxConnsPerHost,
+		"max_idle_conns_per_host": &cfg.MaxIdleConnsPerHost,
+		"size_scan_limit":         &cfg.SizeScanLimit,
+		"layer_cache_size":        &cfg.LayerCacheSize,
+		"download_concurrency":    &cfg.DownloadConcurrency,
+		"burst":                   &cfg.Burst,
+		"max_inflight_reads":      &cfg.MaxInflightReads,
+		"max_inflight_writes":     &cfg.MaxInflightWrites,
+	} {
+		if v := opts[key]; v != "" {
+			if *n, err = strconv.Atoi(v); err != nil || *n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, v)
+			}
+		}
+	}
+	if v := opts["max_inflight"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid max_inflight %q", v)
+		}
+		if opts["max_inflight_reads"] == "" {
+			cfg.MaxInflightReads = n
+		}
+		if opts["max_inflight_writes"] == "" {
+			cfg.MaxInflightWrites = n
+		}
+	}
+	if v := opts["requests_per_second"]; v != "" {
+		if cfg.RequestsPerSecond, err = strconv.ParseFloat(v, 64); err != nil || cfg.RequestsPerSecond < 0 || math.IsInf(cfg.RequestsPerSecond, 0) {
+			return nil, fmt.Errorf("invalid requests_per_second %q", v)
+		}
+	}
+	if v := opts["lock_ttl"]; v != "" {
+		if cfg.LockTTL, err = time.ParseDuration(v); err != nil || cfg.LockTTL <= 0 {
+			return nil, fmt.Errorf("invalid lock_ttl %q", v)
+		}
+	}
+
+	var pin []byte
+	if v := opts["tls_pin_sha256"]; v != "" {
+		if pin, err = parsePin(v); err != nil {
+			return nil, err
+		}
+	}
+
+	// the environment's proxy settings, NO_PROXY included, apply unless
+	// proxy_url overrides the proxy itself
+	proxy := httpproxy.FromEnvironment()
+	if v := opts["proxy_url"]; v != "" {
+		pu, err := url.Parse(v)
+		if err != nil || pu.Host == "" {
+			return nil, fmt.Errorf("invalid proxy_url %q", redactURL(v))
+		}
+		switch pu.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid proxy_url %q: unsupported scheme %q", redactURL(v), pu.Scheme)
+		}
+		proxy.HTTPProxy, proxy.HTTPSProxy = v, v
+	}
+	proxyFunc := proxy.ProxyFunc()
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: !tlsVerify}, //nolint:gosec
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		},
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+
+		// the custom dialer would otherwise disable HTTP/2, which
+		// multiplexes parallel transfers on few connections
+		ForceAttemptHTTP2:   true,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
 	}
-	return &ociStore{
-		base: base,
-		repo: repo,
+	if socket != "" {
+		// every request goes to the socket whatever its URL says
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	// the pin is that of the registry: mirrors, replicas and the hosts
+	// it redirects to are verified as usual
+	var rt http.RoundTripper = tr
+	if pin != nil {
+		pinned := tr.Clone()
+		pinned.TLSClientConfig = pinnedTLSConfig(pin)
+		rt = &pinnedHostTransport{host: u.Host, pinned: pinned, other: tr}
+	}
+	s := &ociStore{
+		base:     base,
+		basePath: basePath,
+		scheme:   scheme,
+		socket:   socket,
+		proxy:    proxyFunc,
+		host:     u.Host,
+		repo:     repo,
+		cfg:      cfg,
+		auth:     &tokenAuth{},
+		rewrite:  rewrite,
+		logical:  logical,
 		client: &http.Client{
-			Transport: tr,
+			Transport: rt,
 			Timeout:   0, // streaming uploads/downloads
 		},
-	}, nil
+	}
+	s.client.CheckRedirect = s.checkRedirect
+	if cfg.RequestsPerSecond > 0 {
+		s.limiter = newTokenBucket(cfg.RequestsPerSecond, cfg.Burst)
+	}
+	// a second worth of bytes may be transferred at once
+	if cfg.UploadBandwidth > 0 {
+		s.uploadBandwidth = newTokenBucket(float64(cfg.UploadBandwidth), 0)
+	}
+	if cfg.DownloadBandwidth > 0 {
+		s.downloadBandwidth = newTokenBucket(float64(cfg.DownloadBandwidth), 0)
+	}
+	s.inflight = newInflight(cfg)
+	s.quota = &quota{}
+	s.layers = newLayerCache(cfg.LayerCacheSize)
+	if cfg.CacheDir != "" {
+		if s.blobs, err = newBlobCache(cfg.CacheDir, cfg.CacheMaxBytes); err != nil {
+			return nil, err
+		}
+	}
+	ftr := tr.Clone()
+	ftr.DialContext = dialer.DialContext
+	s.fetcher = &http.Client{Transport: ftr}
+	for _, spec := range strings.Split(opts["mirrors"], ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		mrepo := s.repo
+		if logical != nil {
+			mrepo = logical.repo
+		}
+		m, err := s.newRemote(spec, mrepo, tr, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("mirrors: %w", err)
+		}
+		s.mirrors = append(s.mirrors, m)
+	}
+	if v := opts["replica_location"]; v != "" {
+		concurrency, queueSize := defaultReplicaConcurrency, defaultReplicaQueueSize
+		for key, n := range map[string]*int{
+			"replica_concurrency": &concurrency,
+			"replica_queue_size":  &queueSize,
+		} {
+			if v := opts[key]; v != "" {
+				if *n, err = strconv.Atoi(v); err != nil || *n <= 0 {
+					return nil, fmt.Errorf("invalid %s %q", key, v)
+				}
+			}
+		}
+		dst, err := s.newRemote(v, "", tr, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("replica_location: %w", err)
+		}
+		dst.cfg.Repos = nil
+		s.replica = newReplicator(dst, concurrency, queueSize)
+	}
+	if len(resourceRepos) > 0 {
+		s.repos = map[storage.StorageResource]*ociStore{}
+		byRepo := map[string]*ociStore{}
+		for res, r := range resourceRepos {
+			if byRepo[r] == nil {
+				byRepo[r] = s.withRepo(r)
+			}
+			s.repos[res] = byRepo[r]
+		}
+	}
+	return s, nil
 }
 
 func (s *ociStore) Create(ctx context.Context, config []byte) error {
-	_, err := s.putByTag(ctx, "CONFIG", bytes.NewReader(config))
+	if s.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+
+	h := http.Header{}
+	if !s.cfg.Force {
+		if _, err := s.headManifestDigest(ctx, "CONFIG"); err == nil {
+			return fmt.Errorf("%w: %s/%s", ErrAlreadyInitialized, s.base, s.repo)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// close the race with a concurrent create on registries
+		// honoring conditional requests
+		h.Set("If-None-Match", "*")
+	}
+
+	// a repository that can never be pruned is better refused upfront
+	// than discovered at the first maintenance run
+	if err := s.probeDelete(ctx); err != nil {
+		return err
+	}
+
+	_, _, err := s.putTagged(ctx, "CONFIG", bytes.NewReader(config), s.configAnnotations(), h)
+	if errors.Is(err, errPreconditionFailed) {
+		return fmt.Errorf("%w: %s/%s", ErrAlreadyInitialized, s.base, s.repo)
+	}
+	if err == nil {
+		s.replicate(ctx, s, "CONFIG", false)
+	}
 	return err
 }
 
 func (s *ociStore) Open(ctx context.Context) ([]byte, error) {
-	rd, err := s.getByTag(ctx, "CONFIG", nil)
+	var (
+		config []byte
+		digest string
+	)
+	err := s.readWithMirrors("CONFIG", func(r *ociStore) error {
+		man, d, err := r.manifestOf(ctx, "CONFIG")
+		if err != nil {
+			return err
+		}
+		layer, err := payloadLayer(man)
+		if err != nil {
+			return err
+		}
+		s.learnDelete(man.Annotations)
+		rd, err := r.getBlob(ctx, layer, nil)
+		if err != nil {
+			return err
+		}
+		defer rd.Close()
+
+		config, err = io.ReadAll(rd)
+		digest = d
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return io.ReadAll(rd)
+
+	s.configMu.Lock()
+	s.configDigest = digest
+	s.configMu.Unlock()
+	return config, nil
 }
 
+// UpdateConfig replaces the repository configuration, provided it was not
+// changed since it was read by Open.  The write is conditioned on the
+// manifest digest observed then, both by comparing it with the current
+// one and by sending If-Match; a ConflictError is returned when another
+// writer got there first, so the caller can re-read and retry.
+func (s *ociStore) UpdateConfig(ctx context.Context, config []byte) error {
+	if err := s.writable(ctx); err != nil {
+		return err
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	if s.configDigest == "" {
+		return fmt.Errorf("oci: configuration must be read with Open before it is updated")
+	}
+
+	current, err := s.headManifestDigest(ctx, "CONFIG")
+	if err != nil {
+		return err
+	}
+	if current != s.configDigest {
+		return &ConflictError{Tag: "CONFIG", Expected: s.configDigest, Actual: current}
+	}
+
+	ifMatchWarning.Do(func() {
+		slog.Warn("oci: configuration updates rely on If-Match; registries ignoring it leave a window between check and write where a concurrent update can be lost")
+	})
+
+	h := http.Header{}
+	h.Set("If-Match", `"`+s.configDigest+`"`)
+	_, digest, err := s.putTagged(ctx, "CONFIG", bytes.NewReader(config), s.configAnnotations(), h)
+	if errors.Is(err, errPreconditionFailed) {
+		return &ConflictError{Tag: "CONFIG", Expected: s.configDigest}
+	}
+	if err != nil {
+		return err
+	}
+	s.configDigest = digest
+	s.replicate(ctx, s, "CONFIG", false)
+	return nil
+}
+
+// ifMatchWarning makes sure the conditional update caveat is only logged
+// once.
+var ifMatchWarning sync.Once
+
+// Location returns a location New configures an equivalent store from:
+// the scheme it was given, the registry host or socket, the base path and
+// the repository.  Credentials and options are left out, and so are
+// host_rewrites, so that the repository keeps its identity across
+// environments.
 func (s *ociStore) Location(ctx context.Context) (string, error) {
-	return strings.Replace(s.base, "http://", "oci://", 1), nil
+	if s.socket != "" {
+		return s.scheme + "://" + s.Origin() + ":" + s.Root(), nil
+	}
+	return s.scheme + "://" + s.Origin() + s.Root(), nil
 }
 
 func (s *ociStore) Mode(ctx context.Context) (storage.Mode, error) {
-	return storage.ModeRead | storage.ModeWrite, nil
+	if s.cfg.ReadOnly || s.pushDenied.Load() {
+		return storage.ModeRead, nil
+	}
+	mode := storage.ModeRead | storage.ModeWrite
+	if s.deleteEnabled.Load() && !s.deleteDisabled.Load() {
+		mode |= ModeDelete
+	}
+	return mode, nil
 }
 
 func (s *ociStore) Flags() location.Flags {
 	return 0
 }
 
+// Origin is the registry host, or socket path, as given in the location.
 func (s *ociStore) Origin() string {
-	return s.repo
+	if s.socket != "" {
+		return s.socket
+	}
+	if s.logical != nil {
+		return s.logical.host
+	}
+	return s.host
 }
 
 func (s *ociStore) Type() string {
 	return "oci"
 }
 
+// Root is the path of the repository on the registry, the base path
+// being separated from it by a double slash.
 func (s *ociStore) Root() string {
-	return s.base
+	basePath, repo := s.basePath, s.repo
+	if s.logical != nil {
+		basePath, repo = s.logical.basePath, s.logical.repo
+	}
+	if basePath != "" {
+		return "/" + basePath + "//" + repo
+	}
+	return "/" + repo
 }
 
-func (s *ociStore) Size(ctx context.Context) (int64, error) {
-	return -1, nil
+// Close waits for pending replication, reporting writes that could not
+// be replicated.
+func (s *ociStore) Close(ctx context.Context) error {
+	if s.replica != nil {
+		return s.replica.close(ctx)
+	}
+	return nil
+}
+
+func (s *ociStore) Ping(ctx context.Context) error {
+	if err := s.pingRepo(ctx); err != nil {
+		return err
+	}
+	// what the creation of the repository found, unless known already
+	if !s.deleteEnabled.Load() && !s.deleteDisabled.Load() {
+		man, _, err := s.manifestOf(ctx, "CONFIG")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if man != nil {
+			s.learnDelete(man.Annotations)
+		}
+	}
+	if s.deleteDisabled.Load() {
+		slog.Warn("oci: registry has deletion disabled, pruning and maintenance will fail", "registry", s.base)
+	}
+	return nil
+}
+
+// pingRepo checks that the registry answers and that the repository may
+// be read with the configured credentials.
+func (s *ociStore) pingRepo(ctx context.Context) error {
+	// base endpoint, answering the auth challenge if any
+	rc, resp, err := s.do(ctx, "GET", s.base+"/v2/", nil, nil)
+	if err != nil {
+		return s.pingError(resp, err)
+	}
+	drainAndClose(rc)
+
+	// the repository itself, with the configured scope; not every
+	// registry routes HEAD on tags/list so retry with a GET on 405
+	resp, err = s.doRepo(ctx, "HEAD", "/tags/list", nil, nil)
+	if resp != nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		resp, err = s.doRepo(ctx, "GET", "/tags/list?n=1", nil, nil)
+	}
+	if err != nil {
+		return s.pingError(resp, err)
+	}
+	return nil
 }
 
-func (s *ociStore) Close(ctx context.Context) error { return nil }
+// pingError turns a failed Ping request into a message telling the user
+// which layer is at fault, naming the proxy the request went through.
+func (s *ociStore) pingError(resp *http.Response, err error) error {
+	perr := s.classifyPingError(resp, err)
+	if u, _ := url.Parse(s.base); u != nil && s.socket == "" {
+		if pu, _ := s.proxy(u); pu != nil {
+			return fmt.Errorf("%w (through proxy %s)", perr, redactURL(pu.String()))
+		}
+	}
+	return perr
+}
 
-func (s *ociStore) Ping(ctx context.Context) error { return nil }
+func (s *ociStore) classifyPingError(resp *http.Response, err error) error {
+	var (
+		dnsErr  *net.DNSError
+		opErr   *net.OpError
+		authErr *authError
+		certErr *tls.CertificateVerificationError
+		hdrErr  tls.RecordHeaderError
+		pinErr  *pinMismatchError
+	)
+
+	switch {
+	case resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden):
+		return fmt.Errorf("registry %s rejected credentials for %s: %w", s.base, s.repo, err)
+	case resp != nil && resp.StatusCode == http.StatusProxyAuthRequired:
+		return fmt.Errorf("proxy rejected credentials for %s: %w", s.base, err)
+	case resp != nil && resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("repository %s not found on %s: %w", s.repo, s.base, err)
+	case errors.As(err, &authErr):
+		return fmt.Errorf("registry %s rejected credentials: %w", s.base, err)
+	case errors.As(err, &dnsErr):
+		return fmt.Errorf("cannot resolve registry host %s: %w", dnsErr.Name, err)
+	case errors.As(err, &certErr), errors.As(err, &hdrErr), errors.As(err, &pinErr):
+		return fmt.Errorf("TLS failure talking to %s: %w", s.base, err)
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return fmt.Errorf("cannot connect to registry %s: %w", s.base, err)
+	default:
+		return fmt.Errorf("registry %s: %w", s.base, err)
+	}
+}
 
 func (s *ociStore) List(ctx context.Context, res storage.StorageResource) ([]objects.MAC, error) {
 	var prefix string
+	r := s.storeFor(res)
 
 	switch res {
 	case storage.StorageResourcePackfile:
@@ -111,14 +952,27 @@ func (s *ociStore) List(ctx context.Context, res storage.StorageResource) ([]obj
 	case storage.StorageResourceState:
 		prefix = "state-"
 	case storage.StorageResourceLock:
-		prefix = "locks-"
+		return r.listLocks(ctx)
 	default:
 		return nil, errors.ErrUnsupported
 	}
-	return s.listByPrefix(ctx, prefix)
+	macs, err := r.listByPrefix(ctx, prefix)
+	if err == nil && res == storage.StorageResourceState && s.cfg.PrefetchStates && r.layers != nil {
+		tags := make([]string, len(macs))
+		for i, mac := range macs {
+			tags[i] = fmt.Sprintf("%s%x", prefix, mac)
+		}
+		r.prefetch(ctx, tags)
+	}
+	return macs, err
 }
 
 func (s *ociStore) Put(ctx context.Context, res storage.StorageResource, mac objects.MAC, rd io.Reader) (int64, error) {
+	r := s.storeFor(res)
+	if err := r.writable(ctx); err != nil {
+		return -1, err
+	}
+
 	var prefix string
 
 	switch res {
@@ -127,37 +981,58 @@ func (s *ociStore) Put(ctx context.Context, res storage.StorageResource, mac obj
 	case storage.StorageResourceState:
 		prefix = "state-"
 	case storage.StorageResourceLock:
-		prefix = "locks-"
+		// locks coordinate writers of this registry only
+		return r.putLock(ctx, fmt.Sprintf("locks-%x", mac), rd)
 	default:
 		return -1, errors.ErrUnsupported
 	}
-	return s.putByTag(ctx, fmt.Sprintf("%s%x", prefix, mac), rd)
+
+	tag := fmt.Sprintf("%s%x", prefix, mac)
+	n, err := r.putByTag(ctx, tag, rd, nil)
+	if err == nil {
+		s.replicate(ctx, r, tag, false)
+	}
+	return n, err
 }
 
 func (s *ociStore) Get(ctx context.Context, res storage.StorageResource, mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
-	var prefix string
+	prefix, err := readPrefix(res)
+	if err != nil {
+		return nil, err
+	}
+	return s.storeFor(res).getByTag(ctx, fmt.Sprintf("%s%x", prefix, mac), rg)
+}
 
+// readPrefix returns the prefix of the tags of res.
+func readPrefix(res storage.StorageResource) (string, error) {
 	switch res {
 	case storage.StorageResourcePackfile:
-		prefix = "packfiles-"
+		return "packfiles-", nil
 	case storage.StorageResourceState:
-		prefix = "state-"
+		return "state-", nil
 	case storage.StorageResourceLock:
-		prefix = "locks-"
+		return "locks-", nil
 	default:
-		return nil, errors.ErrUnsupported
+		return "", errors.ErrUnsupported
 	}
+}
 
-	var h http.Header
-	if rg != nil {
-		end := rg.Offset + uint64(rg.Length) - 1
-		h = http.Header{}
-		h.Set("Range", fmt.Sprintf("bytes=%d-%d", rg.Offset, end))
+func (s *ociStore) Delete(ctx context.Context, res storage.StorageResource, mac objects.MAC) error {
+	layers, err := s.delete(ctx, res, mac)
+	if err != nil || len(layers) == 0 {
+		return err
 	}
-	return s.getByTag(ctx, fmt.Sprintf("%s%x", prefix, mac), h)
+	return s.storeFor(res).deleteUnreferenced(ctx, layers)
 }
 
-func (s *ociStore) Delete(ctx context.Context, res storage.StorageResource, mac objects.MAC) error {
+// delete deletes a resource but leaves its layer blobs, which it returns
+// with DeleteBlobs set, to the caller.
+func (s *ociStore) delete(ctx context.Context, res storage.StorageResource, mac objects.MAC) ([]string, error) {
+	r := s.storeFor(res)
+	if err := r.writeError(); err != nil {
+		return nil, err
+	}
+
 	var prefix string
 
 	switch res {
@@ -166,120 +1041,333 @@ func (s *ociStore) Delete(ctx context.Context, res storage.StorageResource, mac
 	case storage.StorageResourceState:
 		prefix = "state-"
 	case storage.StorageResourceLock:
-		prefix = "locks-"
+		return nil, r.deleteLock(ctx, fmt.Sprintf("locks-%x", mac))
 	default:
-		return errors.ErrUnsupported
+		return nil, errors.ErrUnsupported
 	}
-	return s.deleteByTag(ctx, fmt.Sprintf("%s%x", prefix, mac))
+
+	tag := fmt.Sprintf("%s%x", prefix, mac)
+	layers, err := r.deleteTag(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	s.replicate(ctx, r, tag, true)
+	return layers, nil
 }
 
 // ---- Core: blob upload + manifest(tag) ----
 
-func (s *ociStore) putByTag(ctx context.Context, tag string, rd io.Reader) (int64, error) {
-	// stream upload payload blob -> returns digest + size
-	payloadDigest, size, err := s.uploadBlob(ctx, rd)
+// tagAnnotation records on every manifest the tag it was pushed under.
+// Deleting a manifest by digest removes every tag pointing at it, so two
+// resources with identical payloads must not share a manifest: this
+// annotation makes each manifest unique to its tag.
+const tagAnnotation = "org.plakar.tag"
+
+// putByTag stores rd as the single layer of a manifest tagged tag.
+// extraHeaders are added to the manifest PUT, to make it conditional.
+func (s *ociStore) putByTag(ctx context.Context, tag string, rd io.Reader, extraHeaders http.Header) (int64, error) {
+	size, _, err := s.putTagged(ctx, tag, rd, nil, extraHeaders)
+	return size, err
+}
+
+// putTagged implements putByTag and also returns the digest of the
+// manifest written, which carries the given annotations.
+func (s *ociStore) putTagged(ctx context.Context, tag string, rd io.Reader, annotations map[string]string, extraHeaders http.Header) (int64, string, error) {
+	// whatever the outcome, the layer cached for tag is no longer known
+	// to be current
+	s.layers.remove(tag)
+	if s.cfg.DeleteBlobs {
+		// blobs are not deleted while a put may be reusing them
+		s.sweepMu.RLock()
+		defer s.sweepMu.RUnlock()
+	}
+
+	// states and locks are compressed as they are uploaded, their size
+	// being that of the payload given
+	mediaType := layerMediaType
+	var counter *countingReader
+	if algo := s.cfg.Compression; algo != compressionNone && compressedTag(tag) {
+		counter = &countingReader{rd: rd}
+		compressed := compress(counter, algo)
+		defer compressed.Close()
+		rd = compressed
+		mediaType += "+" + algo
+	}
+
+	// stream upload payload blob -> returns digest + size, alongside the
+	// config blob; the first to fail cancels the other, whose upload
+	// session is then cancelled too
+	var payloadDigest string
+	var blobSize int64
+	var fresh bool
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		var err error
+		payloadDigest, blobSize, fresh, err = s.pushBlob(gctx, rd)
+		return err
+	})
+	g.Go(func() error {
+		return s.pushEmptyConfig(gctx)
+	})
+	if err := g.Wait(); err != nil {
+		if fresh {
+			s.deleteBlob(ctx, payloadDigest)
+		}
+		return 0, "", err
+	}
+
+	// put manifest that references payload blob as a single layer and tag it to chosen "key"
+	layer := descriptor{
+		MediaType: mediaType,
+		Digest:    payloadDigest,
+		Size:      blobSize,
+	}
+	manAnnotations := map[string]string{tagAnnotation: tag}
+	for k, v := range annotations {
+		manAnnotations[k] = v
+	}
+
+	body, err := marshalManifest(layer, manAnnotations)
 	if err != nil {
-		return 0, err
+		return -1, "", err
+	}
+
+	h := http.Header{}
+	for k, vv := range extraHeaders {
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+	h.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	resp, err := s.doRepo(ctx, "PUT", "/manifests/"+url.PathEscape(tag), bytes.NewReader(body), h)
+	if errors.Is(err, ErrBlobUnknown) {
+		// the config blob uploaded earlier is gone, e.g. garbage
+		// collected, upload it again
+		s.emptyConfig.reset()
+		if cerr := s.pushEmptyConfig(ctx); cerr != nil {
+			return 0, "", cerr
+		}
+		resp, err = s.doRepo(ctx, "PUT", "/manifests/"+url.PathEscape(tag), bytes.NewReader(body), h)
+	}
+	if resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+		if fresh {
+			s.deleteBlob(ctx, payloadDigest)
+		}
+		return 0, "", fmt.Errorf("put manifest %s: %w", tag, errPreconditionFailed)
+	}
+	if err != nil {
+		// a registry that answered did not move the tag; without an
+		// answer we cannot know
+		state := "still points at its previous content"
+		if resp == nil {
+			state = "may or may not have been updated"
+			s.refs.reset()
+		}
+		if fresh {
+			s.deleteBlob(ctx, payloadDigest)
+		}
+		return 0, "", fmt.Errorf("put manifest: tag %s %s: %w", tag, state, err)
+	}
+	sum := sha256.Sum256(body)
+	expected := "sha256:" + hex.EncodeToString(sum[:])
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d != expected {
+		return 0, "", fmt.Errorf("put manifest: %w", &DigestMismatchError{Ref: tag, Expected: expected, Actual: d})
+	}
+	s.layers.set(tag, layerEntry{layer: layer, manifest: expected})
+	if s.cfg.DeleteBlobs {
+		s.refs.set(tag, []string{layer.Digest})
 	}
+	if counter != nil {
+		return counter.n, expected, nil
+	}
+	return blobSize, expected, nil
+}
+
+// deleteBlob removes a blob, best effort: registries with blob deletion
+// disabled refuse it, which is fine for cleanup purposes.
+func (s *ociStore) deleteBlob(ctx context.Context, digest string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), uploadCleanupTimeout)
+	defer cancel()
+
+	if _, err := s.doRepo(ctx, "DELETE", "/blobs/"+url.PathEscape(digest), nil, nil); err != nil {
+		slog.Debug("oci: failed to delete blob", "digest", digest, "error", err)
+	}
+}
+
+// getByTag reads the payload of tag, going straight to its blob when its
+// layer is cached.  A full read is checked against the digest of the
+// layer, as named by the manifest, so that an entry gone stale cannot
+// serve the wrong content unnoticed.
+func (s *ociStore) getByTag(ctx context.Context, tag string, rg *storage.Range) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := s.readWithMirrors(tag, func(r *ociStore) error {
+		entry, cached := r.layers.get(tag)
+		if cached {
+			var err error
+			if rc, err = r.getLayer(ctx, entry, rg); !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			// the tag moved or was deleted since it was cached
+			r.layers.remove(tag)
+		}
+		entry, err := r.resolveEntry(ctx, tag)
+		if err != nil {
+			return err
+		}
+		rc, err = r.getLayer(ctx, entry, rg)
+		return err
+	})
+	return rc, err
+}
 
-	// upload minimal config blob "{}"
-	cfgDigest, _, err := s.uploadBlob(ctx, bytes.NewReader([]byte("{}")))
+// getLayer reads the payload of entry, optionally ranged, decompressing
+// its layer if compressed.
+func (s *ociStore) getLayer(ctx context.Context, entry layerEntry, rg *storage.Range) (io.ReadCloser, error) {
+	algo, err := layerCompression(entry.layer.MediaType)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	// put manifest that references payload blob as a single layer and tag it to chosen "key"
-	man := ociManifest{
-		SchemaVersion: 2,
-		MediaType:     "application/vnd.oci.image.manifest.v1+json",
-		Config: descriptor{
-			MediaType: "application/vnd.oci.image.config.v1+json",
-			Digest:    cfgDigest,
-			Size:      int64(len("{}")),
-		},
-		Layers: []descriptor{{
-			MediaType: "application/octet-stream",
-			Digest:    payloadDigest,
-			Size:      size,
-		}},
+	if algo == compressionNone {
+		return s.fetchLayer(ctx, entry, rg)
 	}
-
-	body, err := json.Marshal(man)
+	rc, err := s.fetchLayer(ctx, entry, nil)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
+	return decompress(rc, algo, rg)
+}
 
-	h := http.Header{}
-	h.Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
-	_, err = s.doRepo(ctx, "PUT", "/manifests/"+tag, bytes.NewReader(body), h)
-	return size, err
+// fetchLayer fetches the payload layer of entry, optionally ranged, from
+// the blob cache if it holds it.  A full read of a large layer is made in
+// parts, checked against its digest, and copied to the blob cache.
+func (s *ociStore) fetchLayer(ctx context.Context, entry layerEntry, rg *storage.Range) (io.ReadCloser, error) {
+	if rc, ok, err := s.blobs.get(entry.layer.Digest, entry.layer.Size, rg); ok {
+		return rc, err
+	}
+	var rc io.ReadCloser
+	var err error
+	if rg == nil && s.cfg.DownloadConcurrency > 1 && entry.layer.Size > s.cfg.DownloadPartSize {
+		rc, err = s.getParts(ctx, entry.layer)
+	} else {
+		rc, err = s.getBlob(ctx, entry.layer, rg)
+	}
+	if err != nil || rg != nil || !strings.HasPrefix(entry.layer.Digest, "sha256:") {
+		return rc, err
+	}
+	if rc, err = NewVerifyingReader(rc, entry.layer.Digest); err != nil {
+		return nil, err
+	}
+	return s.blobs.populate(rc, entry.layer.Digest, entry.layer.Size), nil
 }
 
-func (s *ociStore) getByTag(ctx context.Context, tag string, extraHeaders http.Header) (io.ReadCloser, error) {
+// resolveLayer fetches the manifest tag points to and returns the
+// descriptor of its payload layer along with the manifest digest.
+func (s *ociStore) resolveLayer(ctx context.Context, tag string) (descriptor, string, error) {
 	// fetch manifest by tag
-	h := http.Header{}
-	h.Set("Accept", "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json")
-	manifestRC, resp, err := s.doRepoRC(ctx, "GET", "/manifests/"+tag, nil, h)
+	raw, digest, err := s.fetchManifest(ctx, tag)
 	if err != nil {
-		return nil, err
+		return descriptor{}, "", err
 	}
-	defer manifestRC.Close()
 
 	var man ociManifest
-	if err := json.NewDecoder(manifestRC).Decode(&man); err != nil {
-		return nil, fmt.Errorf("decode manifest: %w", err)
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return descriptor{}, "", fmt.Errorf("decode manifest: %w", err)
 	}
-	_ = resp // may be useful for ETag/digest caching later
+	layer, err := payloadLayer(&man)
+	return layer, digest, err
+}
 
+// payloadLayer is the layer of man holding the payload of a resource.
+func payloadLayer(man *ociManifest) (descriptor, error) {
 	if len(man.Layers) < 1 {
-		return nil, fmt.Errorf("manifest has no layers")
+		return descriptor{}, fmt.Errorf("manifest has no layers")
 	}
 	layer := man.Layers[0]
 	if layer.Digest == "" {
-		return nil, fmt.Errorf("manifest layer digest missing")
+		return descriptor{}, fmt.Errorf("manifest layer digest missing")
 	}
+	return layer, nil
+}
 
+// getBlob fetches the content of a layer, optionally ranged.
+func (s *ociStore) getBlob(ctx context.Context, layer descriptor, rg *storage.Range) (io.ReadCloser, error) {
 	// GET blob by digest (optionally ranged)
-	h2 := http.Header{}
-	for k, vv := range extraHeaders {
-		for _, v := range vv {
-			h2.Add(k, v)
+	if rg == nil {
+		rc, _, err := s.doRepoBlobRC(ctx, layer.Digest, nil)
+		return rc, err
+	}
+
+	h := http.Header{}
+	h.Set("Range", rangeHeader(rg))
+	rc, resp, err := s.doRepoBlobRC(ctx, layer.Digest, h)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, fmt.Errorf("%w: %v", ErrRangeNotSatisfiable, err)
 		}
+		return nil, err
 	}
-	return s.doRepoBlobRC(ctx, layer.Digest, h2)
+	return checkRange(rg, resp, rc)
 }
 
+// deleteByTag deletes the manifest tag points to and, with DeleteBlobs
+// set, the layer blobs no other manifest references.
 func (s *ociStore) deleteByTag(ctx context.Context, tag string) error {
-	// Need manifest digest to delete: HEAD /manifests/<tag> gives Docker-Content-Digest
-	digest, err := s.headManifestDigest(ctx, tag)
-	if err != nil {
+	layers, err := s.deleteTag(ctx, tag)
+	if err != nil || len(layers) == 0 {
 		return err
 	}
-	_, err = s.doRepo(ctx, "DELETE", "/manifests/"+digest, nil, nil)
-	return err
+	return s.deleteUnreferenced(ctx, layers)
+}
+
+// deleteTag deletes the manifest tag points to.  With DeleteBlobs set it
+// returns the layer blobs of the manifest, for deleteUnreferenced.
+func (s *ociStore) deleteTag(ctx context.Context, tag string) ([]string, error) {
+	s.layers.remove(tag)
+	if !s.cfg.DeleteBlobs {
+		// Need manifest digest to delete: HEAD /manifests/<tag> gives Docker-Content-Digest
+		digest, err := s.headManifestDigest(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.deleteManifest(ctx, digest)
+	}
+
+	// the layer digests are only known from the manifest itself
+	man, digest, err := s.manifestOf(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.deleteManifest(ctx, digest); err != nil {
+		return nil, err
+	}
+	s.refs.drop(tag)
+
+	// the config blob is shared by every manifest and is left alone
+	layers := make([]string, len(man.Layers))
+	for i, layer := range man.Layers {
+		layers[i] = layer.Digest
+	}
+	return layers, nil
 }
 
 type tagsList struct {
 	Name string   `json:"name"`
 	Tags []string `json:"tags"`
+	Last string   `json:"last,omitempty"`
 }
 
+// tagsPageSize is the page size requested from /tags/list; registries are
+// free to return fewer entries per page.
+const tagsPageSize = 1000
+
 func (s *ociStore) listByPrefix(ctx context.Context, prefix string) ([]objects.MAC, error) {
-	// /v2/<name>/tags/list is spec'd but pagination is registry-dependent.
-	// good enough to start but will need pagination support.
-	rc, _, err := s.doRepoRC(ctx, "GET", "/tags/list", nil, nil)
+	tags, err := s.listTags(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rc.Close()
-
-	var tl tagsList
-	if err := json.NewDecoder(rc).Decode(&tl); err != nil {
-		return nil, err
-	}
 
-	var out []objects.MAC
-	for _, t := range tl.Tags {
+	out := []objects.MAC{}
+	for _, t := range tags {
 		if strings.HasPrefix(t, prefix) {
 			b, err := hex.DecodeString(strings.TrimPrefix(t, prefix))
 			if err != nil || len(b) != 32 {
@@ -293,6 +1381,94 @@ func (s *ociStore) listByPrefix(ctx context.Context, prefix string) ([]objects.M
 	return out, nil
 }
 
+// listTags returns every tag of the repository.
+func (s *ociStore) listTags(ctx context.Context) ([]string, error) {
+	var out []string
+	err := s.tagPages(ctx, func(tags []string) error {
+		out = append(out, tags...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// tagPages calls fn with each page of tags of the repository, following
+// the pagination of /v2/<name>/tags/list.  Pages are chained through the
+// Link header when present, or through a last= marker otherwise.
+func (s *ociStore) tagPages(ctx context.Context, fn func(tags []string) error) error {
+	next := s.baseURL(s.repoBase() + "/tags/list?n=" + strconv.Itoa(tagsPageSize))
+	seen := map[string]struct{}{}
+
+	for next != "" {
+		if _, ok := seen[next]; ok {
+			return fmt.Errorf("tags/list pagination loops on %s", redactURL(next))
+		}
+		seen[next] = struct{}{}
+
+		pageCtx, cancel := s.controlContext(ctx)
+		rc, resp, err := s.do(pageCtx, "GET", next, nil, nil)
+		if err != nil {
+			cancel()
+			// a repository nothing was pushed to yet is reported as
+			// NAME_UNKNOWN or a bare 404 by several registries
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		var tl tagsList
+		err = json.NewDecoder(rc).Decode(&tl)
+		drainAndClose(rc)
+		cancel()
+		if err != nil {
+			return err
+		}
+		// "tags": null is how empty repositories are listed
+		if tl.Tags == nil {
+			break
+		}
+		if err := fn(tl.Tags); err != nil {
+			return err
+		}
+
+		next = ""
+		if link := parseNextLink(resp.Header.Get("Link")); link != "" {
+			next, err = s.resolveLocation(resp, link)
+			if err != nil {
+				return err
+			}
+		} else if len(tl.Tags) > 0 && (tl.Last != "" || len(tl.Tags) == tagsPageSize) {
+			last := tl.Last
+			if last == "" {
+				last = tl.Tags[len(tl.Tags)-1]
+			}
+			next = s.baseURL(s.repoBase() + "/tags/list?n=" + strconv.Itoa(tagsPageSize) + "&last=" + url.QueryEscape(last))
+		}
+	}
+	return nil
+}
+
+// parseNextLink extracts the target of the rel="next" entry of an RFC 5988
+// Link header, e.g. `</v2/foo/tags/list?n=100&last=bar>; rel="next"`.
+func parseNextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(k, "rel") && strings.Trim(v, `"`) == "next" {
+				return target[1 : len(target)-1]
+			}
+		}
+	}
+	return ""
+}
+
 // ---- OCI HTTP primitives ----
 
 type descriptor struct {
@@ -306,6 +1482,20 @@ type ociManifest struct {
 	MediaType     string       `json:"mediaType"`
 	Config        descriptor   `json:"config"`
 	Layers        []descriptor `json:"layers"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// marshalManifest returns the manifest of the single payload layer with
+// the given annotations.
+func marshalManifest(layer descriptor, annotations map[string]string) ([]byte, error) {
+	return json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.manifest.v1+json",
+		Config:        emptyConfigDescriptor,
+		Layers:        []descriptor{layer},
+		Annotations:   annotations,
+	})
 }
 
 func (s *ociStore) baseURL(p string) string {
@@ -313,99 +1503,427 @@ func (s *ociStore) baseURL(p string) string {
 }
 
 func (s *ociStore) repoBase() string {
-	return s.repo
+	return escapeRepo(s.repo)
 }
 
+// doRepo performs a control request on the repository, bounded by
+// ControlTimeout, whose response body is not needed: it is drained and
+// closed before returning, so that the connection is reused, and the
+// response only carries the status and headers.  doRepoRC hands the body
+// over instead, and releases the deadline when it is closed.
 func (s *ociStore) doRepo(ctx context.Context, method, p string, body io.Reader, headers http.Header) (*http.Response, error) {
-	_, resp, err := s.do(ctx, method, s.baseURL(s.repoBase()+p), body, headers)
+	rc, resp, err := s.doRepoRC(ctx, method, p, body, headers)
+	drainAndClose(rc)
+	if resp != nil {
+		resp.Body = http.NoBody
+	}
 	return resp, err
 }
 
 func (s *ociStore) doRepoRC(ctx context.Context, method, p string, body io.Reader, headers http.Header) (io.ReadCloser, *http.Response, error) {
+	ctx, cancel := s.controlContext(ctx)
 	rc, resp, err := s.do(ctx, method, s.baseURL(s.repoBase()+p), body, headers)
-	return rc, resp, err
+	if err != nil {
+		cancel()
+		return nil, resp, err
+	}
+	rc = &cancelCloser{ReadCloser: rc, cancel: cancel}
+	resp.Body = rc
+	return rc, resp, nil
 }
 
-func (s *ociStore) doRepoBlobRC(ctx context.Context, digest string, headers http.Header) (io.ReadCloser, error) {
-	rc, _, err := s.do(ctx, "GET", s.baseURL(s.repoBase()+"/blobs/"+digest), nil, headers)
-	return rc, err
+// doRepoBlobRC GETs the blob digest, its body paced to the
+// download_bandwidth of the store.
+func (s *ociStore) doRepoBlobRC(ctx context.Context, digest string, headers http.Header) (io.ReadCloser, *http.Response, error) {
+	rc, resp, err := s.do(ctx, "GET", s.baseURL(s.repoBase()+"/blobs/"+url.PathEscape(digest)), nil, headers)
+	if err != nil {
+		return rc, resp, err
+	}
+	return s.throttleDownload(ctx, rc), resp, nil
+}
+
+// maxManifestSize bounds how much of a manifest body we are willing to
+// read, following the 4MiB limit recommended by the distribution spec.
+const maxManifestSize = 4 << 20
+
+const manifestAccept = "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"
+
+// fetchManifest GETs the manifest for ref and returns its raw bytes along
+// with their sha256 digest.  The digest is checked against the
+// Docker-Content-Digest header when present, and against ref itself when
+// ref is a digest.
+func (s *ociStore) fetchManifest(ctx context.Context, ref string) ([]byte, string, error) {
+	raw, _, digest, err := s.fetchManifestAs(ctx, ref, manifestAccept)
+	return raw, digest, err
+}
+
+// fetchManifestAs is fetchManifest accepting the given media types, and
+// also returns the media type the registry served.
+func (s *ociStore) fetchManifestAs(ctx context.Context, ref, accept string) ([]byte, string, string, error) {
+	h := http.Header{}
+	h.Set("Accept", accept)
+	rc, resp, err := s.doRepoRC(ctx, "GET", "/manifests/"+url.PathEscape(ref), nil, h)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer rc.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(rc, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("read manifest: %w", err)
+	}
+	if len(raw) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("manifest %s exceeds %d bytes", ref, maxManifestSize)
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+
+	sum := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	expected := resp.Header.Get("Docker-Content-Digest")
+	if expected == "" && strings.HasPrefix(ref, "sha256:") {
+		expected = ref
+	}
+	if expected != "" && strings.HasPrefix(expected, "sha256:") && expected != digest {
+		return nil, "", "", &DigestMismatchError{Ref: ref, Expected: expected, Actual: digest}
+	}
+	return raw, strings.TrimSpace(mediaType), digest, nil
 }
 
+// headManifestDigest returns the digest of the manifest ref points to.
+// Registries and proxies that strip Docker-Content-Digest from HEAD
+// responses are handled by GETting the manifest with the same Accept
+// header and hashing the raw bytes exactly as received: re-marshalling
+// the JSON would not yield the digest the registry knows it by.
 func (s *ociStore) headManifestDigest(ctx context.Context, ref string) (string, error) {
 	h := http.Header{}
-	h.Set("Accept", "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json")
-	resp, err := s.doRepo(ctx, "HEAD", "/manifests/"+ref, nil, h)
+	h.Set("Accept", manifestAccept)
+	resp, err := s.doRepo(ctx, "HEAD", "/manifests/"+url.PathEscape(ref), nil, h)
 	if err != nil {
 		return "", err
 	}
-	d := resp.Header.Get("Docker-Content-Digest")
-	if d == "" {
-		return "", fmt.Errorf("missing Docker-Content-Digest header on HEAD manifest")
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" {
+		return d, nil
+	}
+
+	slog.Debug("oci: HEAD manifest without Docker-Content-Digest, falling back to GET", "ref", ref)
+	_, d, err := s.fetchManifest(ctx, ref)
+	if err != nil {
+		return "", err
 	}
 	return d, nil
 }
+
 func (s *ociStore) uploadBlob(ctx context.Context, rd io.Reader) (digest string, size int64, err error) {
-	// POST start upload
-	resp, err := s.doRepo(ctx, "POST", "/blobs/uploads/", nil, nil)
+	uploadURL, err := s.startUpload(ctx)
 	if err != nil {
 		return "", 0, err
 	}
-	io.Copy(io.Discard, resp.Body)
-	resp.Body.Close()
+	return s.uploadToSession(ctx, uploadURL, rd)
+}
+
+// startUpload opens an upload session and returns its URL.
+func (s *ociStore) startUpload(ctx context.Context) (string, error) {
+	// POST start upload, expecting 202 with a Location
+	resp, err := s.doRepo(ctx, "POST", "/blobs/uploads/", nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("start upload: %w", err)
+	}
 
 	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusAccepted {
+		if loc == "" {
+			return "", fmt.Errorf("start upload: unexpected status %s without Location", resp.Status)
+		}
+		slog.Warn("oci: unexpected status on upload start", "status", resp.Status)
+	}
 	if loc == "" {
-		return "", 0, fmt.Errorf("registry missing Location on upload start")
+		return "", fmt.Errorf("start upload: registry missing Location")
+	}
+	uploadURL, err := s.resolveLocation(resp, loc)
+	if err != nil {
+		return "", fmt.Errorf("start upload: %w", err)
+	}
+	return uploadURL, nil
+}
+
+// uploadCleanupTimeout is the grace period given to cancelling an upload
+// session once the operation that opened it has failed or was cancelled.
+const uploadCleanupTimeout = 10 * time.Second
+
+// uploadToSession streams rd to an open upload session and commits it.
+// The session is cancelled if anything fails along the way, so it does
+// not linger against the registry quotas.
+func (s *ociStore) uploadToSession(ctx context.Context, uploadURL string, rd io.Reader) (digest string, size int64, err error) {
+	defer func() {
+		if err != nil {
+			s.cancelUpload(ctx, uploadURL)
+		}
+	}()
+
+	// registries that refuse streamed bodies need the exact length
+	// up-front, which requires spooling unless rd is seekable
+	if _, seekable := rd.(io.Seeker); !seekable && !s.cfg.UploadChunked &&
+		(s.cfg.RequireContentLength || s.lengthRequired.Load()) {
+		spooled, cleanup, err := spool(ctx, rd)
+		defer cleanup()
+		if err != nil {
+			return "", 0, fmt.Errorf("spool payload: %w", err)
+		}
+		rd = spooled
+	}
+
+	// the hasher is only returned to the pool once the upload succeeded,
+	// as the transport may still be reading the body of a failed PATCH
+	h := getHasher()
+	if s.cfg.UploadChunked {
+		uploadURL, size, err = s.patchChunks(ctx, uploadURL, rd, h)
+	} else {
+		uploadURL, size, err = s.patchStream(ctx, uploadURL, rd, h)
+	}
+	if errors.Is(err, errLengthRequired) {
+		s.lengthRequired.Store(true)
+		slog.Warn("oci: registry requires Content-Length, spooling further uploads")
 	}
-	uploadURL, err := s.resolveLocation(loc)
 	if err != nil {
 		return "", 0, err
 	}
 
-	// PATCH stream + hash
-	h := sha256.New()
-	tee := io.TeeReader(rd, h)
+	// Finalize with digest using the *latest* uploadURL
+	sum := h.Sum(nil)
+	putHasher(h)
+	digest = "sha256:" + fmt.Sprintf("%x", sum)
+
+	finalURL := uploadURL
+	if strings.Contains(finalURL, "?") {
+		finalURL += "&digest=" + url.QueryEscape(digest)
+	} else {
+		finalURL += "?digest=" + url.QueryEscape(digest)
+	}
+
+	rc3, resp3, err := s.do(ctx, "PUT", finalURL, nil, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("finalize upload: %w", err)
+	}
+	drainAndClose(rc3)
+
+	if d := resp3.Header.Get("Docker-Content-Digest"); d != "" && d != digest {
+		return "", 0, fmt.Errorf("finalize upload: %w", &DigestMismatchError{Ref: "blob upload", Expected: digest, Actual: d})
+	}
+
+	// anything but 201 may mean the upload was not committed, make sure
+	// the blob is there before declaring success
+	if resp3.StatusCode != http.StatusCreated {
+		slog.Warn("oci: unexpected status on upload finalize", "status", resp3.Status)
+		exists, err := s.blobExists(ctx, digest)
+		if err != nil {
+			return "", 0, fmt.Errorf("finalize upload: verify blob: %w", err)
+		}
+		if !exists {
+			return "", 0, fmt.Errorf("finalize upload: status %s but blob %s is missing", resp3.Status, digest)
+		}
+	}
+
+	return digest, size, nil
+}
 
+// patchStream sends the whole payload in a single streaming PATCH and
+// returns the updated session URL.
+func (s *ociStore) patchStream(ctx context.Context, uploadURL string, rd io.Reader, h hash.Hash) (string, int64, error) {
+	// PATCH stream + hash; a seekable payload stays seekable so the
+	// PATCH can be retried
 	patchHeaders := http.Header{}
 	patchHeaders.Set("Content-Type", "application/octet-stream")
 
-	rc, resp2, err := s.do(ctx, "PATCH", uploadURL, tee, patchHeaders)
+	counter := &countingReader{rd: io.TeeReader(rd, h)}
+	var body io.Reader = counter
+	written := func() int64 { return counter.n }
+	if rs, ok := rd.(io.ReadSeeker); ok {
+		if hr, err := newHashingReader(rs, h); err == nil {
+			body = hr
+			written = func() int64 { return hr.n }
+		}
+		if n, err := remaining(rs); err == nil {
+			patchHeaders.Set("Content-Length", strconv.FormatInt(n, 10))
+		}
+	}
+
+	rc, resp2, err := s.do(ctx, "PATCH", uploadURL, s.throttleUpload(ctx, body), patchHeaders)
+	if resp2 != nil && resp2.StatusCode == http.StatusLengthRequired {
+		return uploadURL, 0, fmt.Errorf("patch data: %w", errLengthRequired)
+	}
 	if err != nil {
-		return "", 0, err
+		return uploadURL, 0, fmt.Errorf("patch data: %w", err)
+	}
+	drainAndClose(rc)
+
+	if resp2.StatusCode != http.StatusAccepted {
+		slog.Warn("oci: unexpected status on upload patch", "status", resp2.Status)
 	}
-	io.Copy(io.Discard, rc)
-	rc.Close()
 
 	// IMPORTANT: many registries return an updated Location (updated _state)
 	if loc2 := resp2.Header.Get("Location"); loc2 != "" {
-		uploadURL, err = s.resolveLocation(loc2)
+		uploadURL, err = s.resolveLocation(resp2, loc2)
 		if err != nil {
-			return "", 0, err
+			return uploadURL, 0, fmt.Errorf("patch data: %w", err)
+		}
+	}
+
+	// the registry's view of the upload, when it shares it, must match
+	// what we sent
+	size := written()
+	if rng := resp2.Header.Get("Range"); rng != "" {
+		if got := s.parseUploadedSize(rng); size > 0 && got > 0 && got != size {
+			return uploadURL, 0, fmt.Errorf("patch data: registry received %d bytes, sent %d", got, size)
 		}
 	}
+	return uploadURL, size, nil
+}
 
-	// size from Range if present (optional)
-	size = s.parseUploadedSize(resp2.Header.Get("Range"))
+// pushBlob uploads rd unless the registry already holds it.  The
+// existence check needs the digest up-front, so it is only done when rd
+// is seekable and can be hashed then rewound; other readers are streamed
+// straight to uploadBlob.  fresh reports that the blob is known not to
+// have existed before, and thus is safe to delete if the write it is
+// part of fails.
+func (s *ociStore) pushBlob(ctx context.Context, rd io.Reader) (digest string, size int64, fresh bool, err error) {
+	rs, ok := rd.(io.ReadSeeker)
+	if !ok {
+		digest, size, err = s.uploadBlob(ctx, rd)
+		return digest, size, false, err
+	}
 
-	// Finalize with digest using the *latest* uploadURL
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		digest, size, err = s.uploadBlob(ctx, rd)
+		return digest, size, false, err
+	}
+	h := getHasher()
+	size, err = copyBuffer(h, rs)
 	sum := h.Sum(nil)
-	digest = "sha256:" + fmt.Sprintf("%x", sum)
+	putHasher(h)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return "", 0, false, err
+	}
 
-	finalURL := uploadURL
-	if strings.Contains(finalURL, "?") {
-		finalURL += "&digest=" + url.QueryEscape(digest)
+	digest = "sha256:" + hex.EncodeToString(sum)
+	if _, fresh, err = s.pushDigest(ctx, digest, rs); err != nil {
+		return "", 0, false, err
+	}
+	return digest, size, fresh, nil
+}
+
+// pushDigest uploads rd, the content of the blob digest, unless the
+// repository holds it already or it can be mounted from one of the
+// mount_from repositories.  uploaded reports that rd was uploaded, and
+// fresh that the blob is known not to have existed before.
+func (s *ociStore) pushDigest(ctx context.Context, digest string, rd io.Reader) (uploaded, fresh bool, err error) {
+	exists, err := s.blobExists(ctx, digest)
+	if err == nil && exists {
+		return false, false, nil
+	}
+	fresh = err == nil
+
+	mounted, uploadURL, err := s.mountBlob(ctx, digest)
+	if err != nil {
+		return false, false, err
+	}
+	if mounted {
+		return false, false, nil
+	}
+	var actual string
+	if uploadURL != "" {
+		actual, _, err = s.uploadToSession(ctx, uploadURL, rd)
 	} else {
-		finalURL += "?digest=" + url.QueryEscape(digest)
+		actual, _, err = s.uploadBlob(ctx, rd)
+	}
+	if err != nil {
+		return false, false, err
 	}
+	if actual != digest {
+		return false, false, &DigestMismatchError{Ref: "blob upload", Expected: digest, Actual: actual}
+	}
+	return true, fresh, nil
+}
+
+// mountBlob tries to link digest from one of the mount_from repositories
+// instead of uploading it.  A registry answering 202 to a mount request
+// for a blob known to exist in the source does not support mounting:
+// this is remembered so that later pushes skip the attempt, and the
+// session it opened is handed back for a regular upload.
+func (s *ociStore) mountBlob(ctx context.Context, digest string) (mounted bool, uploadURL string, err error) {
+	if s.mountUnsupported.Load() {
+		return false, "", nil
+	}
+	for _, from := range s.cfg.MountFrom {
+		rc, _, err := s.do(ctx, "HEAD", s.baseURL(escapeRepo(from)+"/blobs/"+url.PathEscape(digest)), nil, nil)
+		if err != nil {
+			continue
+		}
+		drainAndClose(rc)
+
+		q := url.Values{}
+		q.Set("mount", digest)
+		q.Set("from", from)
+		resp, err := s.doRepo(ctx, "POST", "/blobs/uploads/?"+q.Encode(), nil, nil)
+		if err != nil {
+			return false, "", fmt.Errorf("mount blob: %w", err)
+		}
+
+		if resp.StatusCode == http.StatusCreated {
+			return true, "", nil
+		}
+
+		slog.Debug("oci: registry does not support cross-repository mounts", "from", from)
+		s.mountUnsupported.Store(true)
+		if loc := resp.Header.Get("Location"); loc != "" {
+			uploadURL, err := s.resolveLocation(resp, loc)
+			if err != nil {
+				return false, "", fmt.Errorf("mount blob: %w", err)
+			}
+			return false, uploadURL, nil
+		}
+		return false, "", nil
+	}
+	return false, "", nil
+}
 
-	rc3, _, err := s.do(ctx, "PUT", finalURL, nil, nil)
+// cancelUpload deletes an upload session, best effort.  It runs on a
+// context detached from ctx so that it still happens after ctx is
+// cancelled.
+func (s *ociStore) cancelUpload(ctx context.Context, uploadURL string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), uploadCleanupTimeout)
+	defer cancel()
+
+	rc, _, err := s.doOnce(ctx, "DELETE", uploadURL, nil, nil)
 	if err != nil {
-		return "", 0, err
+		s.uploadCleanupFailures.Add(1)
+		slog.Debug("oci: failed to cancel upload session", "error", err)
+		return
 	}
-	io.Copy(io.Discard, rc3)
-	rc3.Close()
+	drainAndClose(rc)
+}
 
-	return digest, size, nil
+// UploadCleanupFailures returns how many abandoned upload sessions could
+// not be cancelled since the store was opened.
+func (s *ociStore) UploadCleanupFailures() int64 {
+	return s.uploadCleanupFailures.Load()
+}
+
+// blobExists checks whether the repository holds the blob with the given
+// digest.
+func (s *ociStore) blobExists(ctx context.Context, digest string) (bool, error) {
+	resp, err := s.doRepo(ctx, "HEAD", "/blobs/"+url.PathEscape(digest), nil, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (s *ociStore) parseUploadedSize(rng string) int64 {
@@ -422,23 +1940,86 @@ func (s *ociStore) parseUploadedSize(rng string) int64 {
 	return last + 1
 }
 
-func (s *ociStore) resolveLocation(loc string) (string, error) {
-	base, err := url.Parse(strings.TrimRight(s.base, "/")) // or s.location base
+// resolveLocation turns a Location or Link header of resp into a URL.
+// Absolute URLs, possibly on another host or scheme as returned by
+// CDN-fronted registries, are used as-is; relative ones are resolved
+// against the registry base, or against the URL of the request when it
+// went to another host, such as the blob store an upload was sent to.
+// resp may be nil for headers of the registry itself.
+func (s *ociStore) resolveLocation(resp *http.Response, loc string) (string, error) {
+	ref, err := url.Parse(loc)
 	if err != nil {
 		return "", err
 	}
-	ref, err := url.Parse(loc)
+	if ref.IsAbs() {
+		s.rewrite.url(ref)
+		return ref.String(), nil
+	}
+	if resp != nil && resp.Request != nil && !strings.EqualFold(resp.Request.URL.Host, s.host) {
+		return resp.Request.URL.ResolveReference(ref).String(), nil
+	}
+	base, err := url.Parse(s.base)
 	if err != nil {
 		return "", err
 	}
+	// a registry unaware of the reverse proxy in front of it returns
+	// /v2/ paths that miss the prefix it is mounted under
+	if s.basePath != "" && strings.HasPrefix(ref.Path, "/v2/") {
+		ref.Path = "/" + s.basePath + ref.Path
+		ref.RawPath = ""
+	}
 	return base.ResolveReference(ref).String(), nil
 }
 
+// do performs a request, retrying transient failures with exponential
+// backoff.  Idempotent requests are always retried; requests carrying a
+// body only when the body can be rewound.
 func (s *ociStore) do(ctx context.Context, method, fullURL string, body io.Reader, headers http.Header) (io.ReadCloser, *http.Response, error) {
+	rw, replayable := newRewinder(body)
+	switch method {
+	case "GET", "HEAD", "DELETE":
+	default:
+		if !replayable {
+			return s.doOnce(ctx, method, fullURL, body, headers)
+		}
+	}
+
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		rc, resp, err := s.doOnce(ctx, method, fullURL, body, headers)
+		if !isTransient(resp, err) {
+			return rc, resp, err
+		}
+
+		delay := backoff(attempt)
+		wait, throttled := retryAfter(resp, time.Now())
+		if throttled {
+			err = &retryAfterError{err: err, delay: wait}
+			delay = min(wait, s.cfg.RetryAfterMax)
+		}
+
+		if attempt >= s.cfg.RetryMax || time.Since(start)+delay > s.cfg.RetryMaxElapsed {
+			return rc, resp, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return rc, resp, err
+		}
+		if rw.rewind() != nil {
+			return rc, resp, err
+		}
+		if serr := sleepContext(ctx, delay); serr != nil {
+			return rc, resp, err
+		}
+	}
+}
+
+func (s *ociStore) doOnce(ctx context.Context, method, fullURL string, body io.Reader, headers http.Header) (io.ReadCloser, *http.Response, error) {
 	req, err := http.NewRequestWithContext(ctx, method, fullURL, body)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, redactError(err)
 	}
+	req.Header.Set("User-Agent", userAgent())
+	s.setExtraHeaders(req)
 	if headers != nil {
 		for k, vv := range headers {
 			for _, v := range vv {
@@ -446,30 +2027,84 @@ func (s *ociStore) do(ctx context.Context, method, fullURL string, body io.Reade
 			}
 		}
 	}
-	// Auth
-	/*
-		if s.cfg.BearerToken != "" {
-			req.Header.Set("Authorization", "Bearer "+s.cfg.BearerToken)
-		} else if s.cfg.Username != "" || s.cfg.Password != "" {
-			req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	// net/http ignores Content-Length in the header map, lift it onto
+	// the request for bodies it cannot size by itself
+	if cl := req.Header.Get("Content-Length"); cl != "" {
+		req.Header.Del("Content-Length")
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			req.ContentLength = n
 		}
-	*/
+	}
+	s.authorize(req)
 
-	resp, err := s.client.Do(req)
+	// the slot is held until the body is closed, HEAD has none to stream
+	release, err := s.inflight.acquire(ctx, method)
 	if err != nil {
 		return nil, nil, err
 	}
+	held := false
+	defer func() {
+		if !held {
+			release()
+		}
+	}()
+
+	// only the request counts, not the time its body takes to stream
+	if s.limiter != nil {
+		if err := s.limiter.wait(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, redactError(err)
+	}
+	s.checkRateLimit(resp)
+
+	// Answer a token challenge once, replaying the request if its body
+	// can be rewound.
+	if resp.StatusCode == http.StatusUnauthorized && s.cfg.BearerToken == "" && s.trustedHost(req.URL.Host) {
+		ch := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		if ch.scheme == "bearer" && (body == nil || req.GetBody != nil) {
+			drainAndClose(resp.Body)
+
+			if _, err := s.fetchToken(ctx, ch); err != nil {
+				return nil, nil, err
+			}
+			if req.GetBody != nil {
+				if req.Body, err = req.GetBody(); err != nil {
+					return nil, nil, err
+				}
+			}
+			s.authorize(req)
+			if s.limiter != nil {
+				if err := s.limiter.wait(ctx); err != nil {
+					return nil, nil, err
+				}
+			}
+			if resp, err = s.client.Do(req); err != nil {
+				return nil, nil, redactError(err)
+			}
+			s.checkRateLimit(resp)
+		}
+	}
 
 	// Minimal status handling
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		if resp.Body == nil {
 			return io.NopCloser(bytes.NewReader(nil)), resp, nil
 		}
-		return resp.Body, resp, nil
+		if method == "HEAD" {
+			return resp.Body, resp, nil
+		}
+		held = true
+		rc := &releaseCloser{ReadCloser: resp.Body, release: release}
+		resp.Body = rc
+		return rc, resp, nil
 	}
 
 	// Read small error body for debugging
 	defer resp.Body.Close()
 	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
-	return nil, resp, fmt.Errorf("oci %s %s: %s: %s", method, fullURL, resp.Status, strings.TrimSpace(string(b)))
+	return nil, resp, newRegistryError(method, fullURL, resp, b)
 }
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"sync"
+)
+
+// hasherPool holds the sha256 hashers of the blobs uploaded and verified,
+// which a backup writing many small states would otherwise allocate for
+// each of them.
+var hasherPool = sync.Pool{New: func() any { return sha256.New() }}
+
+func getHasher() hash.Hash {
+	return hasherPool.Get().(hash.Hash)
+}
+
+// putHasher returns h to the pool.  It must be called once h is known to
+// be written no more, which rules out hashers fed by a request body the
+// transport may still be reading.
+func putHasher(h hash.Hash) {
+	h.Reset()
+	hasherPool.Put(h)
+}
+
+// copyBufferSize is the size of the buffers io.Copy allocates.
+const copyBufferSize = 32 << 10
+
+var copyBufferPool = sync.Pool{New: func() any {
+	b := make([]byte, copyBufferSize)
+	return &b
+}}
+
+// copyBuffer is io.Copy with a buffer from the pool.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	b := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
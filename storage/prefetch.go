@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+	"golang.org/x/sync/errgroup"
+)
+
+// prefetchConcurrency is the number of manifests resolved in parallel by
+// GetMany and the prefetch of states.
+const prefetchConcurrency = 8
+
+// resolveEntry resolves the payload layer of tag and caches it.  Callers
+// resolving the same tag at once share a single manifest fetch, so that
+// a read racing the prefetch of its tag waits for it rather than
+// fetching the manifest again; the fetch outlives the cancellation of
+// the caller that started it, which the others may still be waiting on.
+func (s *ociStore) resolveEntry(ctx context.Context, tag string) (layerEntry, error) {
+	ch := s.resolving.DoChan(tag, func() (any, error) {
+		layer, digest, err := s.resolveLayer(context.WithoutCancel(ctx), tag)
+		if err != nil {
+			return layerEntry{}, err
+		}
+		entry := layerEntry{layer: layer, manifest: digest}
+		s.layers.set(tag, entry)
+		return entry, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(layerEntry), res.Err
+	case <-ctx.Done():
+		return layerEntry{}, ctx.Err()
+	}
+}
+
+// prefetch resolves the payload layer of the tags not cached yet,
+// prefetchConcurrency at a time, so that reading them afterwards costs a
+// blob fetch each.  Failures are only logged: the reads of those
+// tags resolve them again, mirrors included, and report the error.
+func (s *ociStore) prefetch(ctx context.Context, tags []string) map[string]layerEntry {
+	var (
+		mu      sync.Mutex
+		entries = map[string]layerEntry{}
+		pending []string
+	)
+	for _, tag := range tags {
+		if entry, ok := s.layers.get(tag); ok {
+			entries[tag] = entry
+		} else {
+			pending = append(pending, tag)
+		}
+	}
+
+	var g errgroup.Group
+	g.SetLimit(prefetchConcurrency)
+	for _, tag := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			entry, err := s.resolveEntry(ctx, tag)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					slog.Debug("oci: prefetch failed", "tag", tag, "error", err)
+				}
+				return nil
+			}
+			mu.Lock()
+			entries[tag] = entry
+			mu.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+	return entries
+}
+
+// GetMany returns the content of many resources, in the order of macs.
+// The manifests of the resources are resolved in parallel up front,
+// while their blobs are only fetched as each reader is first read, so
+// that reading them in turn costs a single round trip each rather than
+// two; opening a repository, which reads every state, is the case in
+// point.  The readers must all be closed, read or not.
+func (s *ociStore) GetMany(ctx context.Context, res storage.StorageResource, macs []objects.MAC) ([]io.ReadCloser, error) {
+	prefix, err := readPrefix(res)
+	if err != nil {
+		return nil, err
+	}
+	r := s.storeFor(res)
+
+	tags := make([]string, len(macs))
+	for i, mac := range macs {
+		tags[i] = fmt.Sprintf("%s%x", prefix, mac)
+	}
+	entries := r.prefetch(ctx, tags)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]io.ReadCloser, len(tags))
+	for i, tag := range tags {
+		entry, ok := entries[tag]
+		out[i] = &lazyReader{open: func() (io.ReadCloser, error) {
+			if ok {
+				if rc, err := r.getLayer(ctx, entry, nil); !errors.Is(err, fs.ErrNotExist) {
+					return rc, err
+				}
+				r.layers.remove(tag)
+			}
+			return r.getByTag(ctx, tag, nil)
+		}}
+	}
+	return out, nil
+}
+
+// lazyReader opens its content on its first read.
+type lazyReader struct {
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser
+	err  error
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.rc == nil && l.err == nil {
+		l.rc, l.err = l.open()
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+	return l.rc.Read(p)
+}
+
+func (l *lazyReader) Close() error {
+	if l.rc == nil {
+		l.err = fs.ErrClosed
+		return nil
+	}
+	return l.rc.Close()
+}
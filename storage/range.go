@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+)
+
+// ErrRangeNotSatisfiable is returned when the requested range lies
+// outside of the blob.
+var ErrRangeNotSatisfiable = errors.New("oci: requested range not satisfiable")
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// rangeHeader returns the value of the Range header requesting rg.  A
+// zero length means "from offset to the end of the blob".  storage.Range
+// cannot express suffix reads (the last N bytes), so none are generated.
+func rangeHeader(rg *storage.Range) string {
+	if rg.Length == 0 {
+		return fmt.Sprintf("bytes=%d-", rg.Offset)
+	}
+	end := rg.Offset + uint64(rg.Length) - 1
+	return fmt.Sprintf("bytes=%d-%d", rg.Offset, end)
+}
+
+// parseContentRange parses a "bytes <start>-<end>/<total>" header; total
+// is -1 when the registry sends "*".
+func parseContentRange(v string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(v), "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", v)
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", v)
+		}
+	}
+	return start, end, total, nil
+}
+
+// checkRange makes sure the body of a ranged blob GET holds exactly the
+// requested bytes.  A 206 must announce the requested range, while a 200
+// means the Range header was ignored and the range is then cut out of the
+// full body client-side.
+func checkRange(rg *storage.Range, resp *http.Response, body io.ReadCloser) (io.ReadCloser, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		mismatch := uint64(start) != rg.Offset
+		if rg.Length == 0 {
+			mismatch = mismatch || (total >= 0 && end != total-1)
+		} else {
+			mismatch = mismatch || end-start+1 != int64(rg.Length)
+		}
+		if mismatch {
+			body.Close()
+			return nil, fmt.Errorf("registry returned range %d-%d, requested %s",
+				start, end, strings.TrimPrefix(rangeHeader(rg), "bytes="))
+		}
+		return body, nil
+
+	case http.StatusOK:
+		// as a registry honouring the range would, refuse an offset at
+		// the end of the blob rather than return nothing
+		if resp.ContentLength >= 0 && rg.Offset >= uint64(resp.ContentLength) {
+			body.Close()
+			return nil, ErrRangeNotSatisfiable
+		}
+		if _, err := io.CopyN(io.Discard, body, int64(rg.Offset)); err != nil {
+			body.Close()
+			if errors.Is(err, io.EOF) {
+				return nil, ErrRangeNotSatisfiable
+			}
+			return nil, err
+		}
+		if rg.Length == 0 {
+			return body, nil
+		}
+		return &readCloser{Reader: io.LimitReader(body, int64(rg.Length)), Closer: body}, nil
+
+	default:
+		body.Close()
+		return nil, fmt.Errorf("unexpected status %s for ranged request", resp.Status)
+	}
+}
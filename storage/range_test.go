@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestGetRange(t *testing.T) {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	tests := []struct {
+		name   string
+		rg     storage.Range
+		header string
+		want   []byte
+		// wantErr is ErrRangeNotSatisfiable or any error when set to
+		// errAny
+		wantErr error
+	}{
+		{name: "offset and length", rg: storage.Range{Offset: 10, Length: 20}, header: "bytes=10-29", want: payload[10:30]},
+		{name: "first byte", rg: storage.Range{Offset: 0, Length: 1}, header: "bytes=0-0", want: payload[:1]},
+		{name: "last byte", rg: storage.Range{Offset: 99, Length: 1}, header: "bytes=99-99", want: payload[99:]},
+		{name: "open ended", rg: storage.Range{Offset: 10}, header: "bytes=10-", want: payload[10:]},
+		{name: "open ended from start", rg: storage.Range{}, header: "bytes=0-", want: payload},
+		{name: "open ended last byte", rg: storage.Range{Offset: 99}, header: "bytes=99-", want: payload[99:]},
+		{name: "offset past the end", rg: storage.Range{Offset: 100, Length: 10}, header: "bytes=100-109", wantErr: ErrRangeNotSatisfiable},
+		{name: "open ended past the end", rg: storage.Range{Offset: 100}, header: "bytes=100-", wantErr: ErrRangeNotSatisfiable},
+		{name: "length past the end", rg: storage.Range{Offset: 90, Length: 20}, header: "bytes=90-109", wantErr: errAny},
+	}
+
+	for _, ignored := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if ignored {
+				name += " range ignored"
+				if tt.name == "length past the end" {
+					// cut client-side, the short read is the caller's
+					// to notice
+					continue
+				}
+			}
+			t.Run(name, func(t *testing.T) {
+				f := newFakeRegistry()
+				if ignored {
+					f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+						r.Header.Del("Range")
+						return false
+					}
+				}
+				s := openFake(t, f.start(t))
+				mac := objects.MAC{1}
+				ctx := context.Background()
+				if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader(payload)); err != nil {
+					t.Fatal(err)
+				}
+				f.reset()
+
+				rg := tt.rg
+				rc, err := s.Get(ctx, storage.StorageResourcePackfile, mac, &rg)
+				if got := blobRange(f); got != tt.header {
+					t.Fatalf("Range header %q, want %q", got, tt.header)
+				}
+				if tt.wantErr != nil {
+					if err == nil {
+						rc.Close()
+						t.Fatal("no error")
+					}
+					if tt.wantErr != errAny && !errors.Is(err, tt.wantErr) {
+						t.Fatalf("error %v, want %v", err, tt.wantErr)
+					}
+					return
+				}
+				if got := readAll(t, rc, err); !bytes.Equal(got, tt.want) {
+					t.Fatalf("read %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// errAny stands for any error in test tables.
+var errAny = errors.New("any error")
+
+// blobRange returns the Range header of the blob GET logged by f.
+func blobRange(f *fakeRegistry) string {
+	for _, r := range f.logged() {
+		if r.method == http.MethodGet && strings.Contains(r.path, "/blobs/sha256:") {
+			return r.header.Get("Range")
+		}
+	}
+	return ""
+}
+
+func TestGetRangeMismatch(t *testing.T) {
+	f := newFakeRegistry()
+	s := openFake(t, f.start(t))
+	mac := objects.MAC{1}
+	ctx := context.Background()
+	if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader(make([]byte, 100))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a registry answering another range than the one requested
+	f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Range") == "" {
+			return false
+		}
+		w.Header().Set("Content-Range", "bytes 0-19/100")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(make([]byte, 20))
+		return true
+	}
+	_, err := s.Get(ctx, storage.StorageResourcePackfile, mac, &storage.Range{Offset: 10, Length: 20})
+	if err == nil || !strings.Contains(err.Error(), "registry returned range 0-19, requested 10-29") {
+		t.Fatalf("error %v, want a range mismatch", err)
+	}
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket refilled at rate tokens per second and
+// holding at most burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes a token, sleeping until one is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	return b.take(ctx, 1)
+}
+
+// take takes n tokens, sleeping until they are available or ctx is done.
+// More tokens than the bucket holds may be taken at once, the wait then
+// lasts until they would have been refilled.
+func (b *tokenBucket) take(ctx context.Context, n float64) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	// the tokens are already taken, give them back if we never wait it out
+	if err := sleepContext(ctx, time.Duration(deficit/b.rate*float64(time.Second))); err != nil {
+		b.mu.Lock()
+		b.tokens += n
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// throttleSlice is the most a throttled body reads at once, so that the
+// bandwidth is spread evenly rather than spent in bursts.
+const throttleSlice = 32 << 10
+
+// throttledReader paces the reads of a request or response body to the
+// bandwidth of its bucket, one token per byte.  Only the transfer of the
+// body is paced: the response header timeout runs once a request body is
+// sent and until the response headers arrive, and a connection being
+// read or written is not idle, so neither is tripped by the pacing.
+type throttledReader struct {
+	ctx    context.Context
+	rd     io.Reader
+	bucket *tokenBucket
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleSlice {
+		p = p[:throttleSlice]
+	}
+	n, err := r.rd.Read(p)
+	if n > 0 {
+		if werr := r.bucket.take(r.ctx, float64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttledSeeker is a throttledReader over a seekable body, which stays
+// seekable for the request to be retried.
+type throttledSeeker struct {
+	*throttledReader
+}
+
+func (r *throttledSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.rd.(io.Seeker).Seek(offset, whence)
+}
+
+// throttleUpload paces body to the upload_bandwidth of the store, if
+// any.
+func (s *ociStore) throttleUpload(ctx context.Context, body io.Reader) io.Reader {
+	if s.uploadBandwidth == nil {
+		return body
+	}
+	r := &throttledReader{ctx: ctx, rd: body, bucket: s.uploadBandwidth}
+	if _, ok := body.(io.Seeker); ok {
+		return &throttledSeeker{r}
+	}
+	return r
+}
+
+// throttleDownload paces the response body rc to the download_bandwidth
+// of the store, if any.
+func (s *ociStore) throttleDownload(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if s.downloadBandwidth == nil {
+		return rc
+	}
+	return &readCloser{Reader: &throttledReader{ctx: ctx, rd: rc, bucket: s.downloadBandwidth}, Closer: rc}
+}
+
+// rateLimitWarnInterval bounds how often a dwindling registry rate limit
+// is reported.
+const rateLimitWarnInterval = time.Minute
+
+// rateLimitWarnRatio is the fraction of the registry rate limit left
+// below which a warning is logged.
+const rateLimitWarnRatio = 0.1
+
+// RateLimit is the quota of requests announced by a registry through the
+// RateLimit-Limit and RateLimit-Remaining headers, as Docker Hub does.
+// Limit and Window are zero when the registry does not tell them.
+type RateLimit struct {
+	Remaining int64
+	Limit     int64
+	Window    time.Duration
+}
+
+// quota is the rate limit last announced by the registry, shared by the
+// repositories reached through the same store.
+type quota struct {
+	mu    sync.Mutex
+	limit RateLimit
+	known bool
+}
+
+func (q *quota) set(limit RateLimit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit, q.known = limit, true
+}
+
+func (q *quota) get() (RateLimit, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit, q.known
+}
+
+// checkRateLimit records the quota announced by the registry, and warns
+// when it runs low.
+func (s *ociStore) checkRateLimit(resp *http.Response) {
+	remaining, window, ok := parseRateLimit(resp.Header.Get("RateLimit-Remaining"))
+	if !ok {
+		return
+	}
+	limit, lwindow, ok := parseRateLimit(resp.Header.Get("RateLimit-Limit"))
+	rl := RateLimit{Remaining: remaining, Window: max(window, lwindow)}
+	if ok {
+		rl.Limit = limit
+	}
+	s.quota.set(rl)
+	if ok && float64(remaining) >= float64(limit)*rateLimitWarnRatio {
+		return
+	}
+	if !ok && remaining >= 10 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := s.rateLimitWarned.Load()
+	if now-last < int64(rateLimitWarnInterval) || !s.rateLimitWarned.CompareAndSwap(last, now) {
+		return
+	}
+	slog.Warn("oci: registry rate limit almost exhausted", "registry", s.base, "remaining", remaining, "limit", resp.Header.Get("RateLimit-Limit"))
+}
+
+// parseRateLimit parses a RateLimit header value such as "76;w=21600",
+// along with its window if any.
+func parseRateLimit(v string) (int64, time.Duration, bool) {
+	v, params, _ := strings.Cut(v, ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || v == "" {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if secs, err := strconv.ParseInt(value, 10, 64); key == "w" && err == nil && secs > 0 {
+			window = time.Duration(secs) * time.Second
+		}
+	}
+	return n, window, true
+}
+
+// RateLimited reports whether err is a registry refusing a request for
+// exceeding its rate limit, along with how long it asked to wait through
+// Retry-After, zero if it did not tell.
+func RateLimited(err error) (time.Duration, bool) {
+	if !errors.Is(err, ErrTooManyRequests) {
+		return 0, false
+	}
+	var rerr *retryAfterError
+	if errors.As(err, &rerr) {
+		return rerr.delay, true
+	}
+	return 0, true
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Registry is a repository of a registry reached through the transport
+// of a store, with its authentication, retries, proxies and TLS settings,
+// for the importer and exporter which work on OCI images rather than on
+// kloset resources.
+type Registry struct {
+	s *ociStore
+}
+
+// Schemes returns the location schemes of the store, which the importer
+// and exporter accept too.
+func Schemes() []string {
+	return slices.Clone(schemes)
+}
+
+// NewRegistry configures a Registry from the same options as the store.
+// The location names a repository, without tag or digest, or the
+// registry alone: its repositories are then listed with Catalog and
+// reached with Repository.
+func NewRegistry(ctx context.Context, name string, config map[string]string) (*Registry, error) {
+	s, err := newStore(ctx, config, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{s: s}, nil
+}
+
+// Name is the name of the repository, empty when the location names the
+// registry alone.
+func (r *Registry) Name() string {
+	return r.s.repo
+}
+
+// Repository returns the repository name of the registry, as listed by
+// Catalog, sharing the transport and credentials of r.
+func (r *Registry) Repository(name string) (*Registry, error) {
+	if err := validateRepo(name); err != nil {
+		return nil, err
+	}
+	return &Registry{s: r.s.withRepo(name)}, nil
+}
+
+// RateLimit returns the quota of requests the registry announced last,
+// if it announces any.
+func (r *Registry) RateLimit() (RateLimit, bool) {
+	return r.s.quota.get()
+}
+
+// Catalog calls fn with each page of repositories of the registry, as
+// listed by the _catalog endpoint.  Most hosted registries disable it,
+// which is reported as ErrCatalogUnsupported.
+func (r *Registry) Catalog(ctx context.Context, fn func(repos []string) error) error {
+	return r.s.catalogPages(ctx, fn)
+}
+
+// Origin is the registry host, or socket path, as given in the location.
+func (r *Registry) Origin() string {
+	return r.s.Origin()
+}
+
+// Root is the path of the repository on the registry.
+func (r *Registry) Root() string {
+	return r.s.Root()
+}
+
+// Location is the location of the repository, without credentials.
+func (r *Registry) Location(ctx context.Context) (string, error) {
+	return r.s.Location(ctx)
+}
+
+// Ping checks that the repository may be read, or that the repositories
+// of the registry may be listed.
+func (r *Registry) Ping(ctx context.Context) error {
+	if r.s.repo == "" {
+		return r.s.catalogPages(ctx, func([]string) error {
+			return errStopCatalog
+		})
+	}
+	return r.s.pingRepo(ctx)
+}
+
+// Tags calls fn with each page of tags of the repository, as returned by
+// the registry, stopping at the first error fn returns.  A repository
+// that does not exist yet has no tags.
+func (r *Registry) Tags(ctx context.Context, fn func(tags []string) error) error {
+	return r.s.tagPages(ctx, fn)
+}
+
+// Manifest fetches the manifest ref, a tag or a digest, accepting the
+// given comma-separated media types, and returns its raw bytes along with
+// its media type and digest.  The content is checked against the digest
+// announced by the registry, and against ref when it is a digest.
+func (r *Registry) Manifest(ctx context.Context, ref, accept string) ([]byte, string, string, error) {
+	return r.s.fetchManifestAs(ctx, ref, accept)
+}
+
+// Referrers fetches the image index listing the manifests whose subject
+// is digest, through the referrers API of OCI distribution 1.1.  A
+// registry without the API answers 404, matching fs.ErrNotExist: clients
+// then fall back to the sha256-<hex> tag schema.
+func (r *Registry) Referrers(ctx context.Context, digest string) ([]byte, error) {
+	h := http.Header{}
+	h.Set("Accept", "application/vnd.oci.image.index.v1+json")
+	rc, _, err := r.s.doRepoRC(ctx, "GET", "/referrers/"+url.PathEscape(digest), nil, h)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(io.LimitReader(rc, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read referrers: %w", err)
+	}
+	if len(raw) > maxManifestSize {
+		return nil, fmt.Errorf("referrers of %s exceed %d bytes", digest, maxManifestSize)
+	}
+	return raw, nil
+}
+
+// Close releases the registry.
+func (r *Registry) Close(ctx context.Context) error {
+	return r.s.Close(ctx)
+}
+
+// Blob fetches the blob digest.  The content is checked against the
+// digest as it is read: the final Read fails with a DigestMismatchError
+// when they differ.
+func (r *Registry) Blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("oci: unsupported digest %q", digest)
+	}
+	rc, _, err := r.s.doRepoBlobRC(ctx, digest, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifyingReader(rc, digest)
+}
+
+// HasBlob reports whether the repository holds the blob digest, with a
+// HEAD request.
+func (r *Registry) HasBlob(ctx context.Context, digest string) (bool, error) {
+	return r.s.blobExists(ctx, digest)
+}
+
+// CanPush checks that the credentials in use may push to the repository,
+// with the push probe of the store: an upload session opened and
+// cancelled straight away.  A refusal is reported as ErrDenied.
+func (r *Registry) CanPush(ctx context.Context) error {
+	if r.s.cfg.ReadOnly {
+		return fmt.Errorf("%w: read_only is set", ErrDenied)
+	}
+	if err := r.s.probePush(ctx); err != nil {
+		return fmt.Errorf("push probe: %w", err)
+	}
+	if r.s.pushDenied.Load() {
+		return fmt.Errorf("%w: no push permission on %s", ErrDenied, r.Root())
+	}
+	return nil
+}
+
+// PushBlob uploads rd, the content of the blob digest, and reports
+// whether it was uploaded: a blob the repository holds already, as a HEAD
+// request tells, is not, nor one mounted from the mount_from
+// repositories of the same registry.  The content uploaded is checked
+// against digest.
+func (r *Registry) PushBlob(ctx context.Context, digest string, rd io.Reader) (bool, error) {
+	uploaded, _, err := r.s.pushDigest(ctx, digest, rd)
+	return uploaded, err
+}
+
+// PushManifest puts the manifest raw, of the given media type, under ref,
+// a tag or its digest, and returns its digest.  raw is sent as it is, so
+// that the manifest keeps the digest it was read under.
+func (r *Registry) PushManifest(ctx context.Context, ref, mediaType string, raw []byte) (string, error) {
+	h := http.Header{}
+	h.Set("Content-Type", mediaType)
+	resp, err := r.s.doRepo(ctx, "PUT", "/manifests/"+url.PathEscape(ref), bytes.NewReader(raw), h)
+	if err != nil {
+		return "", fmt.Errorf("put manifest %s: %w", ref, err)
+	}
+
+	sum := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d != digest {
+		return "", fmt.Errorf("put manifest %s: %w", ref, &DigestMismatchError{Ref: ref, Expected: digest, Actual: d})
+	}
+	return digest, nil
+}
+
+// NewVerifyingReader checks the content of rc against digest as it is
+// read, like the blobs returned by Blob, for blobs read from elsewhere.
+func NewVerifyingReader(rc io.ReadCloser, digest string) (io.ReadCloser, error) {
+	algo, expected, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" {
+		return nil, fmt.Errorf("oci: unsupported digest %q", digest)
+	}
+	return &verifyingReader{rc: rc, h: getHasher(), ref: digest, expected: expected}, nil
+}
+
+// Retry calls fn again when it fails with a network error, such as a
+// connection dropped while a blob is read, which the store cannot retry
+// by itself once the response is handed over.  It follows the retry
+// policy of the store: retry_max attempts within retry_max_elapsed.
+func (r *Registry) Retry(ctx context.Context, fn func() error) error {
+	return r.s.retryRead(ctx, fn)
+}
+
+// retryRead implements Registry.Retry.
+func (s *ociStore) retryRead(ctx context.Context, fn func() error) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !readTransient(err) {
+			return err
+		}
+		delay := backoff(attempt)
+		if attempt >= s.cfg.RetryMax || time.Since(start)+delay > s.cfg.RetryMaxElapsed {
+			return err
+		}
+		if serr := sleepContext(ctx, delay); serr != nil {
+			return err
+		}
+	}
+}
+
+// readTransient reports whether err, met while reading a response, is a
+// network failure worth another attempt.
+func readTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var nerr net.Error
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &nerr)
+}
+
+// verifyingReader hashes a blob as it is read and checks it once read
+// to the end, when its hasher goes back to the pool.
+type verifyingReader struct {
+	rc       io.ReadCloser
+	h        hash.Hash
+	ref      string
+	expected string
+
+	// done is the outcome of the check, returned by the reads past it
+	done error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.h == nil {
+		return 0, v.done
+	}
+	n, err := v.rc.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		actual := hex.EncodeToString(v.h.Sum(nil))
+		putHasher(v.h)
+		v.h = nil
+		v.done = io.EOF
+		if actual != v.expected {
+			v.done = &DigestMismatchError{Ref: v.ref, Expected: v.ref, Actual: "sha256:" + actual}
+		}
+		return n, v.done
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.rc.Close()
+}
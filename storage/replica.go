@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplicaConcurrency = 4
+	defaultReplicaQueueSize   = 1024
+
+	// replicaAttempts is how many times a replication is tried before it
+	// is given up and reported by Close.
+	replicaAttempts = 5
+)
+
+// replicaJob copies a tag from src to the replica, or deletes it there.
+type replicaJob struct {
+	src    *ociStore
+	tag    string
+	delete bool
+}
+
+// replicator mirrors writes to a secondary registry in the background.
+// Jobs go through a bounded queue, so writers are slowed down rather than
+// piling up work when the replica lags behind.
+type replicator struct {
+	dst   *ociStore
+	queue chan replicaJob
+	wg    sync.WaitGroup
+
+	// stop is closed by close, which then closes queue once no enqueue
+	// holds sendMu: jobs scheduled from then on are reported as failed
+	stop      chan struct{}
+	sendMu    sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	failed []error
+}
+
+// replicate schedules the replication of a write of tag, held by src, if
+// a replica is configured.
+func (s *ociStore) replicate(ctx context.Context, src *ociStore, tag string, delete bool) {
+	if s.replica != nil {
+		s.replica.enqueue(ctx, replicaJob{src: src, tag: tag, delete: delete})
+	}
+}
+
+func newReplicator(dst *ociStore, concurrency, queueSize int) *replicator {
+	rp := &replicator{
+		dst:   dst,
+		queue: make(chan replicaJob, queueSize),
+		stop:  make(chan struct{}),
+	}
+	for range concurrency {
+		rp.wg.Add(1)
+		go func() {
+			defer rp.wg.Done()
+			for job := range rp.queue {
+				rp.replicate(job)
+			}
+		}()
+	}
+	return rp
+}
+
+// errReplicatorClosed fails the jobs scheduled once the store is closed.
+var errReplicatorClosed = errors.New("replicator closed")
+
+// enqueue schedules job, waiting for room in the queue.
+func (rp *replicator) enqueue(ctx context.Context, job replicaJob) {
+	rp.sendMu.RLock()
+	defer rp.sendMu.RUnlock()
+	if rp.closed {
+		rp.fail(job, errReplicatorClosed)
+		return
+	}
+	select {
+	case rp.queue <- job:
+	case <-ctx.Done():
+		rp.fail(job, ctx.Err())
+	case <-rp.stop:
+		rp.fail(job, errReplicatorClosed)
+	}
+}
+
+// replicate runs job until it succeeds or runs out of attempts.  Jobs
+// are detached from the request that scheduled them.
+func (rp *replicator) replicate(job replicaJob) {
+	ctx := context.Background()
+
+	var err error
+	for attempt := range replicaAttempts {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt - 1))
+		}
+		if err = rp.run(ctx, job); err == nil {
+			return
+		}
+		slog.Debug("oci: replication failed", "tag", job.tag, "delete", job.delete, "attempt", attempt+1, "error", err)
+	}
+	rp.fail(job, err)
+}
+
+func (rp *replicator) run(ctx context.Context, job replicaJob) error {
+	if job.delete {
+		err := rp.dst.deleteByTag(ctx, job.tag)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// the payload is read back from the primary rather than kept around
+	// until the replica is written
+	rc, err := job.src.getByTag(ctx, job.tag, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		// deleted since, the deletion will be replicated as well
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = rp.dst.putByTag(ctx, job.tag, rc, nil)
+	return err
+}
+
+func (rp *replicator) fail(job replicaJob, err error) {
+	op := "put"
+	if job.delete {
+		op = "delete"
+	}
+	slog.Warn("oci: giving up replicating", "op", op, "tag", job.tag, "replica", rp.dst.base, "error", err)
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.failed = append(rp.failed, fmt.Errorf("%s %s: %w", op, job.tag, err))
+}
+
+// close waits for the queue to drain and reports what could not be
+// replicated.  If ctx ends first, the jobs still queued are reported as
+// pending.
+func (rp *replicator) close(ctx context.Context) error {
+	rp.closeOnce.Do(func() {
+		close(rp.stop)
+		rp.sendMu.Lock()
+		rp.closed = true
+		close(rp.queue)
+		rp.sendMu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		rp.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("oci: replication to %s interrupted with %d writes pending: %w", rp.dst.base, len(rp.queue), ctx.Err())
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if len(rp.failed) > 0 {
+		return fmt.Errorf("oci: %d writes could not be replicated to %s: %w", len(rp.failed), rp.dst.base, errors.Join(rp.failed...))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestReplicaWriteAfterClose(t *testing.T) {
+	f, replica := newFakeRegistry(), newFakeRegistry()
+	s := openFake(t, f.start(t), "replica_location", "oci+http://"+replica.start(t)+"/repo")
+	ctx := context.Background()
+
+	if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("before"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := replica.tagged("repo", fmt.Sprintf("state-%x", objects.MAC{1})); !ok {
+		t.Fatal("state written before Close not replicated")
+	}
+
+	// writes racing Close, and after it, must not panic
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Put(ctx, storage.StorageResourceState, objects.MAC{2, byte(i)}, bytes.NewReader([]byte("after")))
+		}()
+	}
+	s.Close(ctx)
+	wg.Wait()
+
+	err := s.Close(ctx)
+	if !errors.Is(err, errReplicatorClosed) {
+		t.Fatalf("error %v, want the writes after Close reported", err)
+	}
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"slices"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+)
+
+// resourceRepoOptions name the options routing a resource to its own
+// repository of the registry.
+var resourceRepoOptions = map[storage.StorageResource]string{
+	storage.StorageResourcePackfile: "packfiles_repo",
+	storage.StorageResourceState:    "state_repo",
+	storage.StorageResourceLock:     "locks_repo",
+}
+
+// withRepo returns a store addressing another repository of the same
+// registry, sharing the client and credentials of s.
+func (s *ociStore) withRepo(repo string) *ociStore {
+	var mirrors []*ociStore
+	for _, m := range s.mirrors {
+		mirrors = append(mirrors, m.withRepo(repo))
+	}
+	return &ociStore{
+		client:   s.client,
+		base:     s.base,
+		basePath: s.basePath,
+		scheme:   s.scheme,
+		socket:   s.socket,
+		proxy:    s.proxy,
+		host:     s.host,
+		repo:     repo,
+		cfg:      s.cfg,
+		auth:     s.auth,
+		limiter:  s.limiter,
+		inflight: s.inflight,
+		quota:    s.quota,
+		rewrite:  s.rewrite,
+		mirrors:  mirrors,
+		fetcher:  s.fetcher,
+		layers:   newLayerCache(s.cfg.LayerCacheSize),
+		blobs:    s.blobs,
+
+		uploadBandwidth:   s.uploadBandwidth,
+		downloadBandwidth: s.downloadBandwidth,
+	}
+}
+
+// storeFor returns the store holding res: the one of its dedicated
+// repository if configured, s otherwise.
+func (s *ociStore) storeFor(res storage.StorageResource) *ociStore {
+	if r, ok := s.repos[res]; ok {
+		return r
+	}
+	return s
+}
+
+// stores returns s followed by each distinct per-resource store.
+func (s *ociStore) stores() []*ociStore {
+	out := []*ociStore{s}
+	for _, res := range []storage.StorageResource{
+		storage.StorageResourcePackfile,
+		storage.StorageResourceState,
+		storage.StorageResourceLock,
+	} {
+		if r, ok := s.repos[res]; ok && !slices.Contains(out, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
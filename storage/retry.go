@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryMax        = 5
+	defaultRetryMaxElapsed = 2 * time.Minute
+	defaultRetryAfterMax   = 5 * time.Minute
+
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+const (
+	defaultConnectTimeout        = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultControlTimeout        = time.Minute
+
+	// the transport default of two idle connections per host would
+	// serialize parallel transfers, while unbounded connections trip
+	// per-client limits of registries
+	defaultMaxConnsPerHost     = 16
+	defaultMaxIdleConnsPerHost = 8
+)
+
+// controlContext bounds a control request by ControlTimeout, zero
+// meaning no bound.
+func (s *ociStore) controlContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cfg.ControlTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.cfg.ControlTimeout)
+}
+
+// cancelCloser releases the context of a request when its body is
+// closed.
+type cancelCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// maxDrain bounds how much of a body is read only for its connection to
+// be reused: past it, a new connection is cheaper.
+const maxDrain = 256 << 10
+
+// drainAndClose reads what is left of a response body and closes it, so
+// that the connection it came on goes back to the pool rather than being
+// torn down.
+func drainAndClose(rc io.ReadCloser) {
+	if rc == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(rc, maxDrain))
+	rc.Close()
+}
+
+// isTransient reports whether a failed request is worth retrying: network
+// errors and the statuses registries use when overloaded.
+func isTransient(resp *http.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if resp == nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before retry number attempt (starting at 0),
+// an exponential with full jitter.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << attempt
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+// retryAfter returns the delay requested by the Retry-After header of a
+// 429 or 503 response, in either delta-seconds or HTTP-date form.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retryAfterError decorates the last error of an exhausted retry loop
+// with the delay the registry asked for.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v (registry asked to retry after %s)", e.err, e.delay.Round(time.Second))
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// rewinder records the initial offset of a seekable request body so it
+// can be replayed on retry.
+type rewinder struct {
+	seeker io.Seeker
+	offset int64
+}
+
+// newRewinder returns a rewinder for body, or nil if body cannot be
+// replayed.  A nil body is trivially replayable.
+func newRewinder(body io.Reader) (*rewinder, bool) {
+	if body == nil {
+		return nil, true
+	}
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return nil, false
+	}
+	off, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+	return &rewinder{seeker: seeker, offset: off}, true
+}
+
+func (r *rewinder) rewind() error {
+	if r == nil {
+		return nil
+	}
+	_, err := r.seeker.Seek(r.offset, io.SeekStart)
+	return err
+}
+
+// hashingReader hashes what is read from a seekable source, and restarts
+// the hash when rewound to where it started so that a retried upload
+// still yields the digest of the payload.
+type hashingReader struct {
+	rd    io.ReadSeeker
+	h     hash.Hash
+	start int64
+	n     int64
+}
+
+func newHashingReader(rd io.ReadSeeker, h hash.Hash) (*hashingReader, error) {
+	start, err := rd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &hashingReader{rd: rd, h: h, start: start}, nil
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.rd.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if pos != r.start {
+		return pos, errors.New("hashingReader: can only rewind to the start")
+	}
+	r.h.Reset()
+	r.n = 0
+	return pos, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// hostRewrite redirects a registry host, or only the repositories under a
+// prefix of it, to another registry, as done in disconnected environments
+// where every external registry is served by an internal mirror.
+type hostRewrite struct {
+	fromHost   string
+	fromPrefix string
+
+	scheme   string
+	host     string
+	basePath string
+	prefix   string
+}
+
+// parseHostRewrites parses a comma-separated list of source=target rules
+// such as ghcr.io=mirror.internal:5000/ghcr.  The source is a host,
+// optionally followed by a repository prefix.  The target is a base URL,
+// https when no scheme is given, whose path is the repository prefix
+// substituted to the source one; a base path is separated from it by a
+// double slash, as in locations.
+func parseHostRewrites(v string) ([]hostRewrite, error) {
+	var rules []hostRewrite
+	for _, spec := range strings.Split(v, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid host_rewrites entry %q, expected source=target", spec)
+		}
+		var rw hostRewrite
+		from = strings.Trim(strings.TrimSpace(from), "/")
+		rw.fromHost, rw.fromPrefix, _ = strings.Cut(from, "/")
+		if rw.fromHost == "" {
+			return nil, fmt.Errorf("invalid host_rewrites entry %q: empty source host", spec)
+		}
+		if rw.fromPrefix != "" {
+			if err := validateRepo(rw.fromPrefix); err != nil {
+				return nil, fmt.Errorf("host_rewrites: %w", err)
+			}
+		}
+
+		to = strings.TrimSpace(to)
+		if !strings.Contains(to, "://") {
+			to = "https://" + to
+		}
+		u, err := url.Parse(to)
+		if err != nil || u.Host == "" || u.User != nil || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid host_rewrites target %q", redactURL(to))
+		}
+		switch u.Scheme {
+		case "http", "https":
+		default:
+			return nil, fmt.Errorf("invalid host_rewrites target %q: unsupported scheme %q", to, u.Scheme)
+		}
+		rw.scheme, rw.host = u.Scheme, u.Host
+		p := strings.TrimLeft(u.Path, "/")
+		if base, rest, ok := strings.Cut(p, "//"); ok {
+			rw.basePath, p = strings.Trim(base, "/"), rest
+		}
+		if rw.prefix = strings.Trim(p, "/"); rw.prefix != "" {
+			if err := validateRepo(rw.prefix); err != nil {
+				return nil, fmt.Errorf("host_rewrites: %w", err)
+			}
+		}
+		rules = append(rules, rw)
+	}
+	return rules, nil
+}
+
+// findHostRewrite returns the rule applying to repo on host, the one with
+// the longest source prefix winning, or nil.
+func findHostRewrite(rules []hostRewrite, host, repo string) *hostRewrite {
+	var best *hostRewrite
+	for i := range rules {
+		rw := &rules[i]
+		if !strings.EqualFold(rw.fromHost, host) || !hasRepoPrefix(repo, rw.fromPrefix) {
+			continue
+		}
+		if best == nil || len(rw.fromPrefix) > len(best.fromPrefix) {
+			best = rw
+		}
+	}
+	return best
+}
+
+// hasRepoPrefix reports whether repo is prefix or lies under it.
+func hasRepoPrefix(repo, prefix string) bool {
+	return prefix == "" || repo == prefix || strings.HasPrefix(repo, prefix+"/")
+}
+
+// repo returns the name of repo on the target registry.  Repositories
+// outside the source prefix are not reachable through the rule.
+func (rw *hostRewrite) repo(repo string) (string, error) {
+	if rw == nil {
+		return repo, nil
+	}
+	if !hasRepoPrefix(repo, rw.fromPrefix) {
+		return "", fmt.Errorf("repository %s is not under %s/%s rewritten by host_rewrites", repo, rw.fromHost, rw.fromPrefix)
+	}
+	rest := strings.Trim(strings.TrimPrefix(repo, rw.fromPrefix), "/")
+	switch {
+	case rw.prefix == "":
+		return rest, nil
+	case rest == "":
+		return rw.prefix, nil
+	}
+	return rw.prefix + "/" + rest, nil
+}
+
+// url rewrites in place an absolute URL the registry handed out under
+// its source name, e.g. in a Location header, and reports whether it did.
+func (rw *hostRewrite) url(u *url.URL) bool {
+	// a rule keeping the host cannot tell source URLs from target ones
+	if rw == nil || !strings.EqualFold(u.Host, rw.fromHost) || strings.EqualFold(rw.host, rw.fromHost) {
+		return false
+	}
+	u.Scheme, u.Host = rw.scheme, rw.host
+	if rest, ok := strings.CutPrefix(u.Path, "/v2/"); ok {
+		if repo, err := rw.repo(rest); err == nil && rest != "" {
+			u.Path = "/v2/" + repo
+		}
+		if rw.basePath != "" {
+			u.Path = "/" + rw.basePath + u.Path
+		}
+		u.RawPath = ""
+	}
+	return true
+}
+
+// logicalLocation is the registry host, base path and repository of the
+// location as given, before host_rewrites apply.
+type logicalLocation struct {
+	host     string
+	basePath string
+	repo     string
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// sizeScanConcurrency is the number of manifests fetched in parallel by
+// SizeEstimate.
+const sizeScanConcurrency = 8
+
+// sizeCache remembers the payload size of each tag, so that repeated
+// Size calls only fetch the manifests written since.
+type sizeCache struct {
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+func (c *sizeCache) get(tag string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.sizes[tag]
+	return n, ok
+}
+
+func (c *sizeCache) set(tag string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes == nil {
+		c.sizes = map[string]int64{}
+	}
+	c.sizes[tag] = n
+}
+
+func (s *ociStore) Size(ctx context.Context) (int64, error) {
+	size, approximate, err := s.SizeEstimate(ctx)
+	if err != nil {
+		return -1, err
+	}
+	if approximate {
+		slog.Warn("oci: repository size is an estimate, raise size_scan_limit for an exact value", "size", size)
+	}
+	return size, nil
+}
+
+// SizeEstimate returns the space used by the packfiles and states of the
+// repository, summing the layer sizes recorded in their manifests.  At
+// most SizeScanLimit manifests not seen before are fetched; the size of
+// the others is then extrapolated from the average and approximate is
+// set.
+func (s *ociStore) SizeEstimate(ctx context.Context) (size int64, approximate bool, err error) {
+	type item struct {
+		r   *ociStore
+		tag string
+	}
+
+	var (
+		known, counted int64
+		pending        []item
+	)
+	for res, prefix := range map[storage.StorageResource]string{
+		storage.StorageResourcePackfile: "packfiles-",
+		storage.StorageResourceState:    "state-",
+	} {
+		r := s.storeFor(res)
+		macs, err := r.listByPrefix(ctx, prefix)
+		if err != nil {
+			return -1, false, err
+		}
+		for _, mac := range macs {
+			tag := fmt.Sprintf("%s%x", prefix, mac)
+			if n, ok := r.sizes.get(tag); ok {
+				known += n
+				counted++
+			} else {
+				pending = append(pending, item{r, tag})
+			}
+		}
+	}
+
+	skipped := 0
+	if limit := s.cfg.SizeScanLimit; limit > 0 && len(pending) > limit {
+		skipped = len(pending) - limit
+		pending = pending[:limit]
+	}
+
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(sizeScanConcurrency)
+	for _, it := range pending {
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			man, _, err := it.r.manifestOf(gctx, it.tag)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			var n int64
+			for _, layer := range man.Layers {
+				n += layer.Size
+			}
+			it.r.sizes.set(it.tag, n)
+
+			mu.Lock()
+			known += n
+			counted++
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return -1, false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return -1, false, err
+	}
+
+	if skipped > 0 && counted > 0 {
+		known += known / counted * int64(skipped)
+	}
+	return known, skipped > 0, nil
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// seedTags tags n packfiles in repo, without manifests behind them, which
+// listing never reads.
+func seedTags(f *fakeRegistry, repo string, n int) map[objects.MAC]struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	macs := map[objects.MAC]struct{}{}
+	f.tags[repo] = map[string]string{}
+	for i := range n {
+		var mac objects.MAC
+		copy(mac[:], fmt.Sprintf("%032d", i))
+		macs[mac] = struct{}{}
+		f.tags[repo][fmt.Sprintf("packfiles-%x", mac)] = "sha256:none"
+	}
+	// not a packfile, and not returned by List
+	f.tags[repo]["CONFIG"] = "sha256:none"
+	return macs
+}
+
+func TestListPaginates(t *testing.T) {
+	tests := []struct {
+		name string
+		// hook rewrites the pages served, nil serves them with a Link
+		// header
+		hook func(f *fakeRegistry) func(w http.ResponseWriter, r *http.Request) bool
+	}{
+		{name: "link header"},
+		{name: "last marker", hook: lastMarkerOnly},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRegistry()
+			f.pageSize = 100
+			if tt.hook != nil {
+				f.hook = tt.hook(f)
+			}
+			want := seedTags(f, "repo", 250)
+			s := openFake(t, f.start(t))
+
+			macs, err := s.List(context.Background(), storage.StorageResourcePackfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(macs) != len(want) {
+				t.Fatalf("listed %d packfiles, want %d", len(macs), len(want))
+			}
+			for _, mac := range macs {
+				if _, ok := want[mac]; !ok {
+					t.Fatalf("listed unknown packfile %x", mac)
+				}
+				delete(want, mac)
+			}
+			if len(want) != 0 {
+				t.Fatalf("%d packfiles listed twice", len(want))
+			}
+			if n := f.count(http.MethodGet, "/tags/list"); n != 3 {
+				t.Fatalf("%d pages fetched, want 3", n)
+			}
+		})
+	}
+}
+
+// lastMarkerOnly serves the tags/list pages of f without a Link header
+// but with a last marker in the body, as some registries do.
+func lastMarkerOnly(f *fakeRegistry) func(w http.ResponseWriter, r *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+			return false
+		}
+		rec := httptest.NewRecorder()
+		f.mu.Lock()
+		f.serveTags(rec, r, "repo")
+		f.mu.Unlock()
+
+		var page tagsList
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			panic(err)
+		}
+		if rec.Header().Get("Link") != "" {
+			page.Last = page.Tags[len(page.Tags)-1]
+		}
+		json.NewEncoder(w).Encode(page)
+		return true
+	}
+}
+
+func TestListEmptyRepository(t *testing.T) {
+	f := newFakeRegistry()
+	f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+			return false
+		}
+		w.Write([]byte(`{"name":"repo","tags":null}`))
+		return true
+	}
+	s := openFake(t, f.start(t))
+	macs, err := s.List(context.Background(), storage.StorageResourceState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 0 {
+		t.Fatalf("listed %d states of an empty repository", len(macs))
+	}
+}
+
+func TestListPaginationLoop(t *testing.T) {
+	f := newFakeRegistry()
+	f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+			return false
+		}
+		w.Header().Set("Link", `</v2/repo/tags/list?n=1&last=a>; rel="next"`)
+		w.Write([]byte(`{"name":"repo","tags":["a"]}`))
+		return true
+	}
+	s := openFake(t, f.start(t))
+	_, err := s.List(context.Background(), storage.StorageResourceState)
+	if err == nil || !strings.Contains(err.Error(), "pagination loops") {
+		t.Fatalf("error %v, want a pagination loop", err)
+	}
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultUploadChunkSize = 64 << 20
+
+// emptyConfig is the config blob of every manifest the store writes,
+// which only carry a payload layer.
+var emptyConfig = []byte("{}")
+
+// emptyConfigDescriptor is the descriptor of emptyConfig.
+var emptyConfigDescriptor = descriptor{
+	MediaType: "application/vnd.oci.image.config.v1+json",
+	Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(emptyConfig)),
+	Size:      int64(len(emptyConfig)),
+}
+
+// uploadOnce runs an upload once, until it is re-armed: concurrent callers
+// wait for the first and share its success, and an upload that failed is
+// tried again by the next caller.  A caller whose wait ends in the failure
+// of another's upload, which may be due to the context of that other
+// caller, tries again with its own.
+type uploadOnce struct {
+	mu  sync.Mutex
+	cur *uploadAttempt
+}
+
+type uploadAttempt struct {
+	once sync.Once
+	err  error
+}
+
+func (u *uploadOnce) do(fn func() error) error {
+	for {
+		u.mu.Lock()
+		if u.cur == nil {
+			u.cur = &uploadAttempt{}
+		}
+		cur := u.cur
+		u.mu.Unlock()
+
+		ran := false
+		cur.once.Do(func() {
+			ran = true
+			if cur.err = fn(); cur.err != nil {
+				u.reset()
+			}
+		})
+		if cur.err == nil || ran {
+			return cur.err
+		}
+	}
+}
+
+// reset re-arms u, for the next call to upload again.
+func (u *uploadOnce) reset() {
+	u.mu.Lock()
+	u.cur = nil
+	u.mu.Unlock()
+}
+
+// pushEmptyConfig uploads emptyConfig, once for the lifetime of the store
+// rather than along with every manifest.
+func (s *ociStore) pushEmptyConfig(ctx context.Context) error {
+	return s.emptyConfig.do(func() error {
+		_, _, _, err := s.pushBlob(ctx, bytes.NewReader(emptyConfig))
+		return err
+	})
+}
+
+// patchChunks uploads rd as a sequence of PATCH requests of at most
+// UploadChunkSize bytes, each with an explicit Content-Length and
+// Content-Range, following the session Location after every chunk.  Each
+// chunk is held in memory so that a failed chunk can be retried without
+// restarting the whole blob: once the retries of the request are spent,
+// or when the registry refuses the range of a chunk it partly received,
+// the upload resumes from the offset the registry reports it committed.
+func (s *ociStore) patchChunks(ctx context.Context, uploadURL string, rd io.Reader, h hash.Hash) (string, int64, error) {
+	buf := make([]byte, s.cfg.UploadChunkSize)
+
+	var offset int64
+	for {
+		n, rerr := io.ReadFull(rd, buf)
+		if rerr != nil && !errors.Is(rerr, io.EOF) && !errors.Is(rerr, io.ErrUnexpectedEOF) {
+			return uploadURL, offset, fmt.Errorf("patch data: %w", rerr)
+		}
+		if n == 0 {
+			break
+		}
+		h.Write(buf[:n])
+
+		var err error
+		if uploadURL, err = s.patchChunk(ctx, uploadURL, offset, buf[:n]); err != nil {
+			return uploadURL, offset, err
+		}
+
+		offset += int64(n)
+		if rerr != nil {
+			break
+		}
+	}
+	return uploadURL, offset, nil
+}
+
+// patchChunk sends chunk, at offset in the upload, and returns the
+// updated session URL.  A chunk that fails is sent again from where the
+// registry says the upload stands, up to RetryMax times: this is the only
+// retry layer of the chunk, each attempt is a single request.
+func (s *ociStore) patchChunk(ctx context.Context, uploadURL string, offset int64, chunk []byte) (string, error) {
+	var sent int64
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		// Content-Length is set explicitly, as the throttled body may no
+		// longer be the bytes.Reader net/http sizes by itself
+		headers := http.Header{}
+		headers.Set("Content-Type", "application/octet-stream")
+		headers.Set("Content-Length", strconv.Itoa(len(chunk)-int(sent)))
+		headers.Set("Content-Range", fmt.Sprintf("%d-%d", offset+sent, offset+int64(len(chunk))-1))
+
+		body := s.throttleUpload(ctx, bytes.NewReader(chunk[sent:]))
+		rc, resp, err := s.doOnce(ctx, "PATCH", uploadURL, body, headers)
+		if err == nil {
+			drainAndClose(rc)
+
+			if resp.StatusCode != http.StatusAccepted {
+				slog.Warn("oci: unexpected status on upload patch", "status", resp.Status, "offset", offset+sent)
+			}
+			if loc := resp.Header.Get("Location"); loc != "" {
+				if uploadURL, err = s.resolveLocation(resp, loc); err != nil {
+					return uploadURL, fmt.Errorf("patch data: %w", err)
+				}
+			}
+			return uploadURL, nil
+		}
+
+		err = fmt.Errorf("patch data at offset %d: %w", offset+sent, err)
+		rangeRefused := resp != nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable
+		if attempt >= s.cfg.RetryMax || !(rangeRefused || isTransient(resp, err)) {
+			return uploadURL, err
+		}
+		if !rangeRefused {
+			delay := backoff(attempt)
+			if wait, throttled := retryAfter(resp, time.Now()); throttled {
+				delay = min(wait, s.cfg.RetryAfterMax)
+			}
+			if time.Since(start)+delay > s.cfg.RetryMaxElapsed {
+				return uploadURL, err
+			}
+			if serr := sleepContext(ctx, delay); serr != nil {
+				return uploadURL, err
+			}
+		}
+		statusURL, committed, serr := s.uploadStatus(ctx, uploadURL)
+		if serr != nil {
+			return uploadURL, errors.Join(err, serr)
+		}
+		if committed < offset || committed > offset+int64(len(chunk)) {
+			return uploadURL, fmt.Errorf("%w: registry holds %d bytes of the upload", err, committed)
+		}
+		uploadURL = statusURL
+		sent = committed - offset
+		slog.Warn("oci: resuming upload", "offset", committed, "error", err)
+		if sent == int64(len(chunk)) {
+			return uploadURL, nil
+		}
+	}
+}
+
+// uploadStatus asks the registry how many bytes of the upload session it
+// committed, and returns them along with the session URL, which the
+// registry may have updated.
+func (s *ociStore) uploadStatus(ctx context.Context, uploadURL string) (string, int64, error) {
+	rc, resp, err := s.do(ctx, "GET", uploadURL, nil, nil)
+	if err != nil {
+		return uploadURL, 0, fmt.Errorf("upload status: %w", err)
+	}
+	drainAndClose(rc)
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if uploadURL, err = s.resolveLocation(resp, loc); err != nil {
+			return uploadURL, 0, fmt.Errorf("upload status: %w", err)
+		}
+	}
+	// no Range means nothing committed, 0-0 the first byte
+	return uploadURL, s.parseUploadedSize(resp.Header.Get("Range")), nil
+}
+
+// spoolMemoryLimit is the payload size up to which spooling happens in
+// memory; larger payloads are spooled to a temporary file.
+const spoolMemoryLimit = 16 << 20
+
+// errLengthRequired is returned when the registry answers 411 to a
+// streaming PATCH.
+var errLengthRequired = errors.New("registry requires Content-Length on uploads")
+
+// spool copies rd to memory, or to a temporary file past spoolMemoryLimit,
+// so that its exact length is known before it is sent.  The returned
+// cleanup function must be called on every path once the spool is no
+// longer needed.
+func spool(ctx context.Context, rd io.Reader) (io.ReadSeeker, func(), error) {
+	buf := &bytes.Buffer{}
+	n, err := io.Copy(buf, io.LimitReader(rd, spoolMemoryLimit+1))
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if n <= spoolMemoryLimit {
+		return bytes.NewReader(buf.Bytes()), func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "plakar-oci-spool-*")
+	if err != nil {
+		return nil, func() {}, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err := io.Copy(f, io.MultiReader(buf, &ctxReader{ctx: ctx, rd: rd})); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	return f, cleanup, nil
+}
+
+// ctxReader stops reading as soon as its context is done.
+type ctxReader struct {
+	ctx context.Context
+	rd  io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.rd.Read(p)
+}
+
+// remaining returns the number of bytes left to read from a seeker.
+func remaining(rs io.Seeker) (int64, error) {
+	cur, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rs.Seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+// writeError returns ErrReadOnly for a store opened with read_only, and
+// an error matching both ErrReadOnly and ErrDenied once the push probe
+// found we may only pull.
+func (s *ociStore) writeError() error {
+	if s.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+	if s.pushDenied.Load() {
+		return fmt.Errorf("%w: no push permission on %s: %w", ErrReadOnly, s.Root(), ErrDenied)
+	}
+	return nil
+}
+
+// writable runs the push probe before the first push, and returns the
+// writeError, if any, before the push makes any request of its own.
+// Deletions do not open upload sessions and do not probe.
+func (s *ociStore) writable(ctx context.Context) error {
+	if !s.cfg.ReadOnly {
+		s.probePush(ctx)
+	}
+	return s.writeError()
+}
+
+// probePush checks, once per store, that we may push to the repository
+// by opening an upload session and cancelling it straight away.  It is
+// run by the first write, not by Open, so that reading, from a mirror
+// even, never writes to the registry.  Only a refusal to open the
+// session marks the store read-only: a registry rejecting the
+// cancellation still let us start an upload.  Other failures leave the
+// store writable, the real upload will tell, and are returned for those
+// who want to know.
+func (s *ociStore) probePush(ctx context.Context) error {
+	if s.cfg.ReadOnly || !s.pushProbed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	uploadURL, err := s.startUpload(ctx)
+	if err != nil {
+		if errors.Is(err, ErrDenied) || errors.Is(err, ErrUnauthorized) {
+			slog.Warn("oci: no push permission on repository, opening read-only", "repository", s.repo, "error", err)
+			s.pushDenied.Store(true)
+			return nil
+		}
+		// try again next time
+		s.pushProbed.Store(false)
+		slog.Debug("oci: push probe failed", "error", err)
+		return err
+	}
+	s.cancelUpload(ctx, uploadURL)
+	return nil
+}
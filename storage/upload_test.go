@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestPatchChunkContentLength(t *testing.T) {
+	for _, bandwidth := range []string{"0", "100MiB"} {
+		t.Run("upload_bandwidth="+bandwidth, func(t *testing.T) {
+			f := newFakeRegistry()
+			s := openFake(t, f.start(t),
+				"upload_chunked", "true",
+				"upload_chunk_size", "1KiB",
+				"upload_bandwidth", bandwidth)
+
+			payload := bytes.Repeat([]byte("0123456789"), 250)
+			if _, err := s.putByTag(context.Background(), "state-01", bytes.NewReader(payload), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			patches := 0
+			for _, r := range f.logged() {
+				if r.method != http.MethodPatch {
+					continue
+				}
+				patches++
+				var start, end int64
+				if _, err := fmt.Sscanf(r.header.Get("Content-Range"), "%d-%d", &start, &end); err != nil {
+					t.Fatalf("PATCH Content-Range %q: %v", r.header.Get("Content-Range"), err)
+				}
+				if r.contentLength != end-start+1 {
+					t.Errorf("PATCH %d-%d sent with Content-Length %d", start, end, r.contentLength)
+				}
+			}
+			if patches < 3 {
+				t.Fatalf("%d PATCH requests, want the payload in 3 chunks at least", patches)
+			}
+		})
+	}
+}
+
+func TestPatchFailureCancelsUpload(t *testing.T) {
+	for _, chunked := range []string{"false", "true"} {
+		t.Run("upload_chunked="+chunked, func(t *testing.T) {
+			f := newFakeRegistry()
+			f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPatch {
+					return false
+				}
+				fakeError(w, http.StatusInternalServerError, "UNKNOWN")
+				return true
+			}
+			s := openFake(t, f.start(t),
+				"upload_chunked", chunked,
+				"upload_chunk_size", "1KiB",
+				"retry_max", "0")
+
+			payload := bytes.Repeat([]byte("0123456789"), 250)
+			_, err := s.putByTag(context.Background(), "state-01", bytes.NewReader(payload), nil)
+			if err == nil || !strings.Contains(err.Error(), "patch data") {
+				t.Fatalf("error %v, want the patch data step to fail", err)
+			}
+			opened, cancelled := f.count(http.MethodPost, "/blobs/uploads/"), f.count(http.MethodDelete, "/blobs/uploads/")
+			if opened == 0 || cancelled != opened {
+				t.Fatalf("%d of %d upload sessions cancelled", cancelled, opened)
+			}
+			if len(f.uploads) != 0 {
+				t.Fatalf("%d upload sessions left open", len(f.uploads))
+			}
+			if _, ok := f.tagged("repo", "state-01"); ok {
+				t.Fatal("manifest pushed despite the failed upload")
+			}
+		})
+	}
+}
+
+// TestPushProbeOnWrite reads from a repository, which must not open an
+// upload session, then writes to it: the first write probes, once, and
+// cancels the session the probe opened.
+func TestPushProbeOnWrite(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	host := f.start(t)
+	if err := openFake(t, host).Create(ctx, []byte("config")); err != nil {
+		t.Fatal(err)
+	}
+	f.reset()
+
+	s := openFake(t, host)
+	if _, err := s.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List(ctx, storage.StorageResourceState); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(http.MethodPost, "/blobs/uploads/"); n != 0 {
+		t.Fatalf("%d upload sessions opened by reads", n)
+	}
+
+	for i := range 2 {
+		if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{byte(i)}, bytes.NewReader([]byte("state"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.count(http.MethodDelete, "/blobs/uploads/"); n != 1 {
+		t.Fatalf("%d upload sessions cancelled, want the probe's", n)
+	}
+	if len(f.uploads) != 0 {
+		t.Fatalf("%d upload sessions left open", len(f.uploads))
+	}
+}
+
+// TestPushDenied refuses to open upload sessions: the first write fails
+// as read-only, and the following ones without a request.
+func TestPushDenied(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+			return false
+		}
+		fakeError(w, http.StatusForbidden, "DENIED")
+		return true
+	}
+	s := openFake(t, f.start(t), "retry_max", "0")
+
+	_, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state")))
+	if !errors.Is(err, ErrDenied) || !errors.Is(err, storage.ErrNotWritable) {
+		t.Fatalf("error %v, want the store read-only", err)
+	}
+	f.reset()
+	if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{2}, bytes.NewReader([]byte("state"))); !errors.Is(err, ErrDenied) {
+		t.Fatalf("second put: error %v, want ErrDenied", err)
+	}
+	if err := s.Delete(ctx, storage.StorageResourceState, objects.MAC{1}); !errors.Is(err, ErrDenied) {
+		t.Fatalf("delete: error %v, want ErrDenied", err)
+	}
+	if n := len(f.logged()); n != 0 {
+		t.Fatalf("%d requests made by writes known to be denied", n)
+	}
+	if mode, err := s.Mode(ctx); err != nil || mode != storage.ModeRead {
+		t.Fatalf("mode %v, %v, want read-only", mode, err)
+	}
+}
+
+// TestPatchChunkRetries fails every PATCH: a chunk is sent RetryMax+1
+// times in all, not again by every retry of the request.
+func TestPatchChunkRetries(t *testing.T) {
+	f := newFakeRegistry()
+	f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPatch {
+			return false
+		}
+		fakeError(w, http.StatusServiceUnavailable, "UNAVAILABLE")
+		return true
+	}
+	s := openFake(t, f.start(t),
+		"upload_chunked", "true",
+		"upload_chunk_size", "1KiB",
+		"retry_max", "2")
+
+	if _, err := s.putByTag(context.Background(), "state-01", bytes.NewReader([]byte("payload")), nil); err == nil {
+		t.Fatal("upload succeeded despite the failed PATCH")
+	}
+	// the config and the payload upload in parallel, the first to fail
+	// cancels the other
+	perSession := map[string]int{}
+	for _, r := range f.logged() {
+		if r.method == http.MethodPatch {
+			perSession[r.path]++
+		}
+	}
+	if n := slices.Max(slices.Collect(maps.Values(perSession))); n != 3 {
+		t.Fatalf("%d PATCH requests for a chunk, want 3", n)
+	}
+}
+
+// TestUploadStatus reads the committed size of an upload session from its
+// Range header, which is absent while nothing is.
+func TestUploadStatus(t *testing.T) {
+	for _, tt := range []struct {
+		rng  string
+		want int64
+	}{
+		{rng: "", want: 0},
+		{rng: "0-0", want: 1},
+		{rng: "0-9", want: 10},
+	} {
+		t.Run("Range="+tt.rng, func(t *testing.T) {
+			f := newFakeRegistry()
+			f.hook = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodGet || !strings.Contains(r.URL.Path, "/blobs/uploads/") {
+					return false
+				}
+				if tt.rng != "" {
+					w.Header().Set("Range", tt.rng)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return true
+			}
+			host := f.start(t)
+			s := openFake(t, host)
+
+			_, got, err := s.uploadStatus(context.Background(), "http://"+host+"/v2/repo/blobs/uploads/1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("%d bytes committed, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUploadSessionsPerPut puts states of different content: each opens
+// one upload session, for its payload, the empty config being uploaded
+// once per store and the push probe run once.
+func TestUploadSessionsPerPut(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRegistry()
+	s := openFake(t, f.start(t))
+
+	const puts = 10
+	for i := range puts {
+		payload := []byte(fmt.Sprintf("state %d", i))
+		if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{byte(i)}, bytes.NewReader(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the payloads, the empty config and the push probe
+	if n := f.count(http.MethodPost, "/blobs/uploads/"); n != puts+2 {
+		t.Fatalf("%d upload sessions for %d puts, want %d", n, puts, puts+2)
+	}
+}